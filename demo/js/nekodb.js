@@ -182,9 +182,11 @@ $(document).ready(function(){
                     series_list.push($(e).text());
                 });
 
+                // about 1000 points per series, nekos reads rollups for wide ranges
+                var resolution = Math.floor((new Date(end) - new Date(start)) / 1000 / 1000);
                 var defered = series_list.map(function(e){
                     qNo++;
-                    var url = api_root + "/series/" + e + "?" + $.param({start: start, end: end});
+                    var url = api_root + "/series/" + e + "?" + $.param({start: start, end: end, resolution: resolution + "s"});
                     return $.getJSON(url, function(r){
                         plot_data.push(r);
                         plot_data.sort(function(a, b){
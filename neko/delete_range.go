@@ -0,0 +1,69 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/codegangsta/cli"
+)
+
+func commandDeleteRange(c *cli.Context) {
+	sname := c.String("series")
+	start_t, err := time.Parse(nekolib.ISO8601, c.String("start"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	end_t, err := time.Parse(nekolib.ISO8601, c.String("end"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	reqHdr := nekolib.ReqDeleteRangeHdr{
+		SeriesName: sname,
+		StartTs:    nekolib.Time2Bytes(start_t),
+		EndTs:      nekolib.Time2Bytes(end_t),
+		Priority:   nekolib.PRIORITY_RAW,
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	buf.WriteByte(byte(nekolib.OP_DELETE))
+	buf.Write(reqHdr.ToBytes())
+
+	s := getSocket(srvHost, srvPort)
+	s.SendBytes(buf.Bytes(), 0)
+
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return
+	}
+	r := map[string]interface{}{}
+	json.Unmarshal(rep[1:], &r)
+	fmt.Printf("%d points deleted\n", int(r["count"].(float64)))
+}
@@ -0,0 +1,55 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/codegangsta/cli"
+)
+
+func commandDropSeries(c *cli.Context) {
+	sname := c.String("series")
+	if sname == "" {
+		fmt.Println("Series name required")
+		return
+	}
+
+	reqHdr := nekolib.ReqSeriesMetaHdr{
+		SeriesName: sname,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	buf.WriteByte(byte(nekolib.OP_DELETE_SERIES))
+	buf.Write(reqHdr.ToBytes())
+
+	s := getSocket(srvHost, srvPort)
+	s.SendBytes(buf.Bytes(), 0)
+
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return
+	}
+	fmt.Printf("Series %s dropped\n", sname)
+}
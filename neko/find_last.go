@@ -0,0 +1,84 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/codegangsta/cli"
+)
+
+// Points are printed newest first
+func commandFindLastPoints(c *cli.Context) {
+	sname := c.String("series")
+	if sname == "" {
+		fmt.Println("Series name required")
+		return
+	}
+
+	// the zero time sets no limit
+	var before time.Time
+	if c.String("before") != "" {
+		var err error
+		if before, err = time.Parse(nekolib.ISO8601, c.String("before")); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
+	reqHdr := nekolib.ReqFindLastHdr{
+		SeriesName: sname,
+		BeforeTs:   nekolib.Time2Bytes(before),
+		Count:      uint16(c.Int("count")),
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.WriteByte(byte(nekolib.OP_FIND_LAST))
+	buf.Write(reqHdr.ToBytes())
+
+	s := getSocket(srvHost, srvPort)
+	s.SendBytes(buf.Bytes(), 0)
+
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return
+	}
+	sinfo := new(nekolib.NekoSeriesInfo)
+	repBuf := bytes.NewBuffer(rep[1:])
+	if err := sinfo.FromBytes(repBuf); err != nil {
+		fmt.Println("Error", err.Error())
+		return
+	}
+	for repBuf.Len() > 0 {
+		r := new(nekolib.NekodRecord)
+		if err := r.FromBytes(repBuf); err != nil {
+			fmt.Println("Error", err.Error())
+			return
+		}
+		ts, _ := nekolib.Bytes2Time(r.Ts)
+		fmt.Printf("%s, %s\n", ts.Format(nekolib.ISO8601),
+			sinfo.FormatValue(r.Value))
+	}
+}
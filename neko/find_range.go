@@ -41,11 +41,22 @@ func commandFindDataPoints(c *cli.Context) {
 		return
 	}
 
+	resolution := time.Duration(0)
+	if c.String("resolution") != "" {
+		resolution, err = time.ParseDuration(c.String("resolution"))
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
 	reqHdr := nekolib.ReqFindByRangeHdr{
 		SeriesName: sname,
 		StartTs:    nekolib.Time2Bytes(start_t),
 		EndTs:      nekolib.Time2Bytes(end_t),
 		Priority:   uint8(0),
+		Resolution: uint32(resolution / time.Second),
+		Fields:     c.String("fields"),
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, 16))
@@ -60,6 +71,17 @@ func commandFindDataPoints(c *cli.Context) {
 		fmt.Println("Error", string(rep[1:]))
 		return
 	}
+	sinfo := new(nekolib.NekoSeriesInfo)
+	ackBuf := bytes.NewBuffer(rep[1:])
+	if err := sinfo.FromBytes(ackBuf); err != nil {
+		fmt.Println("Error", err.Error())
+		return
+	}
+	priority, _ := ackBuf.ReadByte()
+	rollup := nekolib.IsRollupLayer(priority)
+	if rollup {
+		fmt.Println("# time, mean, min, max, count")
+	}
 	count := 0
 READ_STREAM:
 	for more, _ := s.GetRcvmore(); more; more, _ = s.GetRcvmore() {
@@ -80,7 +102,19 @@ READ_STREAM:
 			}
 
 			ts, _ := nekolib.Bytes2Time(r.Ts)
-			fmt.Printf("%s, %s\n", ts.Format(nekolib.ISO8601), string(r.Value))
+			if rollup {
+				rv := new(nekolib.RollupValue)
+				if err := rv.FromBytes(r.Value); err != nil {
+					fmt.Println("Error", err.Error())
+					return
+				}
+				fmt.Printf("%s, %v, %v, %v, %d\n", ts.Format(nekolib.ISO8601),
+					rv.Mean(), rv.Min, rv.Max, rv.Count)
+				count++
+				continue
+			}
+			fmt.Printf("%s, %s\n", ts.Format(nekolib.ISO8601),
+				sinfo.FormatValue(r.Value))
 			count++
 		}
 
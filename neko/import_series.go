@@ -24,6 +24,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -42,6 +43,23 @@ func commandImportSeries(c *cli.Context) {
 		return
 	}
 
+	// csv columns after time mapped to fields, empty names skip a column
+	var fields []string
+	if f := c.String("fields"); f != "" {
+		fields = strings.Split(f, ",")
+	}
+
+	durability, err := nekolib.ParseDurability(c.String("durability"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	consistency, err := nekolib.ParseConsistency(c.String("consistency"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
 	seriesFileName := c.Args()[0]
 	fi, err := os.Open(seriesFileName)
 
@@ -55,7 +73,9 @@ func commandImportSeries(c *cli.Context) {
 	bench_start := time.Now()
 
 	reqHdr := &nekolib.ReqImportSeriesHdr{
-		SeriesName: seriesName,
+		SeriesName:  seriesName,
+		Durability:  durability,
+		Consistency: consistency,
 	}
 	buf := bytes.NewBuffer(make([]byte, 0))
 	buf.WriteByte(byte(nekolib.OP_IMPORT_SERIES))
@@ -75,9 +95,19 @@ func commandImportSeries(c *cli.Context) {
 		if err != nil {
 			break
 		}
+		value := tokens[1]
+		if len(fields) > 0 {
+			q := url.Values{}
+			for i, name := range fields {
+				if name != "" && i+1 < len(tokens) && tokens[i+1] != "" {
+					q.Set(name, tokens[i+1])
+				}
+			}
+			value = q.Encode()
+		}
 		record := nekolib.NekodRecord{
 			Ts:    nekolib.Time2Bytes(t),
-			Value: []byte(tokens[1]),
+			Value: []byte(value),
 		}
 		s.SendBytes(record.ToBytes(), zmq.SNDMORE)
 	}
@@ -87,7 +117,15 @@ func commandImportSeries(c *cli.Context) {
 
 	s.SendBytes([]byte{0, 0}, 0)
 
-	b, _ := s.Recv(0)
-	fmt.Printf("%v\n", b)
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return
+	}
+	fmt.Println(string(rep[1:]))
 	fmt.Fprintln(os.Stderr, time.Since(bench_start))
 }
@@ -0,0 +1,121 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/codegangsta/cli"
+)
+
+// Points are given as arguments in the form of "timestamp,value", the
+// timestamp defaults to now if omitted.
+func commandInsertPoints(c *cli.Context) {
+	sname := c.String("series")
+	if sname == "" {
+		fmt.Println("Series name required")
+		return
+	}
+	if len(c.Args()) == 0 {
+		fmt.Println("No points given")
+		return
+	}
+	if len(c.Args()) > nekolib.MAX_INSERT_POINTS {
+		fmt.Printf("At most %d points per insert, use import instead\n",
+			nekolib.MAX_INSERT_POINTS)
+		return
+	}
+
+	durability, err := nekolib.ParseDurability(c.String("durability"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	consistency, err := nekolib.ParseConsistency(c.String("consistency"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	records := make([]*nekolib.NekodRecord, 0, len(c.Args()))
+	for _, arg := range c.Args() {
+		t, value := time.Now(), arg
+		if tokens := strings.SplitN(arg, ",", 2); len(tokens) == 2 {
+			var err error
+			if t, err = time.Parse(nekolib.ISO8601, tokens[0]); err != nil {
+				fmt.Println(err.Error())
+				return
+			}
+			value = tokens[1]
+		}
+		records = append(records, &nekolib.NekodRecord{
+			Ts:    nekolib.Time2Bytes(t),
+			Value: []byte(value),
+		})
+	}
+
+	reqHdr := nekolib.ReqInsertHdr{
+		SeriesName:  sname,
+		Count:       uint16(len(records)),
+		Durability:  durability,
+		Consistency: consistency,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 64))
+	buf.WriteByte(byte(nekolib.OP_INSERT))
+	buf.Write(reqHdr.ToBytes())
+	for _, r := range records {
+		buf.Write(r.ToBytes())
+	}
+
+	s := getSocket(srvHost, srvPort)
+	s.SendBytes(buf.Bytes(), 0)
+
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return
+	}
+
+	var result struct {
+		Count      int `json:"count"`
+		Duplicates int `json:"duplicates"`
+		Errors     []struct {
+			Index int    `json:"index"`
+			Error string `json:"error"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(rep[1:], &result); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	for _, e := range result.Errors {
+		fmt.Printf("Error %s: %s\n", c.Args()[e.Index], e.Error)
+	}
+	fmt.Printf("%d points inserted, %d at existing timestamps\n",
+		result.Count, result.Duplicates)
+}
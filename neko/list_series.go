@@ -27,8 +27,14 @@ import (
 )
 
 func commandListSeries(c *cli.Context) {
+	if _, err := nekolib.ParseTagMatchers(c.String("match")); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	reqHdr := nekolib.ReqListSeriesHdr{Match: c.String("match")}
+
 	s := getSocket(srvHost, srvPort)
-	s.SendBytes([]byte{nekolib.OP_LIST_SERIES}, 0)
+	s.SendBytes(append([]byte{nekolib.OP_LIST_SERIES}, reqHdr.ToBytes()...), 0)
 
 	rep, err := s.RecvBytes(0)
 	if err != nil {
@@ -43,11 +49,13 @@ func commandListSeries(c *cli.Context) {
 		json.Unmarshal(rep[1:], &seriesList)
 		for _, series := range seriesList {
 			fmt.Printf(
-				"name: %s, id: %s, count: %d, fragLevel: %d\n",
+				"name: %s, id: %s, count: %d, fragLevel: %d, type: %s, tags: %s\n",
 				series.Name,
 				series.Id,
 				series.Count,
 				series.FragLevel,
+				nekolib.ValueTypeName(series.ValueType),
+				nekolib.FormatTags(series.Tags),
 			)
 		}
 	}
@@ -39,9 +39,11 @@ func main() {
 	}
 	app.Commands = []cli.Command{
 		{
-			Name:   "list",
-			Usage:  "List Series",
-			Flags:  []cli.Flag{},
+			Name:  "list",
+			Usage: "List Series",
+			Flags: []cli.Flag{
+				cli.StringFlag{"match, m", "", "Tag matchers, eg: site=beijing,sensor=~temp.*"},
+			},
 			Action: commandListSeries,
 		},
 		{
@@ -51,6 +53,9 @@ func main() {
 				cli.StringFlag{"name, n", "", "Series Name"},
 				cli.StringFlag{"id", "", "Series Id"},
 				cli.IntFlag{"level, l", nekolib.SLICE_FRAG_LEVEL_DEFAULT, "Fragmentation Level"},
+				cli.StringFlag{"fields, f", "", "Fields of the csv columns after time, eg: temperature,,pressure skips the 2nd one"},
+				cli.StringFlag{"durability, d", "", "Durability, one of nowal, wal, sync, empty for the series default"},
+				cli.StringFlag{"consistency, c", "", "Replicas to acknowledge, one of one, quorum, all, empty for the series default"},
 			},
 			Action: commandImportSeries,
 		},
@@ -61,9 +66,41 @@ func main() {
 				cli.StringFlag{"name, n", "", "Series Name"},
 				cli.StringFlag{"id", "", "Series Id"},
 				cli.IntFlag{"level, l", nekolib.SLICE_FRAG_LEVEL_DEFAULT, "Fragmentation Level"},
+				cli.StringFlag{"type, t", "float64", "Value Type: float64, int64, bool, string or bytes"},
+				cli.StringFlag{"fields, f", "", "Fields of a multi-field series, eg: temperature:float64,humidity:float64"},
+				cli.BoolFlag{"compress, c", "Store frag blocks gorilla compressed"},
+				cli.StringFlag{"retention, r", "", "Retention, eg: 720h, empty to keep data forever"},
+				cli.IntFlag{"write-buffer-size", 0, "RocksDB write buffer size in bytes, 0 for the nekod default"},
+				cli.StringFlag{"block-compression", "", "RocksDB compression, empty for the nekod default"},
+				cli.IntFlag{"bloom-bits", 0, "RocksDB bloom filter bits per key, 0 for the nekod default"},
+				cli.StringFlag{"durability", "", "Default durability of writes, one of nowal, wal, sync"},
+				cli.StringFlag{"tags", "", "Tags, eg: site=beijing,sensor=temp"},
+				cli.StringFlag{"duplicates", "last", "Points at a stored timestamp: last, first, reject or keep"},
+				cli.IntFlag{"replicas", 1, "Number of peers keeping each frag block"},
+				cli.StringFlag{"consistency", "", "Default replicas to acknowledge writes, one of one, quorum, all"},
 			},
 			Action: commandNewSeries,
 		},
+		{
+			Name:  "insert",
+			Usage: "Insert data points, eg: insert -s temp 2014-01-01T00:00:00.000+0800,21.5, or temperature=21.5&humidity=60 as the value of a multi-field series",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+				cli.StringFlag{"durability, d", "", "Durability, one of nowal, wal, sync, empty for the series default"},
+				cli.StringFlag{"consistency, c", "", "Replicas to acknowledge, one of one, quorum, all, empty for the series default"},
+			},
+			Action: commandInsertPoints,
+		},
+		{
+			Name:  "last",
+			Usage: "Find the newest data points",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+				cli.IntFlag{"count, n", 1, "Number of points"},
+				cli.StringFlag{"before", "", "Latest Time, eg: 2012-12-21T23:59:59.999+0800, empty for no limit"},
+			},
+			Action: commandFindLastPoints,
+		},
 		{
 			Name:  "find",
 			Usage: "Find data points",
@@ -71,9 +108,55 @@ func main() {
 				cli.StringFlag{"series, s", "", "Series Name"},
 				cli.StringFlag{"start", "", "Start Time, eg: 1970-01-01T00:00:00.000+0800"},
 				cli.StringFlag{"end", "", "End Time, eg: 2012-12-21T23:59:59.999+0800"},
+				cli.StringFlag{"resolution, r", "", "Resolution, eg: 1h, numeric series answer from rollups"},
+				cli.StringFlag{"fields, f", "", "Fields of a multi-field series to show, eg: temperature,humidity"},
 			},
 			Action: commandFindDataPoints,
 		},
+		{
+			Name:  "delete",
+			Usage: "Delete data points in a time range",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+				cli.StringFlag{"start", "", "Start Time, eg: 1970-01-01T00:00:00.000+0800"},
+				cli.StringFlag{"end", "", "End Time, eg: 2012-12-21T23:59:59.999+0800"},
+			},
+			Action: commandDeleteRange,
+		},
+		{
+			Name:  "drop-series",
+			Usage: "Drop a series and all of its data",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+			},
+			Action: commandDropSeries,
+		},
+		{
+			Name:  "recount",
+			Usage: "Rebuild element counters of a series from stored data",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+			},
+			Action: commandRecountSeries,
+		},
+		{
+			Name:  "snapshot",
+			Usage: "Snapshot a series on every peer",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+				cli.StringFlag{"tag, t", "", "Snapshot Tag"},
+			},
+			Action: commandSnapshotSeries,
+		},
+		{
+			Name:  "restore",
+			Usage: "Restore a dropped series from a snapshot",
+			Flags: []cli.Flag{
+				cli.StringFlag{"series, s", "", "Series Name"},
+				cli.StringFlag{"tag, t", "", "Snapshot Tag"},
+			},
+			Action: commandRestoreSeries,
+		},
 	}
 	app.Before = func(c *cli.Context) error {
 		srvHost = c.String("host")
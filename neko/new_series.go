@@ -22,6 +22,7 @@ import (
 	// "os"
 	// "encoding/binary"
 	"bytes"
+	"time"
 
 	"github.com/bigeagle/nekodb/nekolib"
 	"github.com/codegangsta/cli"
@@ -29,6 +30,60 @@ import (
 
 func commandNewSeries(c *cli.Context) {
 	fmt.Printf("Nekos: %s:%d\n", srvHost, srvPort)
+
+	vtype, err := nekolib.ParseValueType(c.String("type"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	var retention time.Duration
+	if r := c.String("retention"); r != "" {
+		if retention, err = time.ParseDuration(r); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+	}
+
+	durability, err := nekolib.ParseDurability(c.String("durability"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	tags, err := nekolib.ParseTags(c.String("tags"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	fields, err := nekolib.ParseFields(c.String("fields"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	if len(fields) > 0 {
+		vtype = nekolib.VALUE_FIELDS
+	}
+
+	dupPolicy, err := nekolib.ParseDuplicatePolicy(c.String("duplicates"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	consistency, err := nekolib.ParseConsistency(c.String("consistency"))
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+
+	replicas := c.Int("replicas")
+	if replicas < 1 || replicas > 255 {
+		fmt.Println("Replicas must be between 1 and 255")
+		return
+	}
+
 	s := getSocket(srvHost, srvPort)
 
 	series := nekolib.NekoSeriesInfo{
@@ -41,7 +96,27 @@ func commandNewSeries(c *cli.Context) {
 				return c.String("name")
 			}
 		}(),
-		FragLevel: c.Int("level"),
+		FragLevel:  c.Int("level"),
+		ValueType:  vtype,
+		Retention:  int64(retention / time.Second),
+		Durability: durability,
+		Tags:       tags,
+
+		DuplicatePolicy: dupPolicy,
+		Fields:          fields,
+		Replicas:        uint8(replicas),
+		Consistency:     consistency,
+	}
+	if c.Bool("compress") {
+		series.Compression = nekolib.COMPRESS_GORILLA
+	}
+	tuning := nekolib.SeriesTuning{
+		WriteBufferSize:  c.Int("write-buffer-size"),
+		BlockCompression: c.String("block-compression"),
+		BloomBits:        c.Int("bloom-bits"),
+	}
+	if tuning != (nekolib.SeriesTuning{}) {
+		series.Tuning = &tuning
 	}
 	fmt.Printf("%#v\n", series)
 	buf := bytes.NewBuffer(make([]byte, 0, 16))
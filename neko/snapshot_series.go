@@ -0,0 +1,76 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/codegangsta/cli"
+)
+
+func snapshotRequest(c *cli.Context, opcode uint8) ([]byte, bool) {
+	sname, tag := c.String("series"), c.String("tag")
+	if sname == "" || tag == "" {
+		fmt.Println("Series name and snapshot tag required")
+		return nil, false
+	}
+
+	reqHdr := nekolib.ReqSnapshotHdr{
+		SeriesName: sname,
+		Tag:        tag,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.WriteByte(byte(opcode))
+	buf.Write(reqHdr.ToBytes())
+
+	s := getSocket(srvHost, srvPort)
+	s.SendBytes(buf.Bytes(), 0)
+
+	rep, err := s.RecvBytes(0)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, false
+	}
+	if uint8(rep[0]) != nekolib.REP_OK {
+		fmt.Println("Error", string(rep[1:]))
+		return nil, false
+	}
+	return rep[1:], true
+}
+
+func commandSnapshotSeries(c *cli.Context) {
+	if _, ok := snapshotRequest(c, nekolib.OP_SNAPSHOT); ok {
+		fmt.Printf("Series %s saved as snapshot %s\n", c.String("series"), c.String("tag"))
+	}
+}
+
+func commandRestoreSeries(c *cli.Context) {
+	rep, ok := snapshotRequest(c, nekolib.OP_RESTORE)
+	if !ok {
+		return
+	}
+	var sinfo nekolib.NekoSeriesInfo
+	if err := json.Unmarshal(rep, &sinfo); err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	fmt.Printf("Series %s (%s) restored from snapshot %s\n", sinfo.Name, sinfo.Id, c.String("tag"))
+}
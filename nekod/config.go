@@ -33,8 +33,34 @@ type Config struct {
 	Hostname   string   `toml:"hostname"`
 	Virtuals   int      `toml:"virtuals"`
 	DataPath   string   `toml:"data_path"`
+	Engine     string   `toml:"engine"`
 	Debug      bool     `toml:"debug"`
 	EtcdPeers  []string `toml:"etcd_peers"`
+	// seconds between two retention runs
+	RetentionInterval int `toml:"retention_interval"`
+	// series snapshots are kept under SnapshotPath/<tag>/<series name>
+	SnapshotPath string `toml:"snapshot_path"`
+	// series are opened on demand, at most MaxOpenSeries of them stay
+	// open and those idle for SeriesIdleTimeout seconds are closed. 0
+	// disables either limit.
+	MaxOpenSeries     int `toml:"max_open_series"`
+	SeriesIdleTimeout int `toml:"series_idle_timeout"`
+	// seconds to let the ring settle before handing blocks this peer no
+	// longer owns to their owners, 0 disables rebalancing
+	RebalanceDelay int `toml:"rebalance_delay"`
+	// writes kept for peers which are away, in bytes per peer at most.
+	// Hints not added to for HintsTTL seconds are dropped, 0 keeps them.
+	HintsMaxSize int64 `toml:"hints_max_size"`
+	HintsTTL     int   `toml:"hints_ttl"`
+	// RocksDB tuning, series may override write buffer size, compression
+	// and bloom bits in their metadata. DbWriteBufferSize caps memtables
+	// of all series together.
+	BlockCacheSize    int    `toml:"block_cache_size"`
+	WriteBufferSize   int    `toml:"write_buffer_size"`
+	DbWriteBufferSize int    `toml:"db_write_buffer_size"`
+	Compression       string `toml:"compression"`
+	BloomBits         int    `toml:"bloom_bits"`
+	MaxOpenFiles      int    `toml:"max_open_files"`
 }
 
 func loadConfig(cfgFile string, arguments []string) (*Config, error) {
@@ -52,8 +78,18 @@ func loadConfig(cfgFile string, arguments []string) (*Config, error) {
 	cfg.Domain = ""
 	cfg.Hostname = ""
 	cfg.DataPath = "/var/lib/nekodb"
+	cfg.Engine = ENGINE_ROCKSDB
 	cfg.Virtuals = 1
 	cfg.Debug = false
+	cfg.RetentionInterval = 3600
+	cfg.SnapshotPath = "/var/lib/nekodb-snapshots"
+	cfg.MaxOpenSeries = 1024
+	cfg.SeriesIdleTimeout = 600
+	cfg.RebalanceDelay = 30
+	cfg.HintsMaxSize = 1 << 30
+	cfg.HintsTTL = 3 * 24 * 3600
+
+	engineDefaults(cfg)
 
 	if cfgFile != "" {
 		if _, err := toml.DecodeFile(cfgFile, cfg); err != nil {
@@ -80,8 +116,22 @@ func loadConfig(cfgFile string, arguments []string) (*Config, error) {
 	f.StringVar(&cfg.Hostname, "hostname", cfg.Hostname, "Host Name")
 	f.IntVar(&cfg.Virtuals, "virtuals", cfg.Virtuals, "Number of virtual nodes")
 	f.StringVar(&cfg.DataPath, "data-path", cfg.DataPath, "Path to store data")
+	f.StringVar(&cfg.Engine, "engine", cfg.Engine, "Storage engine, rocksdb or memory")
 	f.StringVar(&etcdPeers, "etcd-peers", "", "Etcd peers")
 	f.BoolVar(&cfg.Debug, "debug", cfg.Debug, "Debug Mode")
+	f.IntVar(&cfg.RetentionInterval, "retention-interval", cfg.RetentionInterval, "Seconds between retention runs")
+	f.StringVar(&cfg.SnapshotPath, "snapshot-path", cfg.SnapshotPath, "Path to store snapshots")
+	f.IntVar(&cfg.MaxOpenSeries, "max-open-series", cfg.MaxOpenSeries, "Max series kept open")
+	f.IntVar(&cfg.SeriesIdleTimeout, "series-idle-timeout", cfg.SeriesIdleTimeout, "Seconds before idle series are closed")
+	f.IntVar(&cfg.RebalanceDelay, "rebalance-delay", cfg.RebalanceDelay, "Seconds to let the ring settle before rebalancing, 0 disables it")
+	f.Int64Var(&cfg.HintsMaxSize, "hints-max-size", cfg.HintsMaxSize, "Bytes of writes kept for a peer which is away")
+	f.IntVar(&cfg.HintsTTL, "hints-ttl", cfg.HintsTTL, "Seconds before writes kept for a peer which is away are dropped, 0 keeps them")
+	f.IntVar(&cfg.BlockCacheSize, "block-cache-size", cfg.BlockCacheSize, "RocksDB block cache size in bytes")
+	f.IntVar(&cfg.WriteBufferSize, "write-buffer-size", cfg.WriteBufferSize, "RocksDB write buffer size in bytes")
+	f.IntVar(&cfg.DbWriteBufferSize, "db-write-buffer-size", cfg.DbWriteBufferSize, "RocksDB write buffer size of all series together in bytes")
+	f.StringVar(&cfg.Compression, "compression", cfg.Compression, "RocksDB compression, one of none, snappy, zlib, bz2, lz4, lz4hc")
+	f.IntVar(&cfg.BloomBits, "bloom-bits", cfg.BloomBits, "RocksDB bloom filter bits per key")
+	f.IntVar(&cfg.MaxOpenFiles, "max-open-files", cfg.MaxOpenFiles, "RocksDB max open files")
 
 	// Begin Ignored  (for usage message)
 	f.BoolVar(&showVersion, "version", false, "Print Version")
@@ -0,0 +1,275 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+var HintsFull = errors.New("Hints Full")
+
+const (
+	HINTS_DIR = "hints"
+	// hints handed out by Take stay here until dropped, so that a failed
+	// replay is retried with the next one
+	HINTS_REPLAYING_SUFFIX = ".replaying"
+)
+
+// Write to be handed to its owner, the header of OP_INSERT_BATCH and the
+// records packed back to back
+type hint struct {
+	hdr     []byte
+	records []byte
+}
+
+// hintStore keeps writes meant for peers which were away, in one append
+// only file per owner of maxSize bytes at most, 0 sets no limit
+type hintStore struct {
+	m       sync.Mutex
+	dir     string
+	maxSize int64
+}
+
+func newHintStore(dataPath string, maxSize int64) (*hintStore, error) {
+	dir := path.Join(dataPath, HINTS_DIR)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &hintStore{dir: dir, maxSize: maxSize}, nil
+}
+
+func (h *hintStore) file(owner string) string {
+	return path.Join(h.dir, url.QueryEscape(owner))
+}
+
+func writeChunk(w io.Writer, b []byte) error {
+	if err := binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+func readChunk(buf *bytes.Buffer) ([]byte, error) {
+	var l uint32
+	if err := binary.Read(buf, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	if int(l) > buf.Len() {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Next(int(l)), nil
+}
+
+// size of the hints of owner, a replay not dropped included
+func (h *hintStore) size(owner string) int64 {
+	size := int64(0)
+	for _, name := range []string{h.file(owner), h.file(owner) + HINTS_REPLAYING_SUFFIX} {
+		if fi, err := os.Stat(name); err == nil {
+			size += fi.Size()
+		}
+	}
+	return size
+}
+
+// Add appends a hint for owner and syncs it to disk, HintsFull is
+// returned once hints of owner reach maxSize
+func (h *hintStore) Add(owner string, hdr, records []byte) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.maxSize > 0 && h.size(owner)+int64(len(hdr)+len(records)+8) > h.maxSize {
+		return HintsFull
+	}
+	f, err := os.OpenFile(h.file(owner), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := new(bytes.Buffer)
+	writeChunk(buf, hdr)
+	writeChunk(buf, records)
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Take returns the hints of owner, including those of a replay which has
+// not been dropped. They are kept until Drop.
+func (h *hintStore) Take(owner string) ([]hint, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	name := h.file(owner)
+	replaying := name + HINTS_REPLAYING_SUFFIX
+	if data, err := ioutil.ReadFile(name); err == nil {
+		f, err := os.OpenFile(replaying, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(data)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Remove(name); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(replaying)
+	if os.IsNotExist(err) {
+		return []hint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return readHints(data)
+}
+
+func readHints(data []byte) ([]hint, error) {
+	hints := []hint{}
+	for buf := bytes.NewBuffer(data); buf.Len() > 0; {
+		hdr, err := readChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+		records, err := readChunk(buf)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, hint{hdr, records})
+	}
+	return hints, nil
+}
+
+// Drop removes hints of owner handed out by Take and returns them
+func (h *hintStore) Drop(owner string) ([]hint, error) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	name := h.file(owner) + HINTS_REPLAYING_SUFFIX
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return []hint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	hints, err := readHints(data)
+	if err != nil {
+		// dropped anyway, the owner has them
+		logger.Error(err.Error())
+	}
+	return hints, os.Remove(name)
+}
+
+// Expire removes hints not added to for ttl, their owner is not coming
+// back
+func (h *hintStore) Expire(ttl time.Duration) error {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	files, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if time.Since(fi.ModTime()) < ttl {
+			continue
+		}
+		logger.Info("hints %s expired", fi.Name())
+		if err := os.Remove(path.Join(h.dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *nekoBackendServer) handleHintExpiry() {
+	if s.cfg.HintsTTL <= 0 {
+		return
+	}
+	ttl := time.Duration(s.cfg.HintsTTL) * time.Second
+	go func() {
+		for _ = range time.Tick(ttl / 4) {
+			if err := s.hints.Expire(ttl); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+	}()
+}
+
+// dropHandedOff forgets blocks of hints handed over to their owner which
+// this peer kept only while standing in for it. Blocks it owns are kept.
+func (s *nekoBackendServer) dropHandedOff(hints []hint) {
+	ring := s.view.ring()
+	if ring.Len() == 0 {
+		// ownership unknown without rebalancing
+		return
+	}
+	type block struct {
+		series string
+		hash   uint32
+	}
+	visited := make(map[block]bool)
+	for _, h := range hints {
+		var hdr nekolib.ReqInsertBlockHdr
+		if err := hdr.FromBytes(bytes.NewBuffer(h.hdr)); err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		b := block{hdr.SeriesName, hdr.HashValue}
+		if visited[b] {
+			continue
+		}
+		visited[b] = true
+		sInfo, found := s.seriesColl.getInfo(hdr.SeriesName)
+		if !found || ring.Owns(s.cfg.Name, hdr.HashValue, sInfo.ReplicaCount()) {
+			continue
+		}
+		series, err := s.GetSeries(hdr.SeriesName)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		if n, err := series.DropBlock(hdr.HashValue); err != nil {
+			logger.Error("series %s: %s", hdr.SeriesName, err.Error())
+		} else {
+			logger.Info("series %s: %d points kept for their owner dropped", hdr.SeriesName, n)
+		}
+		s.ReleaseSeries(series)
+	}
+}
@@ -0,0 +1,516 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+// Package nekomem keeps series in memory. It needs no cgo and holds no
+// state across restarts, which suits tests and ephemeral peers. Series
+// outlive Close within the process, snapshots are plain files.
+package nekomem
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+var (
+	InvalidTimestamp = errors.New("Invalid Timestamp")
+	SeriesClosed     = errors.New("Series Closed")
+	SeriesExists     = errors.New("Series Exists")
+)
+
+// series of this process by id, closed ones included
+var (
+	registry  = make(map[string]*Series)
+	registryM sync.Mutex
+)
+
+type point struct {
+	ts    int64
+	value []byte
+}
+
+// frag block bounds registered by ReverseHash, in unix nanoseconds
+type blockRange struct {
+	start, end int64
+}
+
+type Series struct {
+	m      sync.RWMutex
+	closed bool
+
+	// points of every priority layer, sorted by time. Rollup layers are
+	// computed from the raw layer when read.
+	layers map[uint8][]point
+	blocks map[uint32]blockRange
+
+	Name        string
+	Id          string
+	FragLevel   int
+	ValueType   uint8
+	Compression uint8
+	// one of nekolib.DUP_*
+	DuplicatePolicy uint8
+}
+
+// NewSeries creates an empty series, replacing any series of the same id
+func NewSeries(info *nekolib.NekoSeriesInfo) *Series {
+	s := &Series{
+		layers:      make(map[uint8][]point),
+		blocks:      make(map[uint32]blockRange),
+		Name:        info.Name,
+		Id:          info.Id,
+		FragLevel:   info.FragLevel,
+		ValueType:   info.ValueType,
+		Compression: info.Compression,
+
+		DuplicatePolicy: info.DuplicatePolicy,
+	}
+	registryM.Lock()
+	defer registryM.Unlock()
+	registry[s.Id] = s
+	return s
+}
+
+// HasSeries tells whether a series of id was created and not destroyed
+func HasSeries(id string) bool {
+	registryM.Lock()
+	defer registryM.Unlock()
+	_, found := registry[id]
+	return found
+}
+
+// GetSeries opens a series created before, with the points it had when
+// it was closed
+func GetSeries(id string) (*Series, error) {
+	registryM.Lock()
+	s, found := registry[id]
+	registryM.Unlock()
+	if !found {
+		return nil, fmt.Errorf("series %s not found", id)
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = false
+	return s, nil
+}
+
+// DestroySeries drops the points of series id
+func DestroySeries(id string) error {
+	registryM.Lock()
+	s, found := registry[id]
+	registryM.Unlock()
+	if !found {
+		return nil
+	}
+	return s.Destroy()
+}
+
+func (s *Series) Info() *nekolib.NekoSeriesInfo {
+	return &nekolib.NekoSeriesInfo{
+		Name:        s.Name,
+		Id:          s.Id,
+		FragLevel:   s.FragLevel,
+		ValueType:   s.ValueType,
+		Compression: s.Compression,
+
+		DuplicatePolicy: s.DuplicatePolicy,
+	}
+}
+
+func wireNano(ts []byte) (int64, error) {
+	t, err := nekolib.Bytes2Time(ts)
+	if err != nil {
+		return 0, InvalidTimestamp
+	}
+	return t.UnixNano(), nil
+}
+
+func wireTs(ns int64) []byte {
+	return nekolib.Time2Bytes(time.Unix(0, ns).UTC())
+}
+
+// seconds since year 1 of a unix nanosecond timestamp, as used by frag
+// blocks
+func nanoSec(ns int64) int64 {
+	return time.Unix(0, ns).Unix() + nekolib.UNIX_TO_INTERNAL
+}
+
+// search returns the index of the first point not before ns
+func search(pts []point, ns int64) int {
+	return sort.Search(len(pts), func(i int) bool { return pts[i].ts >= ns })
+}
+
+func (s *Series) Count() (int, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return 0, SeriesClosed
+	}
+	count := 0
+	for _, pts := range s.layers {
+		count += len(pts)
+	}
+	return count, nil
+}
+
+// Recount is Count, counts of memory series are always exact
+func (s *Series) Recount() (int, error) {
+	return s.Count()
+}
+
+func (s *Series) Insert(key, value []byte, priority uint8) error {
+	_, err := s.InsertBatch([]*nekolib.NekodRecord{{key, value}}, priority, nekolib.DURABILITY_WAL)
+	return err
+}
+
+// PutRollups keeps nothing, rollup layers are computed from the raw layer
+// when read
+func (s *Series) PutRollups(records []*nekolib.NekodRecord, priority uint8, durability uint8) error {
+	if !nekolib.IsRollupLayer(priority) {
+		return fmt.Errorf("priority %d is not a rollup layer", priority)
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return SeriesClosed
+	}
+	return nil
+}
+
+// InsertBatch ignores durability, nothing survives a restart anyway.
+// Points at timestamps already stored are handled by the duplicate policy
+// of the series, their number is returned.
+func (s *Series) InsertBatch(records []*nekolib.NekodRecord, priority uint8, durability uint8) (int, error) {
+	if nekolib.IsRollupLayer(priority) {
+		return 0, fmt.Errorf("priority %d is a rollup layer", priority)
+	}
+	ts := make([]int64, len(records))
+	for i, r := range records {
+		ns, err := wireNano(r.Ts)
+		if err != nil {
+			return 0, err
+		}
+		if err := nekolib.ValidateValue(s.ValueType, r.Value); err != nil {
+			return 0, err
+		}
+		ts[i] = ns
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return 0, SeriesClosed
+	}
+	if s.DuplicatePolicy == nekolib.DUP_REJECT {
+		seen := make(map[int64]bool, len(records))
+		for _, ns := range ts {
+			if seen[ns] || s.has(priority, ns) {
+				return 0, nekolib.DuplicateTimestamps
+			}
+			seen[ns] = true
+		}
+	}
+	dups := 0
+	for i, r := range records {
+		if s.put(priority, ts[i], append([]byte{}, r.Value...)) {
+			dups++
+		}
+	}
+	return dups, nil
+}
+
+func (s *Series) has(priority uint8, ns int64) bool {
+	pts := s.layers[priority]
+	i := search(pts, ns)
+	return i < len(pts) && pts[i].ts == ns
+}
+
+// put inserts a point following the duplicate policy, it tells whether
+// a point at the same time was already there
+func (s *Series) put(priority uint8, ns int64, value []byte) bool {
+	pts := s.layers[priority]
+	// versions kept of a time stay in the order they were written
+	i := search(pts, ns+1)
+	dup := i > 0 && pts[i-1].ts == ns
+	if dup && s.DuplicatePolicy == nekolib.DUP_FIRST_WINS {
+		return true
+	}
+	if dup && s.DuplicatePolicy != nekolib.DUP_KEEP_ALL {
+		pts[i-1].value = value
+		return true
+	}
+	pts = append(pts, point{})
+	copy(pts[i+1:], pts[i:])
+	pts[i] = point{ns, value}
+	s.layers[priority] = pts
+	return dup
+}
+
+func (s *Series) RangeOp(start, end []byte, priority uint8, op func(key, value []byte)) {
+	startNs, err := wireNano(start)
+	if err != nil {
+		return
+	}
+	endNs, err := wireNano(end)
+	if err != nil {
+		return
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return
+	}
+	if nekolib.IsRollupLayer(priority) {
+		s.rollupOp(startNs, endNs, priority, op)
+		return
+	}
+	pts := s.layers[priority]
+	for i := search(pts, startNs); i < len(pts) && pts[i].ts <= endNs; i++ {
+		op(wireTs(pts[i].ts), pts[i].value)
+	}
+}
+
+// Last returns up to n raw points not after before, newest first
+func (s *Series) Last(before []byte, n int) ([]*nekolib.NekodRecord, error) {
+	beforeNs, err := wireNano(before)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return nil, SeriesClosed
+	}
+	pts := s.layers[nekolib.PRIORITY_RAW]
+	records := make([]*nekolib.NekodRecord, 0, n)
+	for i := search(pts, beforeNs+1) - 1; i >= 0 && len(records) < n; i-- {
+		records = append(records, &nekolib.NekodRecord{wireTs(pts[i].ts), pts[i].value})
+	}
+	return records, nil
+}
+
+// rollup keys are the later one of bucket start and frag block start, as
+// nekorocks stores them, so that nekos merges partials of both engines
+func (s *Series) rollupKey(ns int64, priority uint8) int64 {
+	bucket, _ := nekolib.RollupBucket(time.Unix(0, ns).UTC(), priority)
+	lower, _ := nekolib.TsBoundary(nanoSec(ns), s.FragLevel)
+	key := nekolib.TimeSec2Time(lower).UnixNano()
+	if bucket.UnixNano() > key {
+		key = bucket.UnixNano()
+	}
+	return key
+}
+
+func (s *Series) rollupOp(startNs, endNs int64, priority uint8, op func(key, value []byte)) {
+	if !nekolib.IsNumericValue(s.ValueType) {
+		return
+	}
+	pts := s.layers[nekolib.PRIORITY_RAW]
+	// points of a bucket starting at startNs may lie up to a step later
+	step := nekolib.RollupStep(priority) * int64(time.Second)
+
+	var cur int64
+	var rv *nekolib.RollupValue
+	flush := func() {
+		if rv != nil && cur >= startNs {
+			op(wireTs(cur), rv.ToBytes())
+		}
+	}
+	for i := search(pts, startNs-step); i < len(pts); i++ {
+		key := s.rollupKey(pts[i].ts, priority)
+		if key > endNs {
+			break
+		}
+		v, ok := nekolib.NumericValue(s.ValueType, pts[i].value)
+		if !ok {
+			continue
+		}
+		if rv == nil || key != cur {
+			flush()
+			cur, rv = key, new(nekolib.RollupValue)
+		}
+		rv.Add(v)
+	}
+	flush()
+}
+
+func (s *Series) ReverseHash(h uint32, ts_start, ts_end []byte) error {
+	start, err := wireNano(ts_start)
+	if err != nil {
+		return err
+	}
+	end, err := wireNano(ts_end)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return SeriesClosed
+	}
+	s.blocks[h] = blockRange{start, end}
+	return nil
+}
+
+// Blocks lists frag blocks recorded by ReverseHash
+func (s *Series) Blocks() ([]nekolib.FragBlock, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.closed {
+		return nil, SeriesClosed
+	}
+	raw := s.layers[nekolib.PRIORITY_RAW]
+	blocks := make([]nekolib.FragBlock, 0, len(s.blocks))
+	for h, b := range s.blocks {
+		count := int64(search(raw, b.end) - search(raw, b.start))
+		blocks = append(blocks, nekolib.FragBlock{h, b.start, b.end, count})
+	}
+	return blocks, nil
+}
+
+// DropBlock removes raw points of a frag block and forgets the block
+func (s *Series) DropBlock(h uint32) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return 0, SeriesClosed
+	}
+	b, found := s.blocks[h]
+	if !found {
+		return 0, nil
+	}
+	delete(s.blocks, h)
+	pts := s.layers[nekolib.PRIORITY_RAW]
+	i := search(pts, b.start)
+	j := search(pts, b.end)
+	s.layers[nekolib.PRIORITY_RAW] = append(pts[:i], pts[j:]...)
+	return j - i, nil
+}
+
+// DeleteRange removes all points in [start, end] of a priority layer
+func (s *Series) DeleteRange(start, end []byte, priority uint8) (int, error) {
+	if nekolib.IsRollupLayer(priority) {
+		return 0, fmt.Errorf("priority %d is a rollup layer", priority)
+	}
+	startNs, err := wireNano(start)
+	if err != nil {
+		return 0, err
+	}
+	endNs, err := wireNano(end)
+	if err != nil {
+		return 0, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return 0, SeriesClosed
+	}
+	pts := s.layers[priority]
+	i := search(pts, startNs)
+	j := i
+	for j < len(pts) && pts[j].ts <= endNs {
+		j++
+	}
+	s.layers[priority] = append(pts[:i], pts[j:]...)
+	if priority == nekolib.PRIORITY_RAW {
+		s.forgetEmptied(startNs, endNs)
+	}
+	return j - i, nil
+}
+
+// forgetEmptied forgets frag blocks overlapping [startNs, endNs] with no
+// raw points left, callers hold s.m
+func (s *Series) forgetEmptied(startNs, endNs int64) {
+	pts := s.layers[nekolib.PRIORITY_RAW]
+	for h, b := range s.blocks {
+		if b.end <= startNs || b.start > endNs {
+			continue
+		}
+		if i := search(pts, b.start); i == len(pts) || pts[i].ts >= b.end {
+			delete(s.blocks, h)
+		}
+	}
+}
+
+// Expire drops frag blocks which ended before the given time, like
+// nekorocks does
+func (s *Series) Expire(before time.Time) (int, error) {
+	cutoff, _ := nekolib.TsBoundary(nanoSec(before.UnixNano()), s.FragLevel)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return 0, SeriesClosed
+	}
+	dropped := 0
+	for p, pts := range s.layers {
+		i := 0
+		for i < len(pts) && nanoSec(pts[i].ts) < cutoff {
+			i++
+		}
+		s.layers[p] = pts[i:]
+		dropped += i
+	}
+	for h, b := range s.blocks {
+		if nanoSec(b.end) <= cutoff {
+			delete(s.blocks, h)
+		}
+	}
+	return dropped, nil
+}
+
+// Bounds returns timestamps of the first and the last raw point
+func (s *Series) Bounds() (first, last time.Time, ok bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	pts := s.layers[nekolib.PRIORITY_RAW]
+	if s.closed || len(pts) == 0 {
+		return
+	}
+	return time.Unix(0, pts[0].ts).UTC(), time.Unix(0, pts[len(pts)-1].ts).UTC(), true
+}
+
+// Close keeps the points, GetSeries opens the series again
+func (s *Series) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *Series) Destroy() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	s.layers = nil
+	s.blocks = nil
+
+	registryM.Lock()
+	defer registryM.Unlock()
+	if registry[s.Id] == s {
+		delete(registry, s.Id)
+	}
+	return nil
+}
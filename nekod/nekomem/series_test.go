@@ -0,0 +1,176 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekomem
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMemorySeries(t *testing.T) {
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:      "test_memory",
+		Id:        "mem00001",
+		FragLevel: 12,
+		ValueType: nekolib.VALUE_FLOAT64,
+	}
+	base := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	records := make([]*nekolib.NekodRecord, 0)
+	for i := 0; i < 120; i++ {
+		v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, fmt.Sprintf("%d", i))
+		ts := nekolib.Time2Bytes(base.Add(time.Duration(i) * time.Minute))
+		records = append(records, &nekolib.NekodRecord{ts, v})
+	}
+
+	Convey("Subject: Test Memory Series", t, func() {
+		series := NewSeries(series_info)
+		// inserted out of order and twice
+		dups, err := series.InsertBatch(records[60:], 0, nekolib.DURABILITY_WAL)
+		So(err, ShouldBeNil)
+		So(dups, ShouldEqual, 0)
+		dups, err = series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+		So(err, ShouldBeNil)
+		So(dups, ShouldEqual, 60)
+
+		Convey("Points Should Be Counted Once", func() {
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records))
+		})
+
+		Convey("Last Should Be Newest First", func() {
+			last, err := series.Last(records[100].Ts, 3)
+			So(err, ShouldBeNil)
+			So(len(last), ShouldEqual, 3)
+			So(last[0].Ts, ShouldResemble, records[100].Ts)
+			So(last[2].Ts, ShouldResemble, records[98].Ts)
+		})
+
+		Convey("Range Should Be Sorted", func() {
+			keys := [][]byte{}
+			series.RangeOp(records[10].Ts, records[19].Ts, 0, func(key, value []byte) {
+				keys = append(keys, key)
+			})
+			So(len(keys), ShouldEqual, 10)
+			So(keys[0], ShouldResemble, records[10].Ts)
+			So(keys[9], ShouldResemble, records[19].Ts)
+		})
+
+		Convey("Rollups Should Be Computed From Raw Points", func() {
+			total := int64(0)
+			series.RangeOp(records[0].Ts, records[119].Ts, nekolib.PRIORITY_ROLLUP_1H,
+				func(key, value []byte) {
+					rv := new(nekolib.RollupValue)
+					rv.FromBytes(value)
+					total += rv.Count
+				})
+			So(total, ShouldEqual, len(records))
+		})
+
+		Convey("DeleteRange Should Drop Points", func() {
+			n, err := series.DeleteRange(records[0].Ts, records[29].Ts, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 30)
+
+			first, last, ok := series.Bounds()
+			So(ok, ShouldBeTrue)
+			So(first, ShouldResemble, base.Add(30*time.Minute))
+			So(last, ShouldResemble, base.Add(119*time.Minute))
+		})
+
+		Convey("Dropped Blocks Should Be Forgotten", func() {
+			lower, upper := nekolib.TimeBoundary(records[0].Ts, series_info.FragLevel)
+			So(series.ReverseHash(1, lower, upper), ShouldBeNil)
+			blocks, err := series.Blocks()
+			So(err, ShouldBeNil)
+			So(len(blocks), ShouldEqual, 1)
+
+			n, err := series.DropBlock(1)
+			So(err, ShouldBeNil)
+			So(n, ShouldBeGreaterThan, 0)
+			So(int64(n), ShouldEqual, blocks[0].Count)
+			count, _ := series.Count()
+			So(count, ShouldEqual, len(records)-n)
+			blocks, _ = series.Blocks()
+			So(len(blocks), ShouldEqual, 0)
+		})
+
+		Convey("Emptied Blocks Should Be Forgotten", func() {
+			lower, upper := nekolib.TimeBoundary(records[0].Ts, series_info.FragLevel)
+			So(series.ReverseHash(1, lower, upper), ShouldBeNil)
+			_, err := series.DeleteRange(lower, records[119].Ts, 0)
+			So(err, ShouldBeNil)
+			blocks, _ := series.Blocks()
+			So(len(blocks), ShouldEqual, 0)
+		})
+
+		Convey("Closed Series Should Keep Points", func() {
+			So(series.Close(), ShouldBeNil)
+			_, err := series.Count()
+			So(err, ShouldEqual, SeriesClosed)
+			So(HasSeries(series_info.Id), ShouldBeTrue)
+
+			series, err = GetSeries(series_info.Id)
+			So(err, ShouldBeNil)
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records))
+		})
+
+		Convey("Snapshots Should Be Restored", func() {
+			dir := path.Join(os.TempDir(), "nekomem-snapshot")
+			os.RemoveAll(dir)
+			defer os.RemoveAll(dir)
+			lower, upper := nekolib.TimeBoundary(records[0].Ts, series_info.FragLevel)
+			So(series.ReverseHash(1, lower, upper), ShouldBeNil)
+			So(series.Snapshot(dir), ShouldBeNil)
+			So(series.Snapshot(dir), ShouldNotBeNil)
+
+			_, err := RestoreSeries(dir, series_info)
+			So(err, ShouldEqual, SeriesExists)
+			So(series.Destroy(), ShouldBeNil)
+			So(HasSeries(series_info.Id), ShouldBeFalse)
+
+			series, err = RestoreSeries(dir, series_info)
+			So(err, ShouldBeNil)
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records))
+			blocks, _ := series.Blocks()
+			So(len(blocks), ShouldEqual, 1)
+		})
+
+		Convey("Operations Should Fail After Destroy", func() {
+			So(series.Destroy(), ShouldBeNil)
+			So(series.Insert(records[0].Ts, records[0].Value, 0), ShouldEqual, SeriesClosed)
+			_, err := series.Count()
+			So(err, ShouldEqual, SeriesClosed)
+			So(HasSeries(series_info.Id), ShouldBeFalse)
+		})
+
+		Reset(func() {
+			series.Destroy()
+		})
+	})
+}
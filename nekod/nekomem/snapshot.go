@@ -0,0 +1,119 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekomem
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+const SNAPSHOT_FILE = "points"
+
+// on disk form of a snapshot
+type snapshot struct {
+	Layers map[uint8][]snapshotPoint
+	Blocks map[uint32][2]int64
+}
+
+type snapshotPoint struct {
+	Ts    int64
+	Value []byte
+}
+
+// Snapshot writes the points of the series into dir, which must not
+// exist yet
+func (s *Series) Snapshot(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot %s exists", dir)
+	}
+
+	snap := snapshot{
+		Layers: make(map[uint8][]snapshotPoint),
+		Blocks: make(map[uint32][2]int64),
+	}
+	s.m.RLock()
+	if s.closed {
+		s.m.RUnlock()
+		return SeriesClosed
+	}
+	for p, pts := range s.layers {
+		sp := make([]snapshotPoint, len(pts))
+		for i, pt := range pts {
+			sp[i] = snapshotPoint{pt.ts, pt.value}
+		}
+		snap.Layers[p] = sp
+	}
+	for h, b := range s.blocks {
+		snap.Blocks[h] = [2]int64{b.start, b.end}
+	}
+	s.m.RUnlock()
+
+	if err := os.MkdirAll(dir, os.ModeDir|os.FileMode(0700)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(dir, SNAPSHOT_FILE), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&snap)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.RemoveAll(dir)
+	}
+	return err
+}
+
+// RestoreSeries reads a snapshot taken by Snapshot back as the series of
+// info, the series must not exist
+func RestoreSeries(dir string, info *nekolib.NekoSeriesInfo) (*Series, error) {
+	if HasSeries(info.Id) {
+		return nil, SeriesExists
+	}
+	f, err := os.Open(path.Join(dir, SNAPSHOT_FILE))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var snap snapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	s := NewSeries(info)
+	s.m.Lock()
+	defer s.m.Unlock()
+	for p, sp := range snap.Layers {
+		pts := make([]point, len(sp))
+		for i, pt := range sp {
+			pts[i] = point{pt.Ts, pt.Value}
+		}
+		s.layers[p] = pts
+	}
+	for h, b := range snap.Blocks {
+		s.blocks[h] = blockRange{b[0], b[1]}
+	}
+	return s, nil
+}
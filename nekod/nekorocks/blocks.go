@@ -0,0 +1,159 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"sort"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// In compressed mode, all points of a frag block are stored as one
+// gorilla encoded value, keyed by the lower boundary of the block.
+
+func (s *Series) blockKey(ns int64, priority uint8) []byte {
+	lower, _ := s.blockBounds(ns)
+	return s.marshalKey(lower, priority)
+}
+
+func (s *Series) getBlock(key []byte) ([]blockPoint, error) {
+	slice, err := s.data.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer slice.Free()
+	if slice.Size() == 0 {
+		return []blockPoint{}, nil
+	}
+	return decodeBlock(slice.Data(), s.ValueType)
+}
+
+// mergePoints merges records into a sorted block, records overwrite
+// existing points with the same timestamp unless policy says otherwise.
+func mergePoints(block []blockPoint, records []*nekolib.NekodRecord, policy uint8) ([]blockPoint, insertResult) {
+	var res insertResult
+	merged := append(make([]blockPoint, 0, len(block)+len(records)), block...)
+	// index of the point kept for each timestamp
+	index := make(map[int64]int, len(block)+len(records))
+	for i, p := range block {
+		index[p.ts] = i
+	}
+	for _, r := range records {
+		t, _ := nekolib.Bytes2Time(r.Ts)
+		ts := t.UnixNano()
+		i, found := index[ts]
+		if found {
+			res.duplicates++
+		}
+		switch {
+		case !found || policy == nekolib.DUP_KEEP_ALL:
+			index[ts] = len(merged)
+			merged = append(merged, blockPoint{ts, r.Value})
+		case policy == nekolib.DUP_FIRST_WINS:
+			continue
+		default:
+			res.replaced = append(res.replaced, &nekolib.NekodRecord{r.Ts, merged[i].value})
+			merged[i].value = r.Value
+		}
+		res.written = append(res.written, r)
+	}
+	// versions of a timestamp stay in the order they were written
+	sort.Stable(blockPoints(merged))
+	return merged, res
+}
+
+type blockPoints []blockPoint
+
+func (b blockPoints) Len() int           { return len(b) }
+func (b blockPoints) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b blockPoints) Less(i, j int) bool { return b[i].ts < b[j].ts }
+
+// insertCompressed merges records into their frag blocks following the
+// duplicate policy, like insertKeys does for single keys
+func (s *Series) insertCompressed(records []*nekolib.NekodRecord, priority uint8, durability uint8) (insertResult, error) {
+	blocks := make(map[string][]*nekolib.NekodRecord)
+	for _, r := range records {
+		ns, _ := wireNano(r.Ts)
+		key := string(s.blockKey(ns, priority))
+		blocks[key] = append(blocks[key], r)
+	}
+
+	// blocks are read, merged and written back as a whole, under s.m
+	// taken by InsertBatch
+	var res insertResult
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	added := 0
+	for key, recs := range blocks {
+		block, err := s.getBlock([]byte(key))
+		if err != nil {
+			return insertResult{}, err
+		}
+		merged, r := mergePoints(block, recs, s.DuplicatePolicy)
+		added += len(merged) - len(block)
+		res.duplicates += r.duplicates
+		res.written = append(res.written, r.written...)
+		res.replaced = append(res.replaced, r.replaced...)
+		if len(r.written) > 0 {
+			batch.Put([]byte(key), encodeBlock(merged, s.ValueType))
+		}
+	}
+	if res.duplicates > 0 && s.DuplicatePolicy == nekolib.DUP_REJECT {
+		return insertResult{}, nekolib.DuplicateTimestamps
+	}
+	if len(res.written) == 0 {
+		return res, nil
+	}
+
+	if err := s.data.WriteWith(batch, durability); err != nil {
+		return insertResult{}, err
+	}
+	return res, s.addCount(int64(added), durability)
+}
+
+func (s *Series) rangeOpCompressed(startTs, endTs int64, priority uint8, op func(key, value []byte)) {
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.Seek(s.blockKey(startTs, priority)); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if len(key) != TS_KEY_LEN+SERIES_KEY_PREFIX_LEN {
+			continue
+		}
+		if key[0] != byte(priority) {
+			break
+		}
+		if s.unmarshalKey(key) > endTs {
+			break
+		}
+
+		block, err := decodeBlock(iter.Value().Data(), s.ValueType)
+		if err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		for _, p := range block {
+			if p.ts < startTs {
+				continue
+			}
+			if p.ts > endTs {
+				break
+			}
+			op(wireTs(p.ts), p.value)
+		}
+	}
+}
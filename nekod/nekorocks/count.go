@@ -0,0 +1,56 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Recount rebuilds the element counter from the data DB, writes are
+// blocked meanwhile.
+func (s *Series) Recount() (int, error) {
+	if err := s.acquire(); err != nil {
+		return -1, err
+	}
+	defer s.release()
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.recount()
+}
+
+func (s *Series) recount() (int, error) {
+	count := int64(0)
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if !isPointKey(key) {
+			continue
+		}
+		count += s.pointsOf(key[0], iter.Value().Data())
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 8))
+	binary.Write(buf, binary.BigEndian, count)
+	if err := s.meta.PutSync([]byte(KEY_SERIES_ELEM_COUNT), buf.Bytes()); err != nil {
+		return -1, err
+	}
+	return int(count), nil
+}
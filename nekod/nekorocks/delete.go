@@ -0,0 +1,148 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// DeleteRange removes all points in [start, end] of a priority layer and
+// returns the number of removed points. Rollups of the raw layer are
+// rebuilt for the range.
+func (s *Series) DeleteRange(start, end []byte, priority uint8) (int, error) {
+	startNs, err := wireNano(start)
+	if err != nil {
+		return 0, err
+	}
+	endNs, err := wireNano(end)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+	if nekolib.IsRollupLayer(priority) {
+		return 0, fmt.Errorf("priority %d is a rollup layer", priority)
+	}
+	startT, endT := time.Unix(0, startNs).UTC(), time.Unix(0, endNs).UTC()
+
+	// stats and rollups are rebuilt before inserts see the range again
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var deleted int
+	if s.compressed(priority) {
+		deleted, err = s.deleteCompressed(startNs, endNs, priority)
+	} else {
+		deleted, err = s.deleteKeys(startNs, endNs, priority)
+	}
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+
+	if err := s.addCount(int64(-deleted), nekolib.DURABILITY_WAL); err != nil {
+		return 0, err
+	}
+	if priority == nekolib.PRIORITY_RAW {
+		if err := s.rebuildBlockStats(startT, endT); err != nil {
+			return deleted, err
+		}
+		return deleted, s.rebuildRollups(startT, endT)
+	}
+	return deleted, nil
+}
+
+func (s *Series) deleteKeys(startNs, endNs int64, priority uint8) (int, error) {
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	deleted := 0
+
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.Seek(s.marshalKey(startNs, priority)); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if !isPointKey(key) {
+			continue
+		}
+		if key[0] != byte(priority) {
+			break
+		}
+		if s.unmarshalKey(key) > endNs {
+			break
+		}
+		batch.Delete(append([]byte{}, key...))
+		deleted++
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, s.data.Write(batch)
+}
+
+// blocks partially covered by the range are re-encoded with the remaining
+// points, emptied blocks are removed
+func (s *Series) deleteCompressed(startTs, endTs int64, priority uint8) (int, error) {
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	deleted := 0
+
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.Seek(s.blockKey(startTs, priority)); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if !isPointKey(key) {
+			continue
+		}
+		if key[0] != byte(priority) {
+			break
+		}
+		if s.unmarshalKey(key) > endTs {
+			break
+		}
+
+		block, err := decodeBlock(iter.Value().Data(), s.ValueType)
+		if err != nil {
+			return 0, err
+		}
+		kept := make([]blockPoint, 0, len(block))
+		for _, p := range block {
+			if p.ts < startTs || p.ts > endTs {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == len(block) {
+			continue
+		}
+		deleted += len(block) - len(kept)
+		if len(kept) == 0 {
+			batch.Delete(append([]byte{}, key...))
+		} else {
+			batch.Put(append([]byte{}, key...), encodeBlock(kept, s.ValueType))
+		}
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, s.data.Write(batch)
+}
@@ -0,0 +1,300 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+// Gorilla style compression of a frag block, see
+// "Gorilla: A Fast, Scalable, In-Memory Time Series Database", VLDB 2015.
+//
+// Timestamps (unix nanoseconds) are delta-of-delta encoded, 8-byte values
+// (float64 and int64) are XOR encoded against the previous value, other
+// values are stored with a 16bit length prefix, callers reject values
+// longer than nekolib.MAX_VALUE_LEN.
+package nekorocks
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+var InvalidBlock = errors.New("Invalid Compressed Block")
+
+type blockPoint struct {
+	ts    int64
+	value []byte
+}
+
+type bitWriter struct {
+	buf   []byte
+	nbits uint8 // free bits in last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.nbits == 0 {
+		w.buf = append(w.buf, 0)
+		w.nbits = 8
+	}
+	w.nbits--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.nbits
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit((v>>uint(i))&1 == 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos int // bit position
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.buf)*8 {
+		return false, InvalidBlock
+	}
+	bit := (r.buf[r.pos/8]>>(7-uint(r.pos%8)))&1 == 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// delta-of-delta buckets: control bits and value width
+var dodBuckets = []struct {
+	ctrl, ctrlLen uint64
+	width         int
+}{
+	{0x2, 2, 7},
+	{0x6, 3, 9},
+	{0xE, 4, 12},
+}
+
+func encodeBlock(points []blockPoint, vtype uint8) []byte {
+	w := new(bitWriter)
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(points)))
+	w.buf = hdr
+
+	fixed := vtype == nekolib.VALUE_FLOAT64 || vtype == nekolib.VALUE_INT64
+	var prevTs, prevDelta int64
+	var prevValue uint64
+	leading, trailing := -1, 0
+
+	for i, p := range points {
+		// timestamp
+		if i == 0 {
+			w.writeBits(uint64(p.ts), 64)
+		} else {
+			delta := p.ts - prevTs
+			dod := delta - prevDelta
+			prevDelta = delta
+			if dod == 0 {
+				w.writeBit(false)
+			} else {
+				written := false
+				for _, b := range dodBuckets {
+					lim := int64(1) << uint(b.width-1)
+					if dod >= -lim+1 && dod <= lim {
+						w.writeBits(b.ctrl, int(b.ctrlLen))
+						w.writeBits(uint64(dod)&(1<<uint(b.width)-1), b.width)
+						written = true
+						break
+					}
+				}
+				if !written {
+					w.writeBits(0xF, 4)
+					w.writeBits(uint64(dod), 64)
+				}
+			}
+		}
+		prevTs = p.ts
+
+		// value
+		if !fixed {
+			w.writeBits(uint64(len(p.value)), 16)
+			for _, b := range p.value {
+				w.writeBits(uint64(b), 8)
+			}
+			continue
+		}
+		v := binary.BigEndian.Uint64(p.value)
+		if i == 0 {
+			w.writeBits(v, 64)
+			prevValue = v
+			continue
+		}
+		xor := v ^ prevValue
+		prevValue = v
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		lz, tz := bits.LeadingZeros64(xor), bits.TrailingZeros64(xor)
+		if lz > 31 {
+			lz = 31
+		}
+		if leading >= 0 && lz >= leading && tz >= trailing {
+			// fits in previous window
+			w.writeBit(false)
+			w.writeBits(xor>>uint(trailing), 64-leading-trailing)
+		} else {
+			leading, trailing = lz, tz
+			w.writeBit(true)
+			w.writeBits(uint64(lz), 5)
+			w.writeBits(uint64(64-lz-tz-1), 6)
+			w.writeBits(xor>>uint(tz), 64-lz-tz)
+		}
+	}
+	return w.buf
+}
+
+func decodeBlock(data []byte, vtype uint8) ([]blockPoint, error) {
+	if len(data) < 4 {
+		return nil, InvalidBlock
+	}
+	count := int(binary.BigEndian.Uint32(data[:4]))
+	r := &bitReader{buf: data[4:]}
+
+	fixed := vtype == nekolib.VALUE_FLOAT64 || vtype == nekolib.VALUE_INT64
+	points := make([]blockPoint, 0, count)
+	var prevTs, prevDelta int64
+	var prevValue uint64
+	leading, trailing := 0, 0
+
+	for i := 0; i < count; i++ {
+		var p blockPoint
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			p.ts = int64(v)
+		} else {
+			var dod int64
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if bit {
+				matched := false
+				for _, b := range dodBuckets {
+					if bit, err = r.readBit(); err != nil {
+						return nil, err
+					}
+					if !bit {
+						v, err := r.readBits(b.width)
+						if err != nil {
+							return nil, err
+						}
+						// sign extend
+						if v > 1<<uint(b.width-1) {
+							dod = int64(v) - int64(1)<<uint(b.width)
+						} else {
+							dod = int64(v)
+						}
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					v, err := r.readBits(64)
+					if err != nil {
+						return nil, err
+					}
+					dod = int64(v)
+				}
+			}
+			prevDelta += dod
+			p.ts = prevTs + prevDelta
+		}
+		prevTs = p.ts
+
+		if !fixed {
+			l, err := r.readBits(16)
+			if err != nil {
+				return nil, err
+			}
+			p.value = make([]byte, l)
+			for j := range p.value {
+				b, err := r.readBits(8)
+				if err != nil {
+					return nil, err
+				}
+				p.value[j] = byte(b)
+			}
+			points = append(points, p)
+			continue
+		}
+
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prevValue = v
+		} else {
+			bit, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if bit {
+				if bit, err = r.readBit(); err != nil {
+					return nil, err
+				}
+				if bit {
+					lz, err := r.readBits(5)
+					if err != nil {
+						return nil, err
+					}
+					l, err := r.readBits(6)
+					if err != nil {
+						return nil, err
+					}
+					leading = int(lz)
+					trailing = 64 - leading - int(l) - 1
+				}
+				v, err := r.readBits(64 - leading - trailing)
+				if err != nil {
+					return nil, err
+				}
+				prevValue ^= v << uint(trailing)
+			}
+		}
+		p.value = make([]byte, 8)
+		binary.BigEndian.PutUint64(p.value, prevValue)
+		points = append(points, p)
+	}
+	return points, nil
+}
@@ -0,0 +1,61 @@
+package nekorocks
+
+import (
+	"testing"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestGorillaBlock(t *testing.T) {
+	Convey("Subject: Gorilla Block Encoding", t, func() {
+
+		Convey("Float Values Should Round Trip", func() {
+			points := make([]blockPoint, 0)
+			ts := int64(1356969600) * 1e9
+			values := []string{"-8.0", "-8.0", "-7.5", "-7.9", "12.25", "0", "-8.0"}
+			for i, v := range values {
+				b, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, v)
+				// mostly regular interval with some jitter
+				jitter := int64(0)
+				if i == 4 {
+					jitter = 1234567
+				}
+				points = append(points, blockPoint{ts + int64(i)*300e9 + jitter, b})
+			}
+
+			data := encodeBlock(points, nekolib.VALUE_FLOAT64)
+			So(len(data), ShouldBeLessThan, len(points)*16)
+
+			decoded, err := decodeBlock(data, nekolib.VALUE_FLOAT64)
+			So(err, ShouldBeNil)
+			So(len(decoded), ShouldEqual, len(points))
+			for i, p := range decoded {
+				So(p.ts, ShouldEqual, points[i].ts)
+				So(nekolib.FormatValue(nekolib.VALUE_FLOAT64, p.value), ShouldEqual,
+					nekolib.FormatValue(nekolib.VALUE_FLOAT64, points[i].value))
+			}
+		})
+
+		Convey("String Values Should Round Trip", func() {
+			points := []blockPoint{
+				{-5e9, []byte("Hello")},
+				{0, []byte("")},
+				{7e9, []byte("World")},
+			}
+			data := encodeBlock(points, nekolib.VALUE_STRING)
+			decoded, err := decodeBlock(data, nekolib.VALUE_STRING)
+			So(err, ShouldBeNil)
+			So(len(decoded), ShouldEqual, 3)
+			So(decoded[0].ts, ShouldEqual, -5e9)
+			So(string(decoded[2].value), ShouldEqual, "World")
+		})
+
+		Convey("Truncated Block Should Fail", func() {
+			points := []blockPoint{{1, []byte("a")}, {2, []byte("b")}}
+			data := encodeBlock(points, nekolib.VALUE_STRING)
+			_, err := decodeBlock(data[:len(data)-2], nekolib.VALUE_STRING)
+			So(err, ShouldEqual, InvalidBlock)
+		})
+	})
+}
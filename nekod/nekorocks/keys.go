@@ -0,0 +1,200 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/vmihailenco/msgpack"
+)
+
+// On-disk formats of a series, recorded in its meta DB
+const (
+	// data keys carry time.Time.MarshalBinary timestamps
+	FORMAT_V0 uint8 = iota
+	// data keys carry big endian unix nanoseconds with the sign bit
+	// flipped, so that keys sort by time
+	FORMAT_V1
+
+	FORMAT_CURRENT = FORMAT_V1
+)
+
+const (
+	TS_KEY_LEN_V0      = 15
+	MIGRATE_BATCH_SIZE = 4096
+)
+
+// Timestamps of the client protocol are binary time.Time, they are
+// converted to unix nanoseconds at the API boundary of Series.
+func wireNano(ts []byte) (int64, error) {
+	t, err := nekolib.Bytes2Time(ts)
+	if err != nil {
+		return 0, InvalidTimestamp
+	}
+	return t.UnixNano(), nil
+}
+
+func wireTs(ns int64) []byte {
+	return nekolib.Time2Bytes(time.Unix(0, ns).UTC())
+}
+
+func encodeTs(ns int64) []byte {
+	b := make([]byte, TS_KEY_LEN)
+	binary.BigEndian.PutUint64(b, uint64(ns)^(1<<63))
+	return b
+}
+
+func decodeTs(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+// seconds since year 1 of a unix nanosecond timestamp, as used by frag
+// blocks
+func nanoSec(ns int64) int64 {
+	return time.Unix(0, ns).Unix() + nekolib.UNIX_TO_INTERNAL
+}
+
+func secNano(sec int64) int64 {
+	return nekolib.TimeSec2Time(sec).UnixNano()
+}
+
+// boundaries of the frag block of a timestamp, in unix nanoseconds
+func (s *Series) blockBounds(ns int64) (lower, upper int64) {
+	l, u := nekolib.TsBoundary(nanoSec(ns), s.FragLevel)
+	return secNano(l), secNano(u)
+}
+
+// checkFormat migrates series written in an older format when opened
+func (s *Series) checkFormat() error {
+	format := FORMAT_V0
+	slice, err := s.meta.Get([]byte(KEY_SERIES_FORMAT))
+	if err != nil {
+		return err
+	}
+	if slice.Size() > 0 {
+		format = slice.Data()[0]
+	} else if s.isEmpty() {
+		format = FORMAT_CURRENT
+	}
+	slice.Free()
+
+	switch {
+	case format == FORMAT_CURRENT:
+	case format > FORMAT_CURRENT:
+		return fmt.Errorf("series %s: unsupported format %d", s.Id, format)
+	default:
+		logger.Info("Migrating series %s from format %d to %d", s.Id, format, FORMAT_CURRENT)
+		if err := s.migrateV0(); err != nil {
+			return err
+		}
+		if _, err := s.recount(); err != nil {
+			return err
+		}
+	}
+	return s.meta.PutSync([]byte(KEY_SERIES_FORMAT), []byte{FORMAT_CURRENT})
+}
+
+func (s *Series) isEmpty() bool {
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	iter.SeekToFirst()
+	if iter.Valid() {
+		return false
+	}
+	miter := s.meta.NewIterator()
+	defer miter.Close()
+	miter.Seek([]byte(PREFIX_SERIES_KEY_MAP))
+	return !(miter.Valid() && bytes.HasPrefix(miter.Key().Data(), []byte(PREFIX_SERIES_KEY_MAP)))
+}
+
+// Reverse hash entry of FORMAT_V0
+type blockInfoV0 struct {
+	TsStart []byte  `msgpack:"ts_start"`
+	TsEnd   []byte  `msgpack:"ts_end"`
+	Count   int64   `msgpack:"count"`
+	Min     float64 `msgpack:"min"`
+	Max     float64 `msgpack:"max"`
+	Sum     float64 `msgpack:"sum"`
+	First   []byte  `msgpack:"first"`
+	Last    []byte  `msgpack:"last"`
+}
+
+// migrateV0 rewrites V0 keys in place, it can be resumed after a crash
+// since keys of both formats differ in length
+func (s *Series) migrateV0() error {
+	batch := s.data.NewBatch()
+	defer func() { batch.Destroy() }()
+	n := 0
+
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if len(key) != SERIES_KEY_PREFIX_LEN+TS_KEY_LEN_V0 {
+			continue
+		}
+		ns, err := wireNano(key[SERIES_KEY_PREFIX_LEN:])
+		if err != nil {
+			return err
+		}
+		value := append([]byte{}, iter.Value().Data()...)
+		batch.Put(s.marshalKey(ns, key[0]), value)
+		batch.Delete(append([]byte{}, key...))
+
+		if n++; n%MIGRATE_BATCH_SIZE == 0 {
+			if err := s.data.Write(batch); err != nil {
+				return err
+			}
+			batch.Destroy()
+			batch = s.data.NewBatch()
+		}
+	}
+	if err := s.data.Write(batch); err != nil {
+		return err
+	}
+
+	prefix := []byte(PREFIX_SERIES_KEY_MAP)
+	miter := s.meta.NewIterator()
+	defer miter.Close()
+	for miter.Seek(prefix); miter.Valid(); miter.Next() {
+		key := miter.Key().Data()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		var old blockInfoV0
+		if err := msgpack.Unmarshal(miter.Value().Data(), &old); err != nil || len(old.TsStart) != TS_KEY_LEN_V0 {
+			continue
+		}
+		info := new(blockInfo)
+		info.TsStart, _ = wireNano(old.TsStart)
+		info.TsEnd, _ = wireNano(old.TsEnd)
+		info.Count, info.Min, info.Max, info.Sum = old.Count, old.Min, old.Max, old.Sum
+		info.First, _ = wireNano(old.First)
+		info.Last, _ = wireNano(old.Last)
+		if err := s.putBlockInfo(append([]byte{}, key...), info, nekolib.DURABILITY_WAL); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Series %s: %d keys migrated", s.Id, n)
+	return nil
+}
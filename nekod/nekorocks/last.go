@@ -0,0 +1,88 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// Last returns up to n points of the raw layer not after before, newest
+// first. Points come from the newest block first, then from earlier ones.
+func (s *Series) Last(before []byte, n int) ([]*nekolib.NekodRecord, error) {
+	beforeNs, err := wireNano(before)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	priority := nekolib.PRIORITY_RAW
+	records := make([]*nekolib.NekodRecord, 0, n)
+	iter := s.data.NewIterator()
+	defer iter.Close()
+
+	// position on the last key not after before, blocks are keyed by
+	// their start
+	target := s.marshalKey(beforeNs, priority)
+	if s.compressed(priority) {
+		target = s.blockKey(beforeNs, priority)
+	}
+	iter.Seek(target)
+	if !iter.Valid() {
+		iter.SeekToLast()
+	} else if string(iter.Key().Data()) != string(target) {
+		iter.Prev()
+	}
+
+	for ; iter.Valid() && len(records) < n; iter.Prev() {
+		key := iter.Key().Data()
+		if !isPointKey(key) {
+			continue
+		}
+		if key[0] != byte(priority) {
+			if key[0] < byte(priority) {
+				break
+			}
+			continue
+		}
+		if !s.compressed(priority) {
+			records = append(records, &nekolib.NekodRecord{
+				Ts:    wireTs(s.unmarshalKey(key)),
+				Value: append([]byte{}, iter.Value().Data()...),
+			})
+			continue
+		}
+
+		block, err := decodeBlock(iter.Value().Data(), s.ValueType)
+		if err != nil {
+			return nil, err
+		}
+		for i := len(block) - 1; i >= 0 && len(records) < n; i-- {
+			if block[i].ts > beforeNs {
+				continue
+			}
+			records = append(records, &nekolib.NekodRecord{
+				Ts:    wireTs(block[i].ts),
+				Value: block[i].value,
+			})
+		}
+	}
+	return records, nil
+}
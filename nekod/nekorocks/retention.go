@@ -0,0 +1,107 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/vmihailenco/msgpack"
+)
+
+// number of points stored under a data key, rollup layers are not counted
+func (s *Series) pointsOf(priority uint8, value []byte) int64 {
+	if nekolib.IsRollupLayer(priority) {
+		return 0
+	}
+	if s.compressed(priority) {
+		if len(value) < 4 {
+			return 0
+		}
+		return int64(binary.BigEndian.Uint32(value[:4]))
+	}
+	return 1
+}
+
+// Expire drops every frag block that ends before the given time, in all
+// priority layers, and returns the number of dropped points.
+func (s *Series) Expire(before time.Time) (int, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+	cutoff, _ := nekolib.TsBoundary(
+		nanoSec(before.UnixNano()), s.FragLevel)
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	dropped := int64(0)
+
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.SeekToFirst(); iter.Valid(); {
+		key := iter.Key().Data()
+		if !isPointKey(key) {
+			iter.Next()
+			continue
+		}
+		if nanoSec(s.unmarshalKey(key)) >= cutoff {
+			// skip to next priority layer
+			if key[0] == 0xFF {
+				break
+			}
+			iter.Seek([]byte{key[0] + 1})
+			continue
+		}
+		dropped += s.pointsOf(key[0], iter.Value().Data())
+		batch.Delete(append([]byte{}, key...))
+		iter.Next()
+	}
+
+	if err := s.data.Write(batch); err != nil {
+		return 0, err
+	}
+	if err := s.addCount(-dropped, nekolib.DURABILITY_WAL); err != nil {
+		return 0, err
+	}
+
+	// remove reverse hash entries of dropped blocks
+	prefix := []byte(PREFIX_SERIES_KEY_MAP)
+	miter := s.meta.NewIterator()
+	defer miter.Close()
+	for miter.Seek(prefix); miter.Valid(); miter.Next() {
+		key := miter.Key().Data()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		var info blockInfo
+		if err := msgpack.Unmarshal(miter.Value().Data(), &info); err != nil {
+			continue
+		}
+		if info.TsEnd > info.TsStart && nanoSec(info.TsEnd) <= cutoff {
+			s.meta.Delete(append([]byte{}, key...))
+		}
+	}
+
+	return int(dropped), nil
+}
@@ -21,13 +21,20 @@ import (
 	//    "os"
 	"sync"
 	// "encoding/binary"
+	"github.com/bigeagle/nekodb/nekolib"
 	"github.com/tecbot/gorocksdb"
 )
 
+// RocksDB is a column family, either of the DB shared by all series or
+// the default one of a standalone DB such as a snapshot
 type RocksDB struct {
 	dbpath string
 	opt    *gorocksdb.Options
 	db     *gorocksdb.DB
+	cf     *gorocksdb.ColumnFamilyHandle
+	// column families of the shared DB are dropped instead of closed
+	shared *sharedDB
+	name   string
 	m      sync.RWMutex
 }
 
@@ -37,7 +44,8 @@ func NewRocksDB(path string, opt *gorocksdb.Options) (*RocksDB, error) {
 		opt.SetCreateIfMissing(true)
 	}
 
-	db, err := gorocksdb.OpenDb(opt, path)
+	db, cfs, err := gorocksdb.OpenDbColumnFamilies(opt, path,
+		[]string{"default"}, []*gorocksdb.Options{opt})
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +53,7 @@ func NewRocksDB(path string, opt *gorocksdb.Options) (*RocksDB, error) {
 	rdb := new(RocksDB)
 	rdb.dbpath = path
 	rdb.db = db
+	rdb.cf = cfs[0]
 	rdb.opt = opt
 
 	return rdb, nil
@@ -53,53 +62,125 @@ func NewRocksDB(path string, opt *gorocksdb.Options) (*RocksDB, error) {
 func (r *RocksDB) Get(key []byte) (*gorocksdb.Slice, error) {
 	ro := gorocksdb.NewDefaultReadOptions()
 	defer ro.Destroy()
-	return r.db.Get(ro, key)
+	return r.db.GetCF(ro, r.cf, key)
 }
 
 func (r *RocksDB) Delete(key []byte) error {
 	wo := gorocksdb.NewDefaultWriteOptions()
 	defer wo.Destroy()
-	return r.db.Delete(wo, key)
+	return r.db.DeleteCF(wo, r.cf, key)
 }
 
 func (r *RocksDB) Put(key, value []byte) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
-	defer wo.Destroy()
-	err := r.db.Put(wo, key, value)
-	return err
+	return r.PutWith(key, value, nekolib.DURABILITY_WAL)
 }
 
 func (r *RocksDB) PutSync(key, value []byte) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
+	return r.PutWith(key, value, nekolib.DURABILITY_SYNC)
+}
+
+// PutWith writes a key with durability, one of nekolib.DURABILITY_*
+func (r *RocksDB) PutWith(key, value []byte, durability uint8) error {
+	wo := writeOptions(durability)
 	defer wo.Destroy()
-	wo.SetSync(true)
-	return r.db.Put(wo, key, value)
+	return r.db.PutCF(wo, r.cf, key, value)
 }
 
-func (r *RocksDB) Write(batch *gorocksdb.WriteBatch) error {
+func writeOptions(durability uint8) *gorocksdb.WriteOptions {
 	wo := gorocksdb.NewDefaultWriteOptions()
+	switch durability {
+	case nekolib.DURABILITY_NO_WAL:
+		wo.DisableWAL(true)
+	case nekolib.DURABILITY_SYNC:
+		wo.SetSync(true)
+	}
+	return wo
+}
+
+// Batch is a write batch bound to the column family it was created for
+type Batch struct {
+	*gorocksdb.WriteBatch
+	cf *gorocksdb.ColumnFamilyHandle
+}
+
+func (r *RocksDB) NewBatch() *Batch {
+	return &Batch{gorocksdb.NewWriteBatch(), r.cf}
+}
+
+func (b *Batch) Put(key, value []byte) {
+	b.WriteBatch.PutCF(b.cf, key, value)
+}
+
+func (b *Batch) Delete(key []byte) {
+	b.WriteBatch.DeleteCF(b.cf, key)
+}
+
+func (b *Batch) Merge(key, value []byte) {
+	b.WriteBatch.MergeCF(b.cf, key, value)
+}
+
+func (r *RocksDB) Write(batch *Batch) error {
+	return r.WriteWith(batch, nekolib.DURABILITY_WAL)
+}
+
+// WriteWith writes batch with durability, one of nekolib.DURABILITY_*
+func (r *RocksDB) WriteWith(batch *Batch, durability uint8) error {
+	wo := writeOptions(durability)
 	defer wo.Destroy()
-	return r.db.Write(wo, batch)
+	return r.db.Write(wo, batch.WriteBatch)
 }
 
 func (r *RocksDB) Merge(key, value []byte) error {
-	wo := gorocksdb.NewDefaultWriteOptions()
+	return r.MergeWith(key, value, nekolib.DURABILITY_WAL)
+}
+
+// MergeWith merges a value with durability, one of nekolib.DURABILITY_*
+func (r *RocksDB) MergeWith(key, value []byte, durability uint8) error {
+	wo := writeOptions(durability)
 	defer wo.Destroy()
-	return r.db.Merge(wo, key, value)
+	return r.db.MergeCF(wo, r.cf, key, value)
 }
 
 func (r *RocksDB) NewIterator() *gorocksdb.Iterator {
 	ro := gorocksdb.NewDefaultReadOptions()
 	defer ro.Destroy()
 	ro.SetFillCache(false)
-	return r.db.NewIterator(ro)
+	return r.db.NewIteratorCF(ro, r.cf)
+}
+
+func (r *RocksDB) NewSnapshot() *gorocksdb.Snapshot {
+	return r.db.NewSnapshot()
+}
+
+func (r *RocksDB) ReleaseSnapshot(snap *gorocksdb.Snapshot) {
+	r.db.ReleaseSnapshot(snap)
+}
+
+// NewSnapshotIterator iterates the DB as of snap
+func (r *RocksDB) NewSnapshotIterator(snap *gorocksdb.Snapshot) *gorocksdb.Iterator {
+	ro := gorocksdb.NewDefaultReadOptions()
+	defer ro.Destroy()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	return r.db.NewIteratorCF(ro, r.cf)
 }
 
 func (r *RocksDB) Destroy() error {
+	if r.shared != nil {
+		return r.shared.dropColumnFamily(r.name)
+	}
 	r.Close()
 	return gorocksdb.DestroyDb(r.dbpath, r.opt)
 }
 
+// Close releases a standalone DB. Column families of the shared DB stay
+// open until dropped, their memtable is flushed so that closed series
+// hold no memory.
 func (r *RocksDB) Close() {
+	if r.shared != nil {
+		r.shared.flushColumnFamily(r.name)
+		return
+	}
+	r.cf.Destroy()
 	r.db.Close()
 }
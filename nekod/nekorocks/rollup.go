@@ -0,0 +1,203 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// Rollup layers of numeric series are maintained on raw inserts. A bucket
+// spanning several frag blocks is kept as one partial aggregate per block,
+// keyed by max(bucket start, block start), so a peer only aggregates the
+// blocks it owns and nekos merges the partials of a bucket at query time.
+
+func (s *Series) hasRollups() bool {
+	return nekolib.IsNumericValue(s.ValueType)
+}
+
+func (s *Series) rollupKey(t time.Time, priority uint8) []byte {
+	bucket, _ := nekolib.RollupBucket(t, priority)
+	lower, _ := s.blockBounds(t.UnixNano())
+	if bucket.UnixNano() > lower {
+		lower = bucket.UnixNano()
+	}
+	return s.marshalKey(lower, priority)
+}
+
+// aggregate raw records into partial rollup values of the given layers
+func (s *Series) aggregate(records []*nekolib.NekodRecord, layers []uint8) map[string]*nekolib.RollupValue {
+	partials := make(map[string]*nekolib.RollupValue)
+	for _, r := range records {
+		v, ok := nekolib.NumericValue(s.ValueType, r.Value)
+		if !ok {
+			continue
+		}
+		t, err := nekolib.Bytes2Time(r.Ts)
+		if err != nil {
+			continue
+		}
+		for _, p := range layers {
+			key := string(s.rollupKey(t, p))
+			rv, found := partials[key]
+			if !found {
+				rv = new(nekolib.RollupValue)
+				partials[key] = rv
+			}
+			rv.Add(v)
+		}
+	}
+	return partials
+}
+
+// updateRollups folds newly inserted raw records into rollup layers and
+// takes out the values they replaced. Only a partial whose Min or Max was
+// replaced is recomputed, from the raw points of its own span.
+func (s *Series) updateRollups(records, replaced []*nekolib.NekodRecord, durability uint8) error {
+	if !s.hasRollups() || len(records) == 0 {
+		return nil
+	}
+
+	added := s.aggregate(records, nekolib.RollupLayers)
+	removed := s.aggregate(replaced, nekolib.RollupLayers)
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	for key, partial := range added {
+		slice, err := s.data.Get([]byte(key))
+		if err != nil {
+			return err
+		}
+		rv := new(nekolib.RollupValue)
+		if slice.Size() > 0 {
+			rv.FromBytes(slice.Data())
+		}
+		slice.Free()
+		rv.Merge(partial)
+		if old, found := removed[key]; found && !rv.Subtract(old) {
+			rv = s.aggregatePartial([]byte(key))
+		}
+		batch.Put([]byte(key), rv.ToBytes())
+	}
+	return s.data.WriteWith(batch, durability)
+}
+
+// aggregatePartial recomputes the partial rollup value stored at key from
+// the raw layer, callers hold s.rm
+func (s *Series) aggregatePartial(key []byte) *nekolib.RollupValue {
+	p := key[0]
+	ns := s.unmarshalKey(key)
+	_, bucketUpper := nekolib.RollupBucket(time.Unix(0, ns), p)
+	_, upper := s.blockBounds(ns)
+	if u := bucketUpper.UnixNano(); u < upper {
+		upper = u
+	}
+
+	rv := new(nekolib.RollupValue)
+	s.rangeOp(wireTs(ns), wireTs(upper-1), nekolib.PRIORITY_RAW, func(ts, value []byte) {
+		if v, ok := nekolib.NumericValue(s.ValueType, value); ok {
+			rv.Add(v)
+		}
+	})
+	return rv
+}
+
+// rebuildRollups recomputes every rollup bucket overlapping [start, end]
+// from the raw layer
+func (s *Series) rebuildRollups(start, end time.Time) error {
+	if !s.hasRollups() {
+		return nil
+	}
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	for _, p := range nekolib.RollupLayers {
+		lower, _ := nekolib.RollupBucket(start, p)
+		_, upper := nekolib.RollupBucket(end, p)
+
+		iter := s.data.NewIterator()
+		for iter.Seek(s.marshalKey(lower.UnixNano(), p)); iter.Valid(); iter.Next() {
+			key := iter.Key().Data()
+			if len(key) != TS_KEY_LEN+SERIES_KEY_PREFIX_LEN {
+				continue
+			}
+			if key[0] != byte(p) {
+				break
+			}
+			if s.unmarshalKey(key) >= upper.UnixNano() {
+				break
+			}
+			batch.Delete(append([]byte{}, key...))
+		}
+		iter.Close()
+
+		records := []*nekolib.NekodRecord{}
+		s.rangeOp(nekolib.Time2Bytes(lower), nekolib.Time2Bytes(upper.Add(-time.Nanosecond)),
+			nekolib.PRIORITY_RAW, func(key, value []byte) {
+				records = append(records, &nekolib.NekodRecord{key, value})
+			})
+
+		for key, rv := range s.aggregate(records, []uint8{p}) {
+			batch.Put([]byte(key), rv.ToBytes())
+		}
+	}
+	return s.data.Write(batch)
+}
+
+// PutRollups stores partial rollup values handed over with their frag
+// block as they are, callers skip partials stored here already
+func (s *Series) PutRollups(records []*nekolib.NekodRecord, priority uint8, durability uint8) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	if !nekolib.IsRollupLayer(priority) {
+		return fmt.Errorf("priority %d is not a rollup layer", priority)
+	}
+	if !s.hasRollups() {
+		return nil
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	batch := s.data.NewBatch()
+	defer batch.Destroy()
+	for _, r := range records {
+		ns, err := wireNano(r.Ts)
+		if err != nil {
+			return err
+		}
+		rv := new(nekolib.RollupValue)
+		if err := rv.FromBytes(r.Value); err != nil {
+			return err
+		}
+		batch.Put(s.marshalKey(ns, priority), rv.ToBytes())
+	}
+	return s.data.WriteWith(batch, durability)
+}
@@ -21,56 +21,88 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"sync"
 
 	"github.com/bigeagle/nekodb/nekolib"
 	. "github.com/tecbot/gorocksdb"
-	"github.com/vmihailenco/msgpack"
 )
 
 const (
-	TS_KEY_LEN             = 15
+	TS_KEY_LEN             = 8
 	SERIES_META_PREFIX_LEN = 4
 	SERIES_KEY_PREFIX_LEN  = 1
+	// versions kept by DUP_KEEP_ALL follow the first one, keyed with a
+	// big endian sequence suffix
+	SEQ_LEN                = 4
 	KEY_SERIES_NAME        = "srs_name"
 	KEY_SERIES_ID          = "srs_id"
 	KEY_SERIES_FRAG_LEVEL  = "srs_fragLevel"
+	KEY_SERIES_VALUE_TYPE  = "srs_valueType"
+	KEY_SERIES_COMPRESSION = "srs_compress"
+	KEY_SERIES_DUP_POLICY  = "srs_dupPolicy"
+	KEY_SERIES_FORMAT      = "srs_format"
 	KEY_SERIES_ELEM_COUNT  = "elm_count"
 	PREFIX_SERIES_KEY_MAP  = "key_"
 )
 
 var (
 	InvalidTimestamp = errors.New("Invalid Binary Timestamp")
+	SeriesClosed     = errors.New("Series Closed")
 )
 
 type Series struct {
 	m sync.RWMutex
+	// guards read-modify-write of rollup layers and block stats
+	rm sync.Mutex
+	// held shared by operations and exclusively by Destroy
+	life   sync.RWMutex
+	closed bool
 
 	data *RocksDB
 	meta *RocksDB
 
-	Name      string
-	Id        string
-	FragLevel int
+	Name        string
+	Id          string
+	FragLevel   int
+	ValueType   uint8
+	Compression uint8
+	// one of nekolib.DUP_*
+	DuplicatePolicy uint8
 
 	dbpath string
 }
 
-func NewSeries(name, id string, fragLevel int) (*Series, error) {
-	s, err := GetSeries(id)
+func NewSeries(info *nekolib.NekoSeriesInfo) (*Series, error) {
+	if err := TuneSeries(info.Id, info.Tuning); err != nil {
+		return nil, err
+	}
+	s, err := GetSeries(info.Id)
 	if err != nil {
 		return nil, err
 	}
-	s.Name = name
-	s.Id = id
-	s.FragLevel = fragLevel
-
-	s.meta.PutSync([]byte(KEY_SERIES_NAME), []byte(name))
-	s.meta.PutSync([]byte(KEY_SERIES_ID), []byte(id))
-	s.meta.PutSync([]byte(KEY_SERIES_FRAG_LEVEL), []byte{byte(fragLevel)})
-	s.meta.PutSync([]byte(KEY_SERIES_ELEM_COUNT), []byte{0, 0, 0, 0, 0, 0, 0, 0})
+	s.Name = info.Name
+	s.Id = info.Id
+	s.FragLevel = info.FragLevel
+	s.ValueType = info.ValueType
+	s.Compression = info.Compression
+	s.DuplicatePolicy = info.DuplicatePolicy
+
+	s.meta.PutSync([]byte(KEY_SERIES_NAME), []byte(s.Name))
+	s.meta.PutSync([]byte(KEY_SERIES_ID), []byte(s.Id))
+	s.meta.PutSync([]byte(KEY_SERIES_FRAG_LEVEL), []byte{byte(s.FragLevel)})
+	s.meta.PutSync([]byte(KEY_SERIES_VALUE_TYPE), []byte{s.ValueType})
+	s.meta.PutSync([]byte(KEY_SERIES_COMPRESSION), []byte{s.Compression})
+	s.meta.PutSync([]byte(KEY_SERIES_DUP_POLICY), []byte{s.DuplicatePolicy})
+	// the series may be registered again over existing data
+	if slice, err := s.meta.Get([]byte(KEY_SERIES_ELEM_COUNT)); err == nil {
+		if slice.Size() == 0 {
+			s.meta.PutSync([]byte(KEY_SERIES_ELEM_COUNT), []byte{0, 0, 0, 0, 0, 0, 0, 0})
+		}
+		slice.Free()
+	}
 
 	return s, nil
 }
@@ -84,31 +116,7 @@ func GetSeries(id string) (*Series, error) {
 	s := new(Series)
 
 	s.dbpath = path.Join(DB_PATH, id)
-	if _, err = os.Stat(s.dbpath); os.IsNotExist(err) {
-		err = os.MkdirAll(s.dbpath, os.ModeDir|os.FileMode(0700))
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	opts := NewDefaultOptions()
-	// opts.SetBlockCache(NewLRUCache(4<<30)) // 4MB cache
-	// opts.SetPrefixExtractor(NewFixedPrefixTransform(5)) // {data_, meta_}
-	opts.SetPrefixExtractor(NewFixedPrefixTransform(SERIES_KEY_PREFIX_LEN)) // {0, 1, 2, 3, ..., 255}
-	opts.SetFilterPolicy(NewBloomFilter(10))
-	opts.SetCreateIfMissing(true)
-
-	s.data, err = NewRocksDB(path.Join(s.dbpath, "data"), opts)
-	if err != nil {
-		return nil, err
-	}
-
-	mopts := NewDefaultOptions()
-	mopts.SetMergeOperator(new(int64AddOperator))
-	mopts.SetCreateIfMissing(true)
-	mopts.SetMaxSuccessiveMerges(10)
-	mopts.SetPrefixExtractor(NewFixedPrefixTransform(SERIES_META_PREFIX_LEN)) // {srs_, elm_, key_}
-	s.meta, err = NewRocksDB(path.Join(s.dbpath, "meta"), mopts)
+	s.data, s.meta, err = openSeriesDBs(id)
 	if err != nil {
 		return nil, err
 	}
@@ -143,12 +151,92 @@ func GetSeries(id string) (*Series, error) {
 		return nil, err
 	}
 
+	if slice, err := s.meta.Get([]byte(KEY_SERIES_VALUE_TYPE)); err == nil {
+		b := slice.Data()
+		if len(b) > 0 {
+			s.ValueType = b[0]
+		}
+		slice.Free()
+	} else {
+		return nil, err
+	}
+
+	if slice, err := s.meta.Get([]byte(KEY_SERIES_COMPRESSION)); err == nil {
+		b := slice.Data()
+		if len(b) > 0 {
+			s.Compression = b[0]
+		}
+		slice.Free()
+	} else {
+		return nil, err
+	}
+
+	if slice, err := s.meta.Get([]byte(KEY_SERIES_DUP_POLICY)); err == nil {
+		b := slice.Data()
+		if len(b) > 0 {
+			s.DuplicatePolicy = b[0]
+		}
+		slice.Free()
+	} else {
+		return nil, err
+	}
+
+	if err := s.checkFormat(); err != nil {
+		return nil, err
+	}
+
 	return s, nil
 }
 
+func dataOptions() *Options {
+	opts := NewDefaultOptions()
+	// opts.SetPrefixExtractor(NewFixedPrefixTransform(5)) // {data_, meta_}
+	opts.SetPrefixExtractor(NewFixedPrefixTransform(SERIES_KEY_PREFIX_LEN)) // {0, 1, 2, 3, ..., 255}
+	opts.SetCreateIfMissing(true)
+	return opts
+}
+
+func metaOptions() *Options {
+	mopts := NewDefaultOptions()
+	mopts.SetMergeOperator(new(int64AddOperator))
+	mopts.SetCreateIfMissing(true)
+	mopts.SetMaxSuccessiveMerges(10)
+	mopts.SetPrefixExtractor(NewFixedPrefixTransform(SERIES_META_PREFIX_LEN)) // {srs_, elm_, key_}
+	return mopts
+}
+
+// acquire keeps the series open until release, it fails once the series
+// is destroyed
+func (s *Series) acquire() error {
+	s.life.RLock()
+	if s.closed {
+		s.life.RUnlock()
+		return SeriesClosed
+	}
+	return nil
+}
+
+func (s *Series) release() {
+	s.life.RUnlock()
+}
+
+func (s *Series) Info() *nekolib.NekoSeriesInfo {
+	return &nekolib.NekoSeriesInfo{
+		Name:        s.Name,
+		Id:          s.Id,
+		FragLevel:   s.FragLevel,
+		ValueType:   s.ValueType,
+		Compression: s.Compression,
+
+		DuplicatePolicy: s.DuplicatePolicy,
+	}
+}
+
 func (s *Series) Count() (int, error) {
-	// s.m.RLock()
-	// defer s.m.RUnlock()
+	if err := s.acquire(); err != nil {
+		return -1, err
+	}
+	defer s.release()
 
 	bcount, err := s.meta.Get([]byte(KEY_SERIES_ELEM_COUNT))
 	if err != nil {
@@ -162,62 +250,226 @@ func (s *Series) Count() (int, error) {
 	}
 }
 
-func (s *Series) marshalKey(key []byte, priority uint8) []byte {
+func (s *Series) marshalKey(ns int64, priority uint8) []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, SERIES_KEY_PREFIX_LEN+TS_KEY_LEN))
 	buf.WriteByte(byte(priority))
-	buf.Write(key)
+	buf.Write(encodeTs(ns))
 	return buf.Bytes()
 }
 
-func (s *Series) unmarshalKey(_key []byte) []byte {
-	return _key[SERIES_KEY_PREFIX_LEN:]
+func (s *Series) unmarshalKey(_key []byte) int64 {
+	return decodeTs(_key[SERIES_KEY_PREFIX_LEN:])
+}
+
+// versionKey is the key of the seq-th version of a point, the first
+// version keeps the plain key
+func versionKey(key []byte, seq uint32) []byte {
+	if seq == 0 {
+		return key
+	}
+	vkey := make([]byte, len(key)+SEQ_LEN)
+	copy(vkey, key)
+	binary.BigEndian.PutUint32(vkey[len(key):], seq)
+	return vkey
+}
+
+// isPointKey tells keys of points, including later versions, from other
+// keys of the data column family
+func isPointKey(key []byte) bool {
+	return len(key) == SERIES_KEY_PREFIX_LEN+TS_KEY_LEN ||
+		len(key) == SERIES_KEY_PREFIX_LEN+TS_KEY_LEN+SEQ_LEN
+}
+
+// Rollup layers are stored uncompressed, one aggregate per key
+func (s *Series) compressed(priority uint8) bool {
+	return s.Compression == nekolib.COMPRESS_GORILLA && !nekolib.IsRollupLayer(priority)
 }
 
 func (s *Series) Insert(key, value []byte, priority uint8) error {
-	if len(key) != TS_KEY_LEN {
-		return InvalidTimestamp
+	_, err := s.InsertBatch([]*nekolib.NekodRecord{&nekolib.NekodRecord{key, value}}, priority, nekolib.DURABILITY_WAL)
+	return err
+}
+
+// InsertBatch writes points with the given durability, one of
+// nekolib.DURABILITY_*. Counters, block stats and rollups are written
+// with the same durability, recount fixes counters after losing unlogged
+// points.
+// Points at timestamps already stored are handled by the duplicate policy
+// of the series, their number is returned.
+func (s *Series) InsertBatch(records []*nekolib.NekodRecord, priority uint8, durability uint8) (int, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+	if nekolib.IsRollupLayer(priority) {
+		return 0, fmt.Errorf("priority %d is a rollup layer", priority)
+	}
+	for _, r := range records {
+		if _, err := wireNano(r.Ts); err != nil {
+			return 0, err
+		}
+		if err := nekolib.ValidateValue(s.ValueType, r.Value); err != nil {
+			return 0, err
+		}
 	}
 
-	key = s.marshalKey(key, priority)
-	if err := s.data.Put(key, value); err == nil {
-		s.addCount(int64(1))
-		return nil
+	// held until block stats and rollups follow the points, so that
+	// Expire and DeleteRange never see one without the other
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var res insertResult
+	var err error
+	if s.compressed(priority) {
+		res, err = s.insertCompressed(records, priority, durability)
 	} else {
-		return err
+		res, err = s.insertKeys(records, priority, durability)
+	}
+	if err != nil {
+		return 0, err
 	}
+
+	if priority == nekolib.PRIORITY_RAW && len(res.written) > 0 {
+		if err := s.updateBlockStats(res.written, res.replaced, durability); err != nil {
+			return res.duplicates, err
+		}
+		return res.duplicates, s.updateRollups(res.written, res.replaced, durability)
+	}
+	return res.duplicates, nil
+}
+
+// Outcome of writing a batch, written are records which made it into
+// the data, duplicates those hitting a timestamp already stored and
+// replaced the values overwritten by written records
+type insertResult struct {
+	written    []*nekolib.NekodRecord
+	replaced   []*nekolib.NekodRecord
+	duplicates int
 }
 
-func (s *Series) InsertBatch(records []*nekolib.NekodRecord, priority uint8) error {
-	batch := NewWriteBatch()
+// insertKeys stores one key per record, points already stored are handled
+// by the duplicate policy and not counted again
+func (s *Series) insertKeys(records []*nekolib.NekodRecord, priority uint8, durability uint8) (insertResult, error) {
+	var res insertResult
+	batch := s.data.NewBatch()
 	defer batch.Destroy()
+	added := 0
+	// versions stored of each timestamp, including those of this batch
+	versions := make(map[string]uint32, len(records))
+	// values written by this batch, to know what an overwrite replaces
+	latest := make(map[string][]byte, len(records))
 	for _, r := range records {
-		if len(r.Ts) != TS_KEY_LEN {
-			return InvalidTimestamp
+		ns, _ := wireNano(r.Ts)
+		key := s.marshalKey(ns, priority)
+		n, found := versions[string(key)]
+		if !found {
+			var err error
+			if n, err = s.countVersions(key); err != nil {
+				return res, err
+			}
+		}
+		if n > 0 {
+			res.duplicates++
+		}
+
+		switch {
+		case n == 0:
+			batch.Put(key, r.Value)
+			added++
+			n++
+		case s.DuplicatePolicy == nekolib.DUP_FIRST_WINS:
+			versions[string(key)] = n
+			continue
+		case s.DuplicatePolicy == nekolib.DUP_KEEP_ALL:
+			batch.Put(versionKey(key, n), r.Value)
+			added++
+			n++
+		default:
+			old, found := latest[string(key)]
+			if !found {
+				slice, err := s.data.Get(key)
+				if err != nil {
+					return insertResult{}, err
+				}
+				old = append([]byte{}, slice.Data()...)
+				slice.Free()
+			}
+			res.replaced = append(res.replaced, &nekolib.NekodRecord{r.Ts, old})
+			batch.Put(key, r.Value)
 		}
-		key := s.marshalKey(r.Ts, priority)
-		batch.Put(key, r.Value)
+		versions[string(key)] = n
+		latest[string(key)] = r.Value
+		res.written = append(res.written, r)
+	}
+	if res.duplicates > 0 && s.DuplicatePolicy == nekolib.DUP_REJECT {
+		return insertResult{}, nekolib.DuplicateTimestamps
+	}
+	if len(res.written) == 0 {
+		return res, nil
+	}
+	if err := s.data.WriteWith(batch, durability); err != nil {
+		return insertResult{}, err
 	}
+	return res, s.addCount(int64(added), durability)
+}
 
-	if err := s.data.Write(batch); err == nil {
-		s.addCount(int64(len(records)))
-		return nil
-	} else {
-		return err
+// countVersions returns the number of points stored at the timestamp of
+// key, only series keeping all versions may have more than one
+func (s *Series) countVersions(key []byte) (uint32, error) {
+	if s.DuplicatePolicy != nekolib.DUP_KEEP_ALL {
+		slice, err := s.data.Get(key)
+		if err != nil {
+			return 0, err
+		}
+		defer slice.Free()
+		if slice.Size() == 0 {
+			return 0, nil
+		}
+		return 1, nil
+	}
+
+	n := uint32(0)
+	iter := s.data.NewIterator()
+	defer iter.Close()
+	for iter.Seek(key); iter.Valid(); iter.Next() {
+		vkey := iter.Key().Data()
+		if !bytes.HasPrefix(vkey, key) || !isPointKey(vkey) {
+			break
+		}
+		n++
 	}
+	return n, nil
 }
 
 func (s *Series) RangeOp(start, end []byte, priority uint8, op func(key, value []byte)) {
-	endTs, _ := nekolib.Bytes2Time(end)
+	if err := s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+	s.rangeOp(start, end, priority, op)
+}
+
+func (s *Series) rangeOp(start, end []byte, priority uint8, op func(key, value []byte)) {
+	startNs, err := wireNano(start)
+	if err != nil {
+		return
+	}
+	endNs, err := wireNano(end)
+	if err != nil {
+		return
+	}
 
-	start = s.marshalKey(start, priority)
-	end = s.marshalKey(end, priority)
+	if s.compressed(priority) {
+		s.rangeOpCompressed(startNs, endNs, priority, op)
+		return
+	}
 
 	iter := s.data.NewIterator()
 	defer iter.Close()
-	for iter.Seek(start); iter.Valid(); iter.Next() {
+	for iter.Seek(s.marshalKey(startNs, priority)); iter.Valid(); iter.Next() {
 		key := iter.Key().Data()
 		// Continue if invalid key
-		if len(key) != TS_KEY_LEN+SERIES_KEY_PREFIX_LEN {
+		if !isPointKey(key) {
 			continue
 		}
 		// Stop if passed prefix
@@ -225,38 +477,47 @@ func (s *Series) RangeOp(start, end []byte, priority uint8, op func(key, value [
 			break
 		}
 
-		cur := s.unmarshalKey(key)
-
 		// stop if went after end
-		curTs, _ := nekolib.Bytes2Time(cur)
-		if curTs.After(endTs) {
+		cur := s.unmarshalKey(key)
+		if cur > endNs {
 			break
 		}
 		v := iter.Value().Data()
-		op(cur, v)
+		op(wireTs(cur), v)
 	}
 }
 
-func (s *Series) ReverseHash(h uint32, ts_start, ts_end []byte) error {
-	m := map[string]interface{}{
-		"ts_start": ts_start,
-		"ts_end":   ts_end,
-	}
-	value, _ := msgpack.Marshal(m)
-	key := bytes.NewBuffer(make([]byte, 0, SERIES_META_PREFIX_LEN+4))
-	key.Write([]byte(PREFIX_SERIES_KEY_MAP))
-	binary.Write(key, binary.BigEndian, h)
-	return s.meta.PutSync(key.Bytes(), value)
-}
-
-func (s *Series) addCount(n int64) error {
+func (s *Series) addCount(n int64, durability uint8) error {
 	key := []byte(KEY_SERIES_ELEM_COUNT)
 	buf := bytes.NewBuffer(make([]byte, 0, 8))
 	binary.Write(buf, binary.BigEndian, n)
-	return s.meta.Merge(key, buf.Bytes())
+	return s.meta.MergeWith(key, buf.Bytes(), durability)
 }
 
+// Close waits for running operations, then closes the series and keeps
+// its data, later operations fail with SeriesClosed
+func (s *Series) Close() error {
+	s.life.Lock()
+	defer s.life.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.data.Close()
+	s.meta.Close()
+	return nil
+}
+
+// Destroy waits for running operations, then drops the column families
+// of the series, later operations fail with SeriesClosed
 func (s *Series) Destroy() error {
+	s.life.Lock()
+	defer s.life.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
 	err := s.data.Destroy()
 	if err != nil {
 		return err
@@ -269,5 +530,28 @@ func (s *Series) Destroy() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return TuneSeries(s.Id, nil)
+}
+
+// DestroySeries removes data of a series which is not opened
+func DestroySeries(id string) error {
+	if !inited {
+		return NotInited
+	}
+	if id == "" {
+		return errors.New("Empty Series Id")
+	}
+	d, err := getShared()
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{CF_DATA_PREFIX + id, CF_META_PREFIX + id} {
+		if err := d.dropColumnFamily(name); err != nil {
+			return err
+		}
+	}
+	if err := d.tuneSeries(id, nil); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(DB_PATH, id))
 }
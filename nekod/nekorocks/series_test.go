@@ -18,6 +18,9 @@
 package nekorocks
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"strings"
@@ -35,13 +38,16 @@ func TestSeriesOperations(t *testing.T) {
 	if _, err := os.Stat(dbpath); os.IsNotExist(err) {
 		os.MkdirAll(dbpath, os.ModeDir|os.FileMode(0755))
 	}
-	series_name := "test"
-	series_id := "alsir12"
-	frag_level := 12
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:      "test",
+		Id:        "alsir12",
+		FragLevel: 12,
+		ValueType: nekolib.VALUE_STRING,
+	}
 	InitNekoRocks(dbpath, nil)
 
 	Convey("Subject: Test Series Operations", t, func() {
-		series, err := NewSeries(series_name, series_id, frag_level)
+		series, err := NewSeries(series_info)
 		Convey("Error Should Be Nil", func() {
 			So(err, ShouldBeNil)
 		})
@@ -80,7 +86,7 @@ func TestSeriesOperations(t *testing.T) {
 			r = &nekolib.NekodRecord{key, value}
 			records = append(records, r)
 
-			err := series.InsertBatch(records, 1)
+			_, err := series.InsertBatch(records, 1, nekolib.DURABILITY_WAL)
 			So(err, ShouldBeNil)
 
 			count, err := series.Count()
@@ -111,3 +117,648 @@ func TestSeriesOperations(t *testing.T) {
 		})
 	})
 }
+
+func TestCompressedSeries(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:        "test_compressed",
+		Id:          "cmpr0001",
+		FragLevel:   12,
+		ValueType:   nekolib.VALUE_FLOAT64,
+		Compression: nekolib.COMPRESS_GORILLA,
+	}
+	InitNekoRocks(dbpath, nil)
+
+	Convey("Subject: Test Compressed Series", t, func() {
+		series, err := NewSeries(series_info)
+		So(err, ShouldBeNil)
+
+		base := time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC)
+		records := make([]*nekolib.NekodRecord, 0)
+		for i := 0; i < 100; i++ {
+			v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, fmt.Sprintf("%d.5", i))
+			ts := nekolib.Time2Bytes(base.Add(time.Duration(i) * 5 * time.Minute))
+			records = append(records, &nekolib.NekodRecord{Ts: ts, Value: v})
+		}
+
+		Convey("Batch Should Be Inserted Across Blocks", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			Convey("Range Should Be Decoded", func() {
+				start := nekolib.Time2Bytes(base.Add(10 * time.Minute))
+				end := nekolib.Time2Bytes(base.Add(4 * time.Hour))
+				values := make([]string, 0)
+				series.RangeOp(start, end, 0, func(key, value []byte) {
+					values = append(values, nekolib.FormatValue(series.ValueType, value))
+				})
+				So(len(values), ShouldEqual, 47)
+				So(values[0], ShouldEqual, "2.5")
+				So(values[46], ShouldEqual, "48.5")
+			})
+
+			Convey("Last Should Fall Back To Earlier Blocks", func() {
+				before := nekolib.Time2Bytes(base.Add(252 * time.Minute))
+				last, err := series.Last(before, 20)
+				So(err, ShouldBeNil)
+				So(len(last), ShouldEqual, 20)
+				So(nekolib.FormatValue(series.ValueType, last[0].Value), ShouldEqual, "50.5")
+				So(nekolib.FormatValue(series.ValueType, last[19].Value), ShouldEqual, "31.5")
+
+				last, err = series.Last(records[2].Ts, 20)
+				So(err, ShouldBeNil)
+				So(len(last), ShouldEqual, 3)
+			})
+
+			Convey("Appends Should Overwrite Points", func() {
+				v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, "-1")
+				err := series.Insert(records[3].Ts, v, 0)
+				So(err, ShouldBeNil)
+
+				values := make([]string, 0)
+				series.RangeOp(records[3].Ts, records[3].Ts, 0, func(key, value []byte) {
+					values = append(values, nekolib.FormatValue(series.ValueType, value))
+				})
+				So(values, ShouldResemble, []string{"-1"})
+			})
+		})
+
+		Convey("Rollups Should Follow Raw Points", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			// partials of a bucket may come from several frag blocks
+			buckets := func(priority uint8) map[int64]*nekolib.RollupValue {
+				m := make(map[int64]*nekolib.RollupValue)
+				start := nekolib.Time2Bytes(base.Add(-24 * time.Hour))
+				end := nekolib.Time2Bytes(base.Add(24 * time.Hour))
+				series.RangeOp(start, end, priority, func(key, value []byte) {
+					t, _ := nekolib.Bytes2Time(key)
+					lower, _ := nekolib.RollupBucket(t, priority)
+					rv := new(nekolib.RollupValue)
+					So(rv.FromBytes(value), ShouldBeNil)
+					if _, found := m[lower.Unix()]; !found {
+						m[lower.Unix()] = new(nekolib.RollupValue)
+					}
+					m[lower.Unix()].Merge(rv)
+				})
+				return m
+			}
+
+			hours := buckets(nekolib.PRIORITY_ROLLUP_1H)
+			So(len(hours), ShouldEqual, 9)
+			first := hours[base.Unix()]
+			So(first.Count, ShouldEqual, 12)
+			So(first.Min, ShouldEqual, 0.5)
+			So(first.Max, ShouldEqual, 11.5)
+
+			days := buckets(nekolib.PRIORITY_ROLLUP_1D)
+			So(len(days), ShouldEqual, 1)
+			So(days[base.Unix()].Count, ShouldEqual, 100)
+			So(days[base.Unix()].Sum, ShouldEqual, 5000)
+
+			Convey("Overwritten Points Should Be Updated", func() {
+				v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, "-1")
+				err := series.Insert(records[3].Ts, v, 0)
+				So(err, ShouldBeNil)
+
+				first := buckets(nekolib.PRIORITY_ROLLUP_1H)[base.Unix()]
+				So(first.Count, ShouldEqual, 12)
+				So(first.Min, ShouldEqual, -1)
+				So(first.Sum, ShouldEqual, 72-3.5-1)
+
+				// the max of the bucket is replaced by a smaller value
+				v, _ = nekolib.ParseValue(nekolib.VALUE_FLOAT64, "5")
+				_, err = series.InsertBatch([]*nekolib.NekodRecord{{records[11].Ts, v}}, 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldBeNil)
+
+				first = buckets(nekolib.PRIORITY_ROLLUP_1H)[base.Unix()]
+				So(first.Count, ShouldEqual, 12)
+				So(first.Max, ShouldEqual, 10.5)
+				So(buckets(nekolib.PRIORITY_ROLLUP_1D)[base.Unix()].Count, ShouldEqual, 100)
+
+				count, err := series.Count()
+				So(err, ShouldBeNil)
+				So(count, ShouldEqual, len(records))
+			})
+
+			Convey("Handed Rollups Should Be Stored As They Are", func() {
+				t := base.Add(20 * time.Hour)
+				rv := &nekolib.RollupValue{3, 1, 3, 6}
+				handed := []*nekolib.NekodRecord{{nekolib.Time2Bytes(t), rv.ToBytes()}}
+				So(series.PutRollups(handed, nekolib.PRIORITY_RAW, nekolib.DURABILITY_WAL), ShouldNotBeNil)
+				So(series.PutRollups(handed, nekolib.PRIORITY_ROLLUP_1H, nekolib.DURABILITY_WAL), ShouldBeNil)
+
+				hours := buckets(nekolib.PRIORITY_ROLLUP_1H)
+				So(len(hours), ShouldEqual, 10)
+				So(hours[t.Unix()], ShouldResemble, rv)
+			})
+		})
+
+		Convey("Block Stats Should Summarize Points", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			first, last, ok := series.Bounds()
+			So(ok, ShouldBeTrue)
+			So(first.Equal(base), ShouldBeTrue)
+			So(last.Equal(base.Add(99*5*time.Minute)), ShouldBeTrue)
+
+			summarize := func() *Summary {
+				summary := new(Summary)
+				series.forEachBlockInfo(func(key []byte, info *blockInfo) {
+					summary.merge(info)
+				})
+				return summary
+			}
+			all := summarize()
+			So(all.Count, ShouldEqual, 100)
+			So(all.Sum, ShouldEqual, 5000)
+			So(all.Min, ShouldEqual, 0.5)
+			So(all.Max, ShouldEqual, 99.5)
+
+			Convey("Deleted Points Should Leave Stats", func() {
+				_, err := series.DeleteRange(records[10].Ts, records[29].Ts, 0)
+				So(err, ShouldBeNil)
+
+				all := summarize()
+				So(all.Count, ShouldEqual, 80)
+				So(all.Sum, ShouldEqual, 5000-400)
+			})
+		})
+
+		Convey("Reimports Should Not Change Counts", func() {
+			dups, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+			So(dups, ShouldEqual, 0)
+			dups, err = series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+			So(dups, ShouldEqual, len(records))
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records))
+
+			n, err := series.Recount()
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, len(records))
+		})
+
+		Convey("DeleteRange Should Drop Points And Fix Counts", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			n, err := series.DeleteRange(records[10].Ts, records[29].Ts, 0)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 20)
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records)-20)
+
+			values := 0
+			series.RangeOp(records[0].Ts, records[99].Ts, 0, func(key, value []byte) {
+				values++
+			})
+			So(values, ShouldEqual, len(records)-20)
+
+			total := int64(0)
+			series.RangeOp(records[0].Ts, records[99].Ts, nekolib.PRIORITY_ROLLUP_1D,
+				func(key, value []byte) {
+					rv := new(nekolib.RollupValue)
+					rv.FromBytes(value)
+					total += rv.Count
+				})
+			So(total, ShouldEqual, len(records)-20)
+		})
+
+		Convey("Expire Should Drop Whole Old Blocks", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			before := base.Add(2 * time.Hour)
+			cutoff, _ := nekolib.TsBoundary(
+				nekolib.Bytes2TimeSec(nekolib.Time2Bytes(before)), series_info.FragLevel)
+			expected := 0
+			for _, r := range records {
+				if nekolib.Bytes2TimeSec(r.Ts) < cutoff {
+					expected++
+				}
+			}
+
+			n, err := series.Expire(before)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, expected)
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records)-expected)
+		})
+
+		Convey("Emptied Blocks Should Be Forgotten", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+			blocks, err := series.Blocks()
+			So(err, ShouldBeNil)
+			total := int64(0)
+			for _, b := range blocks {
+				total += b.Count
+			}
+			So(total, ShouldEqual, int64(len(records)))
+
+			// the first block is emptied, the next one only partially
+			first := blocks[0]
+			for _, b := range blocks {
+				if b.Start < first.Start {
+					first = b
+				}
+			}
+			_, err = series.DeleteRange(records[0].Ts, wireTs(first.End+1), 0)
+			So(err, ShouldBeNil)
+			left, err := series.Blocks()
+			So(err, ShouldBeNil)
+			So(len(left), ShouldEqual, len(blocks)-1)
+			for _, b := range left {
+				So(b.Hash, ShouldNotEqual, first.Hash)
+			}
+		})
+
+		Convey("Dropped Blocks Should Be Forgotten", func() {
+			_, err := series.InsertBatch(records, 0, nekolib.DURABILITY_WAL)
+			So(err, ShouldBeNil)
+
+			blocks, err := series.Blocks()
+			So(err, ShouldBeNil)
+			So(len(blocks), ShouldBeGreaterThan, 1)
+			expected := 0
+			for _, r := range records {
+				t, _ := nekolib.Bytes2Time(r.Ts)
+				if t.UnixNano() >= blocks[0].Start && t.UnixNano() < blocks[0].End {
+					expected++
+				}
+			}
+
+			n, err := series.DropBlock(blocks[0].Hash)
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, expected)
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, len(records)-expected)
+			left, err := series.Blocks()
+			So(err, ShouldBeNil)
+			So(len(left), ShouldEqual, len(blocks)-1)
+		})
+
+		Convey("Invalid Values Should Be Rejected", func() {
+			err := series.Insert(records[0].Ts, []byte("abc"), 0)
+			So(err, ShouldEqual, nekolib.InvalidValue)
+		})
+
+		Reset(func() {
+			series.Destroy()
+		})
+	})
+}
+
+func TestDestroyedSeries(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:      "test_destroyed",
+		Id:        "dstr0001",
+		FragLevel: 12,
+		ValueType: nekolib.VALUE_FLOAT64,
+	}
+	InitNekoRocks(dbpath, nil)
+
+	Convey("Subject: Test Destroyed Series", t, func() {
+		series, err := NewSeries(series_info)
+		So(err, ShouldBeNil)
+
+		v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, "1")
+		ts := nekolib.Time2Bytes(time.Now())
+		So(series.Insert(ts, v, 0), ShouldBeNil)
+
+		So(series.Destroy(), ShouldBeNil)
+		_, err = os.Stat(path.Join(dbpath, series_info.Id))
+		So(os.IsNotExist(err), ShouldBeTrue)
+
+		Convey("Operations Should Fail After Destroy", func() {
+			So(series.Insert(ts, v, 0), ShouldEqual, SeriesClosed)
+			_, err := series.DeleteRange(ts, ts, 0)
+			So(err, ShouldEqual, SeriesClosed)
+			_, err = series.Count()
+			So(err, ShouldEqual, SeriesClosed)
+		})
+
+		Convey("Destroy Should Be Idempotent", func() {
+			So(series.Destroy(), ShouldBeNil)
+			So(DestroySeries(series_info.Id), ShouldBeNil)
+		})
+	})
+}
+
+func TestFormatMigration(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:      "test_migration",
+		Id:        "mgrt0001",
+		FragLevel: 12,
+		ValueType: nekolib.VALUE_STRING,
+	}
+	InitNekoRocks(dbpath, nil)
+
+	Convey("Subject: Test Format Migration", t, func() {
+		series, err := NewSeries(series_info)
+		So(err, ShouldBeNil)
+
+		// write keys the way FORMAT_V0 did and forget the format
+		base := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 10; i++ {
+			ts := nekolib.Time2Bytes(base.Add(time.Duration(i) * time.Minute))
+			key := append([]byte{0}, ts...)
+			So(len(key), ShouldEqual, SERIES_KEY_PREFIX_LEN+TS_KEY_LEN_V0)
+			So(series.data.Put(key, []byte(fmt.Sprintf("v%d", i))), ShouldBeNil)
+		}
+		So(series.meta.Delete([]byte(KEY_SERIES_FORMAT)), ShouldBeNil)
+		series.data.Close()
+		series.meta.Close()
+
+		series, err = GetSeries(series_info.Id)
+		So(err, ShouldBeNil)
+
+		Convey("Keys Should Be Rewritten And Counted", func() {
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 10)
+
+			values := []string{}
+			series.RangeOp(nekolib.Time2Bytes(base), nekolib.Time2Bytes(base.Add(time.Hour)), 0,
+				func(key, value []byte) {
+					values = append(values, string(value))
+				})
+			So(len(values), ShouldEqual, 10)
+			So(values[0], ShouldEqual, "v0")
+			So(values[9], ShouldEqual, "v9")
+
+			slice, err := series.meta.Get([]byte(KEY_SERIES_FORMAT))
+			So(err, ShouldBeNil)
+			So(slice.Data(), ShouldResemble, []byte{FORMAT_CURRENT})
+			slice.Free()
+		})
+
+		Reset(func() {
+			series.Destroy()
+		})
+	})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	snappath := path.Join(os.TempDir(), "nekodb-snapshots", "snap0001")
+	series_info := &nekolib.NekoSeriesInfo{
+		Name:      "test_snapshot",
+		Id:        "snap0001",
+		FragLevel: 12,
+		ValueType: nekolib.VALUE_FLOAT64,
+	}
+	InitNekoRocks(dbpath, nil)
+	os.RemoveAll(snappath)
+
+	Convey("Subject: Test Snapshot And Restore", t, func() {
+		series, err := NewSeries(series_info)
+		So(err, ShouldBeNil)
+
+		base := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+		records := make([]*nekolib.NekodRecord, 0)
+		for i := 0; i < 100; i++ {
+			v, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, fmt.Sprintf("%d", i))
+			ts := nekolib.Time2Bytes(base.Add(time.Duration(i) * time.Minute))
+			records = append(records, &nekolib.NekodRecord{ts, v})
+		}
+		_, err = series.InsertBatch(records[:60], 0, nekolib.DURABILITY_WAL)
+		So(err, ShouldBeNil)
+		So(series.Snapshot(snappath), ShouldBeNil)
+		_, err = series.InsertBatch(records[60:], 0, nekolib.DURABILITY_WAL)
+		So(err, ShouldBeNil)
+
+		Convey("Existing Snapshots Should Not Be Overwritten", func() {
+			So(series.Snapshot(snappath), ShouldNotBeNil)
+		})
+
+		Convey("Live Series Should Not Be Replaced", func() {
+			_, err := RestoreSeries(snappath, series_info.Id)
+			So(err, ShouldEqual, SeriesExists)
+		})
+
+		Convey("Restored Series Should Match The Snapshot", func() {
+			So(series.Destroy(), ShouldBeNil)
+			series, err = RestoreSeries(snappath, series_info.Id)
+			So(err, ShouldBeNil)
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 60)
+
+			first, last, ok := series.Bounds()
+			So(ok, ShouldBeTrue)
+			So(first.Equal(base), ShouldBeTrue)
+			So(last.Equal(base.Add(59*time.Minute)), ShouldBeTrue)
+		})
+
+		Reset(func() {
+			series.Destroy()
+			os.RemoveAll(snappath)
+		})
+	})
+}
+
+func TestSharedDBMigration(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	id := "lgcy0001"
+	InitNekoRocks(dbpath, nil)
+
+	Convey("Subject: Test Moving Series Into The Shared DB", t, func() {
+		// lay out a series the way it was stored before the shared DB
+		legacy := path.Join(dbpath, id)
+		data, err := NewRocksDB(path.Join(legacy, "data"), dataOptions())
+		So(err, ShouldBeNil)
+		meta, err := NewRocksDB(path.Join(legacy, "meta"), metaOptions())
+		So(err, ShouldBeNil)
+
+		base := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 10; i++ {
+			key := encodeTs(base.Add(time.Duration(i) * time.Minute).UnixNano())
+			So(data.Put(append([]byte{0}, key...), []byte(fmt.Sprintf("v%d", i))), ShouldBeNil)
+		}
+		So(meta.Put([]byte(KEY_SERIES_NAME), []byte("test_legacy")), ShouldBeNil)
+		So(meta.Put([]byte(KEY_SERIES_ID), []byte(id)), ShouldBeNil)
+		So(meta.Put([]byte(KEY_SERIES_FRAG_LEVEL), []byte{12}), ShouldBeNil)
+		So(meta.Put([]byte(KEY_SERIES_FORMAT), []byte{FORMAT_CURRENT}), ShouldBeNil)
+		So(meta.Put([]byte(KEY_SERIES_ELEM_COUNT), []byte{0, 0, 0, 0, 0, 0, 0, 10}), ShouldBeNil)
+		data.Close()
+		meta.Close()
+
+		series, err := GetSeries(id)
+		So(err, ShouldBeNil)
+
+		Convey("Series Should Be Read From The Shared DB", func() {
+			_, err := os.Stat(legacy)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(HasSeries(id), ShouldBeTrue)
+			So(series.Name, ShouldEqual, "test_legacy")
+
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 10)
+
+			values := 0
+			series.RangeOp(nekolib.Time2Bytes(base), nekolib.Time2Bytes(base.Add(time.Hour)), 0,
+				func(key, value []byte) {
+					values++
+				})
+			So(values, ShouldEqual, 10)
+		})
+
+		Convey("Destroy Should Drop Column Families", func() {
+			So(series.Destroy(), ShouldBeNil)
+			So(HasSeries(id), ShouldBeFalse)
+		})
+
+		Convey("Shared DB Should Not Move While Open", func() {
+			InitNekoRocks(path.Join(os.TempDir(), "nekodb-moved"), nil)
+			_, err := GetSeries(id)
+			So(err, ShouldNotBeNil)
+
+			InitNekoRocks(dbpath, nil)
+			count, err := series.Count()
+			So(err, ShouldBeNil)
+			So(count, ShouldEqual, 10)
+		})
+
+		Reset(func() {
+			series.Destroy()
+		})
+	})
+}
+
+func TestSeriesTuning(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	InitNekoRocks(dbpath, nil)
+
+	Convey("Subject: Test Series Tuning", t, func() {
+		series_info := &nekolib.NekoSeriesInfo{
+			Name:      "test_tuned",
+			Id:        "tune0001",
+			FragLevel: 12,
+			Tuning: &nekolib.SeriesTuning{
+				WriteBufferSize:  64 << 20,
+				BlockCompression: "lz4",
+			},
+		}
+		series, err := NewSeries(series_info)
+		So(err, ShouldBeNil)
+		tuningFile := path.Join(dbpath, SHARED_DB_DIR, SERIES_TUNING_FILE)
+
+		Convey("Overrides Should Be Recorded", func() {
+			b, err := ioutil.ReadFile(tuningFile)
+			So(err, ShouldBeNil)
+			var recorded map[string]*nekolib.SeriesTuning
+			So(json.Unmarshal(b, &recorded), ShouldBeNil)
+			So(*recorded["tune0001"], ShouldResemble, *series_info.Tuning)
+		})
+
+		Convey("Unknown Compression Should Be Rejected", func() {
+			err := TuneSeries("tune0002", &nekolib.SeriesTuning{BlockCompression: "gzip"})
+			So(err, ShouldNotBeNil)
+			So(SetTuning(Tuning{Compression: "gzip"}), ShouldNotBeNil)
+		})
+
+		Convey("Destroy Should Drop Overrides", func() {
+			So(series.Destroy(), ShouldBeNil)
+			b, err := ioutil.ReadFile(tuningFile)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldNotContainSubstring, "tune0001")
+		})
+
+		Reset(func() {
+			series.Destroy()
+		})
+	})
+}
+
+func TestDuplicatePolicy(t *testing.T) {
+	dbpath := path.Join(os.TempDir(), "nekodb")
+	InitNekoRocks(dbpath, nil)
+
+	base := time.Date(2014, 6, 1, 0, 0, 0, 0, time.UTC)
+	point := func(i int, v float64) *nekolib.NekodRecord {
+		value, _ := nekolib.ParseValue(nekolib.VALUE_FLOAT64, fmt.Sprintf("%f", v))
+		return &nekolib.NekodRecord{nekolib.Time2Bytes(base.Add(time.Duration(i) * time.Minute)), value}
+	}
+	first := []*nekolib.NekodRecord{point(0, 1), point(1, 1)}
+	second := []*nekolib.NekodRecord{point(1, 2), point(2, 2)}
+
+	for _, compression := range []uint8{nekolib.COMPRESS_NONE, nekolib.COMPRESS_GORILLA} {
+		Convey(fmt.Sprintf("Subject: Test Duplicate Policy, Compression %d", compression), t, func() {
+			newSeries := func(policy uint8) *Series {
+				series, err := NewSeries(&nekolib.NekoSeriesInfo{
+					Name:            "test_dups",
+					Id:              "dups0001",
+					FragLevel:       12,
+					Compression:     compression,
+					DuplicatePolicy: policy,
+				})
+				So(err, ShouldBeNil)
+				dups, err := series.InsertBatch(first, 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldBeNil)
+				So(dups, ShouldEqual, 0)
+				return series
+			}
+			values := func(series *Series) []string {
+				vs := []string{}
+				series.RangeOp(first[0].Ts, second[1].Ts, 0, func(key, value []byte) {
+					vs = append(vs, nekolib.FormatValue(nekolib.VALUE_FLOAT64, value))
+				})
+				return vs
+			}
+			var series *Series
+
+			Convey("First Write Should Win", func() {
+				series = newSeries(nekolib.DUP_FIRST_WINS)
+				dups, err := series.InsertBatch(second, 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldBeNil)
+				So(dups, ShouldEqual, 1)
+				So(values(series), ShouldResemble, []string{"1", "1", "2"})
+				count, _ := series.Count()
+				So(count, ShouldEqual, 3)
+			})
+
+			Convey("Duplicates Should Be Rejected", func() {
+				series = newSeries(nekolib.DUP_REJECT)
+				_, err := series.InsertBatch(second, 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldEqual, nekolib.DuplicateTimestamps)
+				So(values(series), ShouldResemble, []string{"1", "1"})
+			})
+
+			Convey("All Versions Should Be Kept", func() {
+				series = newSeries(nekolib.DUP_KEEP_ALL)
+				dups, err := series.InsertBatch(second, 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldBeNil)
+				So(dups, ShouldEqual, 1)
+				dups, err = series.InsertBatch(second[:1], 0, nekolib.DURABILITY_WAL)
+				So(err, ShouldBeNil)
+				So(dups, ShouldEqual, 1)
+				So(values(series), ShouldResemble, []string{"1", "1", "2", "2", "2"})
+				count, _ := series.Count()
+				So(count, ShouldEqual, 5)
+			})
+
+			Reset(func() {
+				if series != nil {
+					series.Destroy()
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,256 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	. "github.com/tecbot/gorocksdb"
+)
+
+// All series of a nekod live in one RocksDB, each series in a data and a
+// meta column family. WAL and block cache are shared, memtables of all
+// column families are flushed once together they exceed the DB write
+// buffer size of the tuning.
+const (
+	SHARED_DB_DIR    = "_shared"
+	CF_DATA_PREFIX   = "data:"
+	CF_META_PREFIX   = "meta:"
+	BLOCK_CACHE_SIZE = 256 << 20
+)
+
+type sharedDB struct {
+	m       sync.Mutex
+	dbpath  string
+	db      *DB
+	cache   *Cache
+	handles map[string]*ColumnFamilyHandle
+	// overrides by series id
+	seriesTuning map[string]*nekolib.SeriesTuning
+}
+
+var (
+	sharedM sync.Mutex
+	shared  *sharedDB
+)
+
+// getShared opens the shared DB under DB_PATH on first use. Open series
+// hold column families of the shared DB, so it stays where it was opened.
+func getShared() (*sharedDB, error) {
+	sharedM.Lock()
+	defer sharedM.Unlock()
+
+	dbpath := path.Join(DB_PATH, SHARED_DB_DIR)
+	if shared != nil {
+		if shared.dbpath != dbpath {
+			return nil, fmt.Errorf("shared DB is open at %s, not moving it to %s", shared.dbpath, dbpath)
+		}
+		return shared, nil
+	}
+	d, err := openShared(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	shared = d
+	return shared, nil
+}
+
+func openShared(dbpath string) (*sharedDB, error) {
+	d := &sharedDB{
+		dbpath:  dbpath,
+		cache:   NewLRUCache(tuning.BlockCacheSize),
+		handles: make(map[string]*ColumnFamilyHandle),
+
+		seriesTuning: make(map[string]*nekolib.SeriesTuning),
+	}
+	if err := d.loadSeriesTuning(); err != nil {
+		d.cache.Destroy()
+		return nil, err
+	}
+
+	opts := d.cfOptions("default")
+	if tuning.MaxOpenFiles != 0 {
+		opts.SetMaxOpenFiles(tuning.MaxOpenFiles)
+	}
+	if tuning.DbWriteBufferSize > 0 {
+		opts.SetDbWriteBufferSize(tuning.DbWriteBufferSize)
+	}
+	// every column family has to be opened along with the DB
+	names := []string{"default"}
+	if _, err := os.Stat(dbpath); err == nil {
+		if names, err = ListColumnFamilies(opts, dbpath); err != nil {
+			return nil, err
+		}
+	}
+	cfOpts := make([]*Options, len(names))
+	for i, name := range names {
+		cfOpts[i] = d.cfOptions(name)
+	}
+
+	db, handles, err := OpenDbColumnFamilies(opts, dbpath, names, cfOpts)
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		d.handles[name] = handles[i]
+	}
+	d.db = db
+	logger.Info("Opened shared DB %s with %d column families", dbpath, len(names))
+	return d, nil
+}
+
+func (d *sharedDB) cfOptions(name string) *Options {
+	var opts *Options
+	if strings.HasPrefix(name, CF_META_PREFIX) {
+		opts = metaOptions()
+		tuning.apply(opts, nil)
+	} else {
+		opts = dataOptions()
+		tuning.apply(opts, d.seriesTuning[strings.TrimPrefix(name, CF_DATA_PREFIX)])
+	}
+	opts.SetBlockCache(d.cache)
+	return opts
+}
+
+// columnFamily opens a column family, creating it if missing
+func (d *sharedDB) columnFamily(name string) (*RocksDB, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	h, found := d.handles[name]
+	if !found {
+		var err error
+		if h, err = d.db.CreateColumnFamily(d.cfOptions(name), name); err != nil {
+			return nil, err
+		}
+		d.handles[name] = h
+	}
+	return &RocksDB{db: d.db, cf: h, shared: d, name: name}, nil
+}
+
+func (d *sharedDB) hasColumnFamily(name string) bool {
+	d.m.Lock()
+	defer d.m.Unlock()
+	_, found := d.handles[name]
+	return found
+}
+
+func (d *sharedDB) dropColumnFamily(name string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	h, found := d.handles[name]
+	if !found {
+		return nil
+	}
+	if err := d.db.DropColumnFamily(h); err != nil {
+		return err
+	}
+	h.Destroy()
+	delete(d.handles, name)
+	return nil
+}
+
+// flushColumnFamily empties the memtable of a column family unless it was
+// dropped meanwhile. gorocksdb flushes the default column family only,
+// compacting one flushes its memtable first.
+func (d *sharedDB) flushColumnFamily(name string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if h, found := d.handles[name]; found {
+		d.db.CompactRangeCF(h, Range{})
+	}
+}
+
+func (d *sharedDB) close() {
+	for _, h := range d.handles {
+		h.Destroy()
+	}
+	d.db.Close()
+	d.cache.Destroy()
+}
+
+// openSeriesDBs returns column families of a series, series still stored
+// in directories of their own are moved into the shared DB first
+func openSeriesDBs(id string) (data, meta *RocksDB, err error) {
+	d, err := getShared()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := d.migrateLegacy(id); err != nil {
+		return nil, nil, err
+	}
+	if data, err = d.columnFamily(CF_DATA_PREFIX + id); err != nil {
+		return nil, nil, err
+	}
+	if meta, err = d.columnFamily(CF_META_PREFIX + id); err != nil {
+		return nil, nil, err
+	}
+	return data, meta, nil
+}
+
+// A series directory is removed only after it is copied, so an
+// interrupted migration is redone from scratch on the next open.
+func (d *sharedDB) migrateLegacy(id string) error {
+	dir := path.Join(DB_PATH, id)
+	if _, err := os.Stat(path.Join(dir, "data")); err != nil {
+		return nil
+	}
+	logger.Info("Moving series %s into the shared DB", id)
+
+	for _, name := range []string{CF_DATA_PREFIX + id, CF_META_PREFIX + id} {
+		if err := d.dropColumnFamily(name); err != nil {
+			return err
+		}
+	}
+	data, err := d.columnFamily(CF_DATA_PREFIX + id)
+	if err != nil {
+		return err
+	}
+	if err := importDB(path.Join(dir, "data"), data, dataOptions()); err != nil {
+		return err
+	}
+	meta, err := d.columnFamily(CF_META_PREFIX + id)
+	if err != nil {
+		return err
+	}
+	if err := importDB(path.Join(dir, "meta"), meta, metaOptions()); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// HasSeries tells whether this peer stores anything of series id
+func HasSeries(id string) bool {
+	if !inited {
+		return false
+	}
+	if _, err := os.Stat(path.Join(DB_PATH, id, "data")); err == nil {
+		return true
+	}
+	d, err := getShared()
+	if err != nil {
+		return false
+	}
+	return d.hasColumnFamily(CF_DATA_PREFIX + id)
+}
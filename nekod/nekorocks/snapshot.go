@@ -0,0 +1,140 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	. "github.com/tecbot/gorocksdb"
+)
+
+const SNAPSHOT_BATCH_SIZE = 4096
+
+var SeriesExists = errors.New("Series Exists")
+
+// Snapshot writes a consistent copy of the series into dir, which must
+// not exist yet. Operations are drained while the snapshots of data and
+// meta are taken, so that both DBs are copied as of the same instant.
+func (s *Series) Snapshot(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot %s exists", dir)
+	}
+
+	s.life.Lock()
+	if s.closed {
+		s.life.Unlock()
+		return SeriesClosed
+	}
+	dsnap, msnap := s.data.NewSnapshot(), s.meta.NewSnapshot()
+	s.life.Unlock()
+	defer s.data.ReleaseSnapshot(dsnap)
+	defer s.meta.ReleaseSnapshot(msnap)
+
+	if err := os.MkdirAll(dir, os.ModeDir|os.FileMode(0700)); err != nil {
+		return err
+	}
+	if err := exportDB(s.data.NewSnapshotIterator(dsnap),
+		path.Join(dir, "data"), dataOptions()); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := exportDB(s.meta.NewSnapshotIterator(msnap),
+		path.Join(dir, "meta"), metaOptions()); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	logger.Info("Series %s: snapshot written to %s", s.Id, dir)
+	return nil
+}
+
+// RestoreSeries copies a snapshot taken by Snapshot back as series id and
+// opens it, the series must not exist
+func RestoreSeries(dir, id string) (*Series, error) {
+	if !inited {
+		return nil, NotInited
+	}
+	for _, db := range []string{"data", "meta"} {
+		if _, err := os.Stat(path.Join(dir, db)); err != nil {
+			return nil, err
+		}
+	}
+	if HasSeries(id) {
+		return nil, SeriesExists
+	}
+
+	data, meta, err := openSeriesDBs(id)
+	if err == nil {
+		err = importDB(path.Join(dir, "data"), data, dataOptions())
+	}
+	if err == nil {
+		err = importDB(path.Join(dir, "meta"), meta, metaOptions())
+	}
+	if err != nil {
+		DestroySeries(id)
+		return nil, err
+	}
+	logger.Info("Series %s: restored from %s", id, dir)
+	return GetSeries(id)
+}
+
+// importDB copies a standalone DB at src into dst
+func importDB(src string, dst *RocksDB, opts *Options) error {
+	db, err := NewRocksDB(src, opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return copyDB(db.NewIterator(), dst)
+}
+
+// exportDB writes everything iter yields into a new standalone DB at dst
+func exportDB(iter *Iterator, dst string, opts *Options) error {
+	db, err := NewRocksDB(dst, opts)
+	if err != nil {
+		iter.Close()
+		return err
+	}
+	defer db.Close()
+	return copyDB(iter, db)
+}
+
+func copyDB(iter *Iterator, db *RocksDB) error {
+	defer iter.Close()
+
+	batch := db.NewBatch()
+	defer func() { batch.Destroy() }()
+	n := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		batch.Put(append([]byte{}, iter.Key().Data()...),
+			append([]byte{}, iter.Value().Data()...))
+		if n++; n%SNAPSHOT_BATCH_SIZE == 0 {
+			if err := db.Write(batch); err != nil {
+				return err
+			}
+			batch.Destroy()
+			batch = db.NewBatch()
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return db.Write(batch)
+}
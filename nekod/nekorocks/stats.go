@@ -0,0 +1,372 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/vmihailenco/msgpack"
+)
+
+// Frag block entry of the reverse hash map, with summary statistics of
+// the raw points in the block. Min, Max and Sum are kept for numeric
+// series only. Timestamps are unix nanoseconds.
+type blockInfo struct {
+	TsStart int64   `msgpack:"start_ns"`
+	TsEnd   int64   `msgpack:"end_ns"`
+	Count   int64   `msgpack:"count"`
+	Min     float64 `msgpack:"min"`
+	Max     float64 `msgpack:"max"`
+	Sum     float64 `msgpack:"sum"`
+	First   int64   `msgpack:"first_ns"`
+	Last    int64   `msgpack:"last_ns"`
+}
+
+func (b *blockInfo) add(ns int64, value float64, numeric bool) {
+	if numeric {
+		if b.Count == 0 || value < b.Min {
+			b.Min = value
+		}
+		if b.Count == 0 || value > b.Max {
+			b.Max = value
+		}
+		b.Sum += value
+	}
+	if b.Count == 0 || ns < b.First {
+		b.First = ns
+	}
+	if b.Count == 0 || ns > b.Last {
+		b.Last = ns
+	}
+	b.Count++
+}
+
+// remove takes out a value overwritten in place, its timestamp stays in
+// the block. Returns false if Min or Max may have been that value.
+func (b *blockInfo) remove(value float64, numeric bool) bool {
+	b.Count--
+	if !numeric {
+		return true
+	}
+	b.Sum -= value
+	return b.Count == 0 || (value > b.Min && value < b.Max)
+}
+
+func (b *blockInfo) reset() {
+	b.Count, b.Min, b.Max, b.Sum = 0, 0, 0, 0
+	b.First, b.Last = 0, 0
+}
+
+func (b *blockInfo) hasBounds() bool {
+	return b.TsEnd > b.TsStart
+}
+
+// Summary of raw points of several blocks
+type Summary struct {
+	nekolib.RollupValue
+	First time.Time
+	Last  time.Time
+}
+
+func (m *Summary) merge(b *blockInfo) {
+	if b.Count == 0 {
+		return
+	}
+	first, last := time.Unix(0, b.First).UTC(), time.Unix(0, b.Last).UTC()
+	if m.Count == 0 || first.Before(m.First) {
+		m.First = first
+	}
+	if m.Count == 0 || last.After(m.Last) {
+		m.Last = last
+	}
+	m.RollupValue.Merge(&nekolib.RollupValue{b.Count, b.Min, b.Max, b.Sum})
+}
+
+func blockInfoKey(h uint32) []byte {
+	key := bytes.NewBuffer(make([]byte, 0, SERIES_META_PREFIX_LEN+4))
+	key.Write([]byte(PREFIX_SERIES_KEY_MAP))
+	binary.Write(key, binary.BigEndian, h)
+	return key.Bytes()
+}
+
+// blocks are hashed the same way nekos places them on the ring
+func (s *Series) blockHash(lower int64) uint32 {
+	return nekolib.Hash32(nekolib.TimeSec2Bytes(lower))
+}
+
+func (s *Series) getBlockInfo(key []byte) (*blockInfo, error) {
+	info := new(blockInfo)
+	slice, err := s.meta.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer slice.Free()
+	if slice.Size() > 0 {
+		if err := msgpack.Unmarshal(slice.Data(), info); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (s *Series) putBlockInfo(key []byte, info *blockInfo, durability uint8) error {
+	value, err := msgpack.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.meta.PutWith(key, value, durability)
+}
+
+func (s *Series) ReverseHash(h uint32, ts_start, ts_end []byte) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	key := blockInfoKey(h)
+	info, err := s.getBlockInfo(key)
+	if err != nil {
+		return err
+	}
+	if info.TsStart, err = wireNano(ts_start); err != nil {
+		return err
+	}
+	if info.TsEnd, err = wireNano(ts_end); err != nil {
+		return err
+	}
+	return s.putBlockInfo(key, info, nekolib.DURABILITY_WAL)
+}
+
+// updateBlockStats folds newly inserted raw records into stats of their
+// blocks and takes out the values they replaced, a block is recomputed
+// from data only if its Min or Max was replaced
+func (s *Series) updateBlockStats(records, replaced []*nekolib.NekodRecord, durability uint8) error {
+	type change struct {
+		added, removed []*nekolib.NekodRecord
+	}
+	blocks := make(map[int64]*change)
+	blockOf := func(r *nekolib.NekodRecord) (*change, error) {
+		ns, err := wireNano(r.Ts)
+		if err != nil {
+			return nil, err
+		}
+		lower, _ := nekolib.TsBoundary(nanoSec(ns), s.FragLevel)
+		c, found := blocks[lower]
+		if !found {
+			c = new(change)
+			blocks[lower] = c
+		}
+		return c, nil
+	}
+	for _, r := range records {
+		c, err := blockOf(r)
+		if err != nil {
+			return err
+		}
+		c.added = append(c.added, r)
+	}
+	for _, r := range replaced {
+		c, err := blockOf(r)
+		if err != nil {
+			return err
+		}
+		c.removed = append(c.removed, r)
+	}
+
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	numeric := s.hasRollups()
+	for lower, c := range blocks {
+		key := blockInfoKey(s.blockHash(lower))
+		info, err := s.getBlockInfo(key)
+		if err != nil {
+			return err
+		}
+		s.fillBounds(info, lower)
+		for _, r := range c.added {
+			ns, _ := wireNano(r.Ts)
+			v, _ := nekolib.NumericValue(s.ValueType, r.Value)
+			info.add(ns, v, numeric)
+		}
+		exact := true
+		for _, r := range c.removed {
+			v, _ := nekolib.NumericValue(s.ValueType, r.Value)
+			exact = info.remove(v, numeric) && exact
+		}
+		if !exact {
+			if err := s.rebuildBlockInfo(lower, durability); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.putBlockInfo(key, info, durability); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Series) fillBounds(info *blockInfo, lower int64) {
+	if info.hasBounds() {
+		return
+	}
+	info.TsStart, info.TsEnd = s.blockBounds(secNano(lower))
+}
+
+// rebuildBlockInfo recomputes stats of the block starting at lower from
+// the raw layer, callers hold s.rm
+func (s *Series) rebuildBlockInfo(lower int64, durability uint8) error {
+	key := blockInfoKey(s.blockHash(lower))
+	info, err := s.getBlockInfo(key)
+	if err != nil {
+		return err
+	}
+	s.fillBounds(info, lower)
+	info.reset()
+
+	start, upper := s.blockBounds(secNano(lower))
+	numeric := s.hasRollups()
+	s.rangeOp(wireTs(start), wireTs(upper-1), nekolib.PRIORITY_RAW, func(ts, value []byte) {
+		ns, _ := wireNano(ts)
+		v, _ := nekolib.NumericValue(s.ValueType, value)
+		info.add(ns, v, numeric)
+	})
+	return s.putBlockInfo(key, info, durability)
+}
+
+// rebuildBlockStats recomputes stats of every block overlapping [start, end]
+// after points were deleted, entries of emptied blocks are removed
+func (s *Series) rebuildBlockStats(start, end time.Time) error {
+	s.rm.Lock()
+	defer s.rm.Unlock()
+
+	lower, _ := nekolib.TsBoundary(nanoSec(start.UnixNano()), s.FragLevel)
+	endSec := nanoSec(end.UnixNano())
+	blocks := []int64{}
+	s.forEachBlockInfo(func(key []byte, info *blockInfo) {
+		if !info.hasBounds() {
+			return
+		}
+		l := nanoSec(info.TsStart)
+		if l >= lower && l <= endSec {
+			blocks = append(blocks, l)
+		}
+	})
+	for _, l := range blocks {
+		if err := s.rebuildBlockInfo(l, nekolib.DURABILITY_WAL); err != nil {
+			return err
+		}
+		key := blockInfoKey(s.blockHash(l))
+		info, err := s.getBlockInfo(key)
+		if err != nil {
+			return err
+		}
+		if info.Count == 0 {
+			if err := s.meta.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Series) forEachBlockInfo(op func(key []byte, info *blockInfo)) {
+	prefix := []byte(PREFIX_SERIES_KEY_MAP)
+	iter := s.meta.NewIterator()
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key().Data()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		info := new(blockInfo)
+		if err := msgpack.Unmarshal(iter.Value().Data(), info); err != nil {
+			continue
+		}
+		op(append([]byte{}, key...), info)
+	}
+}
+
+// Blocks lists frag blocks recorded by ReverseHash
+func (s *Series) Blocks() ([]nekolib.FragBlock, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	blocks := []nekolib.FragBlock{}
+	s.forEachBlockInfo(func(key []byte, info *blockInfo) {
+		if !info.hasBounds() {
+			return
+		}
+		h := binary.BigEndian.Uint32(key[len(PREFIX_SERIES_KEY_MAP):])
+		blocks = append(blocks, nekolib.FragBlock{h, info.TsStart, info.TsEnd, info.Count})
+	})
+	return blocks, nil
+}
+
+// DropBlock removes raw points of a frag block together with its reverse
+// hash entry and returns the number of removed points
+func (s *Series) DropBlock(h uint32) (int, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	info, err := s.getBlockInfo(blockInfoKey(h))
+	s.release()
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	if info.hasBounds() {
+		dropped, err = s.DeleteRange(wireTs(info.TsStart), wireTs(info.TsEnd-1), nekolib.PRIORITY_RAW)
+		if err != nil {
+			return dropped, err
+		}
+	}
+
+	if err := s.acquire(); err != nil {
+		return dropped, err
+	}
+	defer s.release()
+	s.rm.Lock()
+	defer s.rm.Unlock()
+	return dropped, s.meta.Delete(blockInfoKey(h))
+}
+
+// Bounds returns timestamps of the first and the last raw point, read
+// from block stats
+func (s *Series) Bounds() (first, last time.Time, ok bool) {
+	if err := s.acquire(); err != nil {
+		return
+	}
+	defer s.release()
+
+	summary := new(Summary)
+	s.forEachBlockInfo(func(key []byte, info *blockInfo) {
+		summary.merge(info)
+	})
+	return summary.First, summary.Last, summary.Count > 0
+}
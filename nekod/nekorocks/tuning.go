@@ -0,0 +1,169 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekorocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	. "github.com/tecbot/gorocksdb"
+)
+
+// tuning overrides of series are kept next to the shared DB, since
+// options of every column family are needed before it is opened
+const SERIES_TUNING_FILE = "series_tuning.json"
+
+// Tuning of the shared DB. Block cache, open files and the memtable size
+// of all series together are shared, the rest can be overridden per
+// series.
+type Tuning struct {
+	BlockCacheSize    int
+	WriteBufferSize   int
+	DbWriteBufferSize int
+	Compression       string
+	BloomBits         int
+	MaxOpenFiles      int
+}
+
+var compressionTypes = map[string]CompressionType{
+	"none":   NoCompression,
+	"snappy": SnappyCompression,
+	"zlib":   ZLibCompression,
+	"bz2":    Bz2Compression,
+	"lz4":    LZ4Compression,
+	"lz4hc":  LZ4HCCompression,
+}
+
+var tuning = DefaultTuning()
+
+func DefaultTuning() Tuning {
+	return Tuning{
+		BlockCacheSize:    BLOCK_CACHE_SIZE,
+		WriteBufferSize:   4 << 20,
+		DbWriteBufferSize: 128 << 20,
+		Compression:       "snappy",
+		BloomBits:         10,
+		MaxOpenFiles:      1000,
+	}
+}
+
+// SetTuning replaces the tuning of the shared DB, it takes effect when
+// the shared DB is opened next
+func SetTuning(t Tuning) error {
+	if _, found := compressionTypes[t.Compression]; !found {
+		return fmt.Errorf("Unknown Compression Type: %s", t.Compression)
+	}
+	tuning = t
+	return nil
+}
+
+func checkSeriesTuning(t *nekolib.SeriesTuning) error {
+	if t == nil || t.BlockCompression == "" {
+		return nil
+	}
+	if _, found := compressionTypes[t.BlockCompression]; !found {
+		return fmt.Errorf("Unknown Compression Type: %s", t.BlockCompression)
+	}
+	return nil
+}
+
+// apply sets column family options of a series, o may be nil
+func (t Tuning) apply(opts *Options, o *nekolib.SeriesTuning) {
+	writeBufferSize, compression, bloomBits := t.WriteBufferSize, t.Compression, t.BloomBits
+	if o != nil {
+		if o.WriteBufferSize > 0 {
+			writeBufferSize = o.WriteBufferSize
+		}
+		if o.BlockCompression != "" {
+			compression = o.BlockCompression
+		}
+		if o.BloomBits > 0 {
+			bloomBits = o.BloomBits
+		}
+	}
+	if writeBufferSize > 0 {
+		opts.SetWriteBufferSize(writeBufferSize)
+	}
+	if c, found := compressionTypes[compression]; found {
+		opts.SetCompression(c)
+	}
+	if bloomBits > 0 {
+		opts.SetFilterPolicy(NewBloomFilter(bloomBits))
+	}
+}
+
+func (d *sharedDB) loadSeriesTuning() error {
+	b, err := ioutil.ReadFile(path.Join(d.dbpath, SERIES_TUNING_FILE))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &d.seriesTuning)
+}
+
+// tuneSeries records overrides of series id, nil drops them
+func (d *sharedDB) tuneSeries(id string, t *nekolib.SeriesTuning) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	old, found := d.seriesTuning[id]
+	if t == nil && !found || t != nil && found && *t == *old {
+		return nil
+	}
+	if t == nil {
+		delete(d.seriesTuning, id)
+	} else {
+		tc := *t
+		d.seriesTuning[id] = &tc
+	}
+
+	b, _ := json.Marshal(d.seriesTuning)
+	tmp := path.Join(d.dbpath, SERIES_TUNING_FILE+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(d.dbpath, SERIES_TUNING_FILE)); err != nil {
+		return err
+	}
+	if _, open := d.handles[CF_DATA_PREFIX+id]; open && t != nil {
+		logger.Info("Series %s: new tuning applies once nekod restarts", id)
+	}
+	return nil
+}
+
+// TuneSeries records storage tuning of series id. Column families take it
+// when created, existing ones only when the shared DB is opened again,
+// that is once nekod restarts.
+func TuneSeries(id string, t *nekolib.SeriesTuning) error {
+	if !inited {
+		return NotInited
+	}
+	if err := checkSeriesTuning(t); err != nil {
+		return err
+	}
+	d, err := getShared()
+	if err != nil {
+		return err
+	}
+	return d.tuneSeries(id, t)
+}
@@ -0,0 +1,600 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/coreos/go-etcd/etcd"
+	zmq "github.com/pebbe/zmq4"
+)
+
+var (
+	UnknownSyncPhase = errors.New("Unknown Sync Phase")
+	BlockMoving      = errors.New("Block Moving")
+)
+
+const (
+	// points of a single SYNC_BLOCK message at most
+	SYNC_BLOCK_POINTS = nekolib.MAX_INSERT_POINTS
+	// receivers give up senders silent for this long, senders give up
+	// receivers not replying
+	SYNC_TIMEOUT = 5 * time.Minute
+)
+
+// peerView follows virtual nodes registered in etcd, for the peer to
+// tell which frag blocks it still owns
+type peerView struct {
+	m     sync.Mutex
+	peers map[string]nekolib.NekodPeerInfo
+	// signalled when nodes join or leave the ring
+	changed chan bool
+}
+
+func newPeerView() *peerView {
+	return &peerView{
+		peers:   make(map[string]nekolib.NekodPeerInfo),
+		changed: make(chan bool, 1),
+	}
+}
+
+func (v *peerView) apply(action string, node *etcd.Node) {
+	vname := node.Key[len(nekolib.ETCD_PEER_DIR)+1:]
+
+	v.m.Lock()
+	defer v.m.Unlock()
+	old, found := v.peers[vname]
+	switch action {
+	case "expire", "delete":
+		if !found {
+			return
+		}
+		delete(v.peers, vname)
+	default:
+		var vnode nekolib.NekodPeerInfo
+		if err := json.Unmarshal([]byte(node.Value), &vnode); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		v.peers[vname] = vnode
+		// states change on their own, the ring does not
+		if found && old.RealName == vnode.RealName &&
+			old.Hostname == vnode.Hostname && old.Port == vnode.Port {
+			return
+		}
+	}
+	select {
+	case v.changed <- true:
+	default:
+	}
+}
+
+func (v *peerView) ring() *nekolib.PeerRing {
+	v.m.Lock()
+	defer v.m.Unlock()
+	peers := make([]nekolib.NekodPeerInfo, 0, len(v.peers))
+	for _, p := range v.peers {
+		peers = append(peers, p)
+	}
+	return nekolib.NewPeerRing(peers)
+}
+
+// watchPeers keeps the view of the ring and rebalances once it settles
+// after a change
+func (s *nekoBackendServer) watchPeers() error {
+	r, err := s.ec.Get(nekolib.ETCD_PEER_DIR, true, true)
+	if err != nil {
+		logger.Error(err.Error())
+		return err
+	}
+	for _, vn := range r.Node.Nodes {
+		s.view.apply("get", vn)
+	}
+
+	updates := make(chan *etcd.Response)
+	go s.ec.Watch(nekolib.ETCD_PEER_DIR, 0, true, updates, nil)
+	go func() {
+		for update := range updates {
+			s.view.apply(update.Action, update.Node)
+		}
+	}()
+
+	delay := time.Duration(s.cfg.RebalanceDelay) * time.Second
+	s.awaitHandover(delay)
+
+	go func() {
+		for {
+			<-s.view.changed
+			// peers join with all their virtual nodes at once
+			time.Sleep(delay)
+			select {
+			case <-s.view.changed:
+			default:
+			}
+			s.rebalance()
+		}
+	}()
+	return nil
+}
+
+// awaitHandover advertises STATE_SYNCING after startup, previous owners
+// start handing blocks over once the ring settles and this peer may miss
+// some of its blocks until then
+func (s *nekoBackendServer) awaitHandover(delay time.Duration) {
+	s.beginSync(s.cfg.Name)
+	time.AfterFunc(2*delay, func() { s.endSync(s.cfg.Name) })
+}
+
+// movingBlocks are frag blocks being handed to their new owners, writes
+// to them are rejected so that none is lost when they are dropped
+type movingBlocks struct {
+	m      sync.Mutex
+	blocks map[movingBlock]bool
+}
+
+type movingBlock struct {
+	id   string
+	hash uint32
+}
+
+func newMovingBlocks() *movingBlocks {
+	return &movingBlocks{blocks: make(map[movingBlock]bool)}
+}
+
+func (b *movingBlocks) mark(id string, h uint32) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.blocks[movingBlock{id, h}] = true
+}
+
+func (b *movingBlocks) unmark(id string, h uint32) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	delete(b.blocks, movingBlock{id, h})
+}
+
+func (b *movingBlocks) has(id string, h uint32) bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.blocks[movingBlock{id, h}]
+}
+
+// syncTarget is a connection to a new owner of blocks, bracketed with
+// SYNC_BEGIN and SYNC_END
+type syncTarget struct {
+	name string
+	sock *zmq.Socket
+	err  error
+}
+
+func (t *syncTarget) request(msg ...[]byte) error {
+	if t.err != nil {
+		return t.err
+	}
+	for i, frame := range msg {
+		flag := zmq.SNDMORE
+		if i == len(msg)-1 {
+			flag = 0
+		}
+		if _, t.err = t.sock.SendBytes(frame, flag); t.err != nil {
+			return t.err
+		}
+	}
+	var reply []byte
+	if reply, t.err = t.sock.RecvBytes(0); t.err != nil {
+		return t.err
+	}
+	if uint8(reply[0]) != nekolib.REP_OK {
+		t.err = fmt.Errorf("peer %s: %s", t.name, string(reply[1:]))
+	}
+	return t.err
+}
+
+func (s *nekoBackendServer) syncMsg(phase uint8) []byte {
+	hdr := &nekolib.ReqSyncHdr{Source: s.cfg.Name, Phase: phase}
+	return append([]byte{byte(nekolib.OP_SYNC)}, hdr.ToBytes()...)
+}
+
+// rebalance hands frag blocks this peer no longer owns on the ring to
+// their owners and drops them once every owner has them. Until then
+// they are still read from here.
+func (s *nekoBackendServer) rebalance() {
+	ring := s.view.ring()
+	targets := make(map[string]*syncTarget)
+	defer func() {
+		for _, t := range targets {
+			if t.err == nil {
+				if err := t.request(s.syncMsg(nekolib.SYNC_END)); err != nil {
+					logger.Error(err.Error())
+				}
+			}
+			t.sock.Close()
+		}
+	}()
+
+	target := func(p nekolib.NekodPeerInfo) *syncTarget {
+		if t, found := targets[p.RealName]; found {
+			return t
+		}
+		t := &syncTarget{name: p.RealName}
+		t.sock, t.err = zmq.NewSocket(zmq.REQ)
+		if t.err != nil {
+			// nothing to close
+			return t
+		}
+		targets[p.RealName] = t
+		t.sock.SetLinger(0)
+		t.sock.SetSndtimeo(SYNC_TIMEOUT)
+		t.sock.SetRcvtimeo(SYNC_TIMEOUT)
+		if t.err = t.sock.Connect(fmt.Sprintf("tcp://%s:%d", p.Hostname, p.Port)); t.err == nil {
+			t.request(s.syncMsg(nekolib.SYNC_BEGIN))
+		}
+		return t
+	}
+
+	// every real peer owns some key, unless it is not on the ring yet
+	onRing := false
+	for _, p := range ring.Owners(0, ring.Len()) {
+		onRing = onRing || p.RealName == s.cfg.Name
+	}
+	if !onRing {
+		return
+	}
+
+	for _, sInfo := range s.seriesColl.knownInfos() {
+		if !s.engine.HasSeries(sInfo.Id) {
+			continue
+		}
+		moved, err := s.rebalanceSeries(ring, sInfo, target)
+		if err != nil {
+			logger.Error("series %s: %s", sInfo.Name, err.Error())
+		}
+		if moved > 0 {
+			logger.Info("series %s: %d blocks handed to their new owners", sInfo.Name, moved)
+		}
+	}
+}
+
+func (s *nekoBackendServer) rebalanceSeries(ring *nekolib.PeerRing, sInfo *nekolib.NekoSeriesInfo,
+	target func(nekolib.NekodPeerInfo) *syncTarget) (int, error) {
+
+	series, err := s.GetSeries(sInfo.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReleaseSeries(series)
+	blocks, err := series.Blocks()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	var lastErr error
+	for _, b := range blocks {
+		n := sInfo.ReplicaCount()
+		if ring.Owns(s.cfg.Name, b.Hash, n) {
+			continue
+		}
+		s.moving.mark(sInfo.Id, b.Hash)
+		err := s.handBlock(series, sInfo, b, ring.Owners(b.Hash, n), target)
+		s.moving.unmark(sInfo.Id, b.Hash)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		moved++
+	}
+	return moved, lastErr
+}
+
+// Points of a priority layer of a frag block
+type blockLayer struct {
+	priority uint8
+	records  []*nekolib.NekodRecord
+}
+
+// readBlock reads every layer of a frag block, raw points first so that
+// new owners skip rollup partials they computed from them
+func readBlock(series SeriesStore, sInfo *nekolib.NekoSeriesInfo, b nekolib.FragBlock) []blockLayer {
+	priorities := []uint8{nekolib.PRIORITY_RAW}
+	if nekolib.IsNumericValue(sInfo.ValueType) {
+		priorities = append(priorities, nekolib.RollupLayers...)
+	}
+	start := nekolib.Time2Bytes(time.Unix(0, b.Start).UTC())
+	last := nekolib.Time2Bytes(time.Unix(0, b.End-1).UTC())
+	layers := []blockLayer{}
+	for _, p := range priorities {
+		l := blockLayer{p, []*nekolib.NekodRecord{}}
+		series.RangeOp(start, last, p, func(key, value []byte) {
+			l.records = append(l.records, &nekolib.NekodRecord{
+				append([]byte{}, key...), append([]byte{}, value...)})
+		})
+		if len(l.records) > 0 {
+			layers = append(layers, l)
+		}
+	}
+	return layers
+}
+
+func sameRecords(a, b []*nekolib.NekodRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Ts, b[i].Ts) || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameLayers(a, b []blockLayer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].priority != b[i].priority || !sameRecords(a[i].records, b[i].records) {
+			return false
+		}
+	}
+	return true
+}
+
+// handBlock copies every layer of a frag block to its owners and drops it
+// once all of them acknowledged. Points written while copying are not
+// dropped, the block is kept and handed over next time.
+func (s *nekoBackendServer) handBlock(series SeriesStore, sInfo *nekolib.NekoSeriesInfo, b nekolib.FragBlock,
+	owners []nekolib.NekodPeerInfo, target func(nekolib.NekodPeerInfo) *syncTarget) error {
+
+	copied := readBlock(series, sInfo, b)
+	start := nekolib.Time2Bytes(time.Unix(0, b.Start).UTC())
+	end := nekolib.Time2Bytes(time.Unix(0, b.End).UTC())
+
+	// the header carries the block range, empty blocks are handed over
+	// with it alone
+	layers := copied
+	if len(layers) == 0 {
+		layers = []blockLayer{{nekolib.PRIORITY_RAW, []*nekolib.NekodRecord{}}}
+	}
+	for _, p := range owners {
+		t := target(p)
+		for _, l := range layers {
+			for i, j := 0, 0; ; i = j {
+				j = i + SYNC_BLOCK_POINTS
+				if j > len(l.records) {
+					j = len(l.records)
+				}
+				// versions of a timestamp go together, in their order
+				for j > i && j < len(l.records) && l.records[j].Key() == l.records[j-1].Key() {
+					j++
+				}
+				hdr := &nekolib.ReqInsertBlockHdr{
+					SeriesName: sInfo.Name,
+					HashValue:  b.Hash,
+					StartTs:    start,
+					EndTs:      end,
+					Priority:   l.priority,
+					Count:      uint16(j - i),
+					Durability: nekolib.DURABILITY_SYNC,
+				}
+				buf := new(bytes.Buffer)
+				for _, r := range l.records[i:j] {
+					buf.Write(r.ToBytes())
+				}
+				if err := t.request(append(s.syncMsg(nekolib.SYNC_BLOCK), hdr.ToBytes()...), buf.Bytes()); err != nil {
+					return err
+				}
+				if j == len(l.records) {
+					break
+				}
+			}
+		}
+	}
+
+	if !sameLayers(readBlock(series, sInfo, b), copied) {
+		return fmt.Errorf("block %d written while handed over, kept", b.Hash)
+	}
+	_, err := series.DropBlock(b.Hash)
+	return err
+}
+
+// syncBlock stores points of a block handed over by its previous owner.
+// They were written before points stored here at the same timestamps,
+// which were written since this peer owns the block. Both are written
+// again in that order under the duplicate policy of the series, copies
+// of points this peer has already are not. Rollup partials are derived
+// from raw points, those stored here are kept.
+func (s *nekoBackendServer) syncBlock(hdr *nekolib.ReqInsertBlockHdr, records []*nekolib.NekodRecord) (int, error) {
+	series, err := s.GetSeries(hdr.SeriesName)
+	if err != nil {
+		return 0, err
+	}
+	defer s.ReleaseSeries(series)
+	if err := series.ReverseHash(hdr.HashValue, hdr.StartTs, hdr.EndTs); err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+
+	stored := make(map[int64][][]byte)
+	series.RangeOp(records[0].Ts, records[len(records)-1].Ts, hdr.Priority, func(key, value []byte) {
+		k := (&nekolib.NekodRecord{Ts: key}).Key()
+		stored[k] = append(stored[k], append([]byte{}, value...))
+	})
+	handed := make(map[int64][]*nekolib.NekodRecord)
+	fresh := make([]*nekolib.NekodRecord, 0, len(records))
+	for _, r := range records {
+		if _, found := stored[r.Key()]; found {
+			handed[r.Key()] = append(handed[r.Key()], r)
+		} else {
+			fresh = append(fresh, r)
+		}
+	}
+	if nekolib.IsRollupLayer(hdr.Priority) {
+		if len(fresh) == 0 {
+			return 0, nil
+		}
+		return len(fresh), series.PutRollups(fresh, hdr.Priority, hdr.Durability)
+	}
+
+	policy := series.Info().DuplicatePolicy
+	for k, versions := range handed {
+		merged := resolveDuplicates(versions, stored[k], policy)
+		if sameValues(merged, stored[k]) {
+			continue
+		}
+		ts := versions[0].Ts
+		if _, err := series.DeleteRange(ts, ts, hdr.Priority); err != nil {
+			return 0, err
+		}
+		for _, v := range merged {
+			fresh = append(fresh, &nekolib.NekodRecord{Ts: ts, Value: v})
+		}
+	}
+	if len(fresh) == 0 {
+		return 0, nil
+	}
+	if _, err := series.InsertBatch(fresh, hdr.Priority, hdr.Durability); err != nil {
+		return 0, err
+	}
+	return len(fresh), nil
+}
+
+// resolveDuplicates returns the values to keep at a timestamp of handed
+// versions written before stored ones. Stored copies of handed versions
+// are the same writes and appear once.
+func resolveDuplicates(handed []*nekolib.NekodRecord, stored [][]byte, policy uint8) [][]byte {
+	values := make([][]byte, 0, len(handed)+len(stored))
+	for _, r := range handed {
+		values = append(values, r.Value)
+	}
+	copies := make([]bool, len(stored))
+	for _, r := range handed {
+		for i, v := range stored {
+			if !copies[i] && bytes.Equal(v, r.Value) {
+				copies[i] = true
+				break
+			}
+		}
+	}
+	for i, v := range stored {
+		if !copies[i] {
+			values = append(values, v)
+		}
+	}
+
+	switch policy {
+	case nekolib.DUP_KEEP_ALL:
+		return values
+	case nekolib.DUP_LAST_WINS:
+		return values[len(values)-1:]
+	}
+	// the first write is kept, later ones were rejected
+	return values[:1]
+}
+
+func sameValues(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// syncSources are peers handing blocks to this one, it advertises
+// STATE_SYNCING while there are any
+type syncSources struct {
+	m      sync.Mutex
+	active map[string]time.Time
+}
+
+func newSyncSources() *syncSources {
+	return &syncSources{active: make(map[string]time.Time)}
+}
+
+// readyState is the state of a peer done with its initialization
+func (s *nekoBackendServer) readyState() int {
+	s.syncs.m.Lock()
+	defer s.syncs.m.Unlock()
+	if len(s.syncs.active) > 0 {
+		return nekolib.STATE_SYNCING
+	}
+	return nekolib.STATE_READY
+}
+
+func (s *nekoBackendServer) beginSync(source string) {
+	s.syncs.m.Lock()
+	first := len(s.syncs.active) == 0
+	s.syncs.active[source] = time.Now()
+	s.syncs.m.Unlock()
+	if first {
+		logger.Info("syncing blocks from %s", source)
+		s.setState(nekolib.STATE_SYNCING)
+	}
+}
+
+func (s *nekoBackendServer) touchSync(source string) {
+	s.syncs.m.Lock()
+	defer s.syncs.m.Unlock()
+	if _, found := s.syncs.active[source]; found {
+		s.syncs.active[source] = time.Now()
+	}
+}
+
+// endSync forgets a source, or every source silent since before
+// SYNC_TIMEOUT if source is empty
+func (s *nekoBackendServer) endSync(source string) {
+	s.syncs.m.Lock()
+	if source != "" {
+		delete(s.syncs.active, source)
+	}
+	for src, t := range s.syncs.active {
+		if time.Since(t) > SYNC_TIMEOUT {
+			logger.Error("peer %s: sync timed out", src)
+			delete(s.syncs.active, src)
+		}
+	}
+	done := len(s.syncs.active) == 0
+	s.syncs.m.Unlock()
+	if done && atomic.LoadUint32(&s.state) == uint32(nekolib.STATE_SYNCING) {
+		logger.Info("caught up with previous owners")
+		s.setState(nekolib.STATE_READY)
+	}
+}
+
+func (s *nekoBackendServer) handleSyncTimeouts() {
+	go func() {
+		t := time.Tick(SYNC_TIMEOUT / 4)
+		for {
+			<-t
+			s.endSync("")
+		}
+	}()
+}
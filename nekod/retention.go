@@ -0,0 +1,74 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// Retention policies are read from etcd on every run, so that changes
+// take effect without restarting nekod.
+func (s *nekoBackendServer) enforceRetention() {
+	r, err := s.ec.Get(nekolib.ETCD_SERIES_DIR, true, true)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+
+	for _, sNode := range r.Node.Nodes {
+		var sInfo nekolib.NekoSeriesInfo
+		if err := json.Unmarshal([]byte(sNode.Value), &sInfo); err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		if sInfo.Retention <= 0 {
+			continue
+		}
+		series, err := s.GetSeries(sInfo.Name)
+		if err != nil {
+			continue
+		}
+
+		before := time.Now().Add(-time.Duration(sInfo.Retention) * time.Second)
+		n, err := series.Expire(before)
+		s.ReleaseSeries(series)
+		if err != nil {
+			logger.Error("series %s: %s", sInfo.Name, err.Error())
+			continue
+		}
+		if n > 0 {
+			logger.Info("series %s: dropped %d points before %v", sInfo.Name, n, before)
+		}
+	}
+}
+
+func (s *nekoBackendServer) handleRetention() {
+	if s.cfg.RetentionInterval <= 0 {
+		return
+	}
+	go func() {
+		t := time.Tick(time.Duration(s.cfg.RetentionInterval) * time.Second)
+		for {
+			s.enforceRetention()
+			<-t
+		}
+	}()
+}
@@ -0,0 +1,289 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+type cachedSeries struct {
+	store    SeriesStore
+	name     string
+	refs     int
+	lastUsed time.Time
+	elem     *list.Element
+}
+
+// A series being opened, callers asking for it meanwhile wait on done.
+// stale is set if the series is registered or dropped while opening.
+type openCall struct {
+	done  chan struct{}
+	err   error
+	stale bool
+}
+
+// seriesCache opens series on first access and closes the least recently
+// used ones beyond maxOpen, series in use are never closed. Series are
+// opened and closed outside the lock.
+type seriesCache struct {
+	m       sync.Mutex
+	engine  storageEngine
+	maxOpen int
+	// every series of the cluster, open or not
+	known   map[string]*nekolib.NekoSeriesInfo
+	open    map[string]*cachedSeries
+	opening map[string]*openCall
+	// front is the most recently used
+	lru *list.List
+	// looks up series this peer has not heard of, in etcd
+	lookup func(name string) (*nekolib.NekoSeriesInfo, error)
+}
+
+func newSeriesCache(engine storageEngine, maxOpen int) *seriesCache {
+	return &seriesCache{
+		engine:  engine,
+		maxOpen: maxOpen,
+		known:   make(map[string]*nekolib.NekoSeriesInfo),
+		open:    make(map[string]*cachedSeries),
+		opening: make(map[string]*openCall),
+		lru:     list.New(),
+	}
+}
+
+// register makes a series known, store is nil if it is not opened yet. A
+// series of the same name opened before is closed.
+func (c *seriesCache) register(sInfo *nekolib.NekoSeriesInfo, store SeriesStore) {
+	c.m.Lock()
+	c.known[sInfo.Name] = sInfo
+	if call, found := c.opening[sInfo.Name]; found {
+		call.stale = true
+	}
+	if store == nil {
+		c.m.Unlock()
+		return
+	}
+	closing := []SeriesStore{}
+	if cs, found := c.open[sInfo.Name]; found {
+		closing = append(closing, c.detach_unsafe(cs))
+	}
+	c.insert_unsafe(sInfo.Name, store)
+	closing = append(closing, c.evict_unsafe()...)
+	c.m.Unlock()
+	closeAll(closing)
+}
+
+// unregister forgets a series unless its name was taken by another one
+// since, and returns its store if it is open
+func (c *seriesCache) unregister(sInfo *nekolib.NekoSeriesInfo) SeriesStore {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if known, found := c.known[sInfo.Name]; found && known.Id != sInfo.Id {
+		return nil
+	}
+	delete(c.known, sInfo.Name)
+	if call, found := c.opening[sInfo.Name]; found {
+		call.stale = true
+	}
+	cs, found := c.open[sInfo.Name]
+	if !found {
+		return nil
+	}
+	return c.detach_unsafe(cs)
+}
+
+func (c *seriesCache) getInfo(name string) (*nekolib.NekoSeriesInfo, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	sInfo, found := c.known[name]
+	return sInfo, found
+}
+
+func (c *seriesCache) knownInfos() []*nekolib.NekoSeriesInfo {
+	c.m.Lock()
+	defer c.m.Unlock()
+	infos := make([]*nekolib.NekoSeriesInfo, 0, len(c.known))
+	for _, sInfo := range c.known {
+		infos = append(infos, sInfo)
+	}
+	return infos
+}
+
+// get returns a series, opening it if needed. Callers release it when
+// done so that it can be closed again. Only one caller opens a series,
+// the others wait for it.
+func (c *seriesCache) get(name string) (SeriesStore, error) {
+	for {
+		c.m.Lock()
+		if cs, found := c.open[name]; found {
+			cs.refs++
+			cs.lastUsed = time.Now()
+			c.lru.MoveToFront(cs.elem)
+			c.m.Unlock()
+			return cs.store, nil
+		}
+		if call, found := c.opening[name]; found {
+			c.m.Unlock()
+			<-call.done
+			if call.err != nil {
+				return nil, call.err
+			}
+			continue
+		}
+		call := &openCall{done: make(chan struct{})}
+		c.opening[name] = call
+		sInfo, found := c.known[name]
+		c.m.Unlock()
+
+		store, err := c.openSeries(name, sInfo, found)
+
+		c.m.Lock()
+		delete(c.opening, name)
+		if err != nil || call.stale {
+			c.m.Unlock()
+			call.err = err
+			close(call.done)
+			if err != nil {
+				return nil, err
+			}
+			// registered or dropped meanwhile, start over
+			closeAll([]SeriesStore{store})
+			continue
+		}
+		if _, known := c.known[name]; !known {
+			c.known[name] = store.Info()
+		}
+		cs := c.insert_unsafe(name, store)
+		cs.refs++
+		closing := c.evict_unsafe()
+		c.m.Unlock()
+		close(call.done)
+		closeAll(closing)
+		return store, nil
+	}
+}
+
+// openSeries opens a series, looking it up first if it is not known
+func (c *seriesCache) openSeries(name string, sInfo *nekolib.NekoSeriesInfo, found bool) (SeriesStore, error) {
+	if !found && c.lookup != nil {
+		if info, err := c.lookup(name); err == nil && info != nil {
+			sInfo, found = info, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("No Series %s", name)
+	}
+	store, err := c.engine.OpenSeries(sInfo)
+	if err != nil {
+		logger.Error(err.Error())
+		return nil, err
+	}
+	return store, nil
+}
+
+func (c *seriesCache) release(store SeriesStore) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if cs, found := c.open[store.Info().Name]; found && cs.store == store && cs.refs > 0 {
+		cs.refs--
+	}
+}
+
+func (c *seriesCache) insert_unsafe(name string, store SeriesStore) *cachedSeries {
+	cs := &cachedSeries{
+		store:    store,
+		name:     name,
+		lastUsed: time.Now(),
+	}
+	cs.elem = c.lru.PushFront(cs)
+	c.open[name] = cs
+	return cs
+}
+
+// detach_unsafe takes a series out of the cache, the caller closes it
+func (c *seriesCache) detach_unsafe(cs *cachedSeries) SeriesStore {
+	c.lru.Remove(cs.elem)
+	delete(c.open, cs.name)
+	return cs.store
+}
+
+// evict_unsafe detaches idle series from the back of the LRU until at
+// most maxOpen are open and returns them to be closed. Series of engines
+// without persistence stay open.
+func (c *seriesCache) evict_unsafe() []SeriesStore {
+	closing := []SeriesStore{}
+	if c.maxOpen <= 0 || !c.engine.Persistent() {
+		return closing
+	}
+	for e := c.lru.Back(); e != nil && len(c.open) > c.maxOpen; {
+		prev := e.Prev()
+		if cs := e.Value.(*cachedSeries); cs.refs == 0 {
+			closing = append(closing, c.detach_unsafe(cs))
+		}
+		e = prev
+	}
+	return closing
+}
+
+// closeIdle closes series not used for idle
+func (c *seriesCache) closeIdle(idle time.Duration) {
+	if !c.engine.Persistent() {
+		return
+	}
+	closing := []SeriesStore{}
+	c.m.Lock()
+	deadline := time.Now().Add(-idle)
+	for e := c.lru.Back(); e != nil; {
+		prev := e.Prev()
+		cs := e.Value.(*cachedSeries)
+		if cs.lastUsed.After(deadline) {
+			break
+		}
+		if cs.refs == 0 {
+			closing = append(closing, c.detach_unsafe(cs))
+		}
+		e = prev
+	}
+	c.m.Unlock()
+	closeAll(closing)
+}
+
+func closeAll(stores []SeriesStore) {
+	for _, store := range stores {
+		if err := store.Close(); err != nil {
+			logger.Error(err.Error())
+		}
+		logger.Debug("Closed series %s", store.Info().Name)
+	}
+}
+
+func (s *nekoBackendServer) handleIdleSeries() {
+	if s.cfg.SeriesIdleTimeout <= 0 {
+		return
+	}
+	idle := time.Duration(s.cfg.SeriesIdleTimeout) * time.Second
+	go func() {
+		for _ = range time.Tick(idle / 2) {
+			s.seriesColl.closeIdle(idle)
+		}
+	}()
+}
@@ -20,31 +20,32 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
 	"path"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bigeagle/nekodb/nekod/nekorocks"
 	"github.com/bigeagle/nekodb/nekolib"
 	"github.com/coreos/go-etcd/etcd"
 	zmq "github.com/pebbe/zmq4"
 )
 
 type nekoBackendServer struct {
-	m          sync.RWMutex
 	cfg        *Config
 	ec         *etcd.Client
 	state      uint32
-	seriesColl map[string]*nekorocks.Series
+	engine     storageEngine
+	seriesColl *seriesCache
+	hints      *hintStore
+	view       *peerView
+	syncs      *syncSources
+	moving     *movingBlocks
 }
 
 func startNekoBackendServer(cfg *Config) error {
 	srv = new(nekoBackendServer)
 	srv.cfg = cfg
 	srv.ec = nil
-	srv.seriesColl = make(map[string]*nekorocks.Series)
 	if err := srv.init(); err != nil {
 		return err
 	}
@@ -65,13 +66,37 @@ func (s *nekoBackendServer) setState(state int) {
 
 func (s *nekoBackendServer) init() error {
 	s.setState(nekolib.STATE_INIT)
-	nekorocks.InitNekoRocks(s.cfg.DataPath, logger)
+	engine, err := newStorageEngine(s.cfg)
+	if err != nil {
+		return err
+	}
+	s.engine = engine
+	s.seriesColl = newSeriesCache(engine, s.cfg.MaxOpenSeries)
+	s.seriesColl.lookup = s.lookupSeries
+	if s.hints, err = newHintStore(s.cfg.DataPath, s.cfg.HintsMaxSize); err != nil {
+		return err
+	}
+	s.view = newPeerView()
+	s.syncs = newSyncSources()
+	s.moving = newMovingBlocks()
 	if err := s.handleEtcd(); err != nil {
 		return err
 	}
 	if err := s.initSeries(); err != nil {
 		return err
 	}
+	if err := s.watchDropped(); err != nil {
+		return err
+	}
+	s.handleRetention()
+	s.handleIdleSeries()
+	s.handleHintExpiry()
+	s.handleSyncTimeouts()
+	if s.cfg.RebalanceDelay > 0 {
+		if err := s.watchPeers(); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -91,7 +116,7 @@ func (s *nekoBackendServer) serveForever() {
 
 	go func() {
 		time.Sleep(500 * time.Millisecond)
-		s.setState(nekolib.STATE_READY)
+		s.setState(s.readyState())
 	}()
 
 	err := zmq.Proxy(clients, workers, nil)
@@ -109,35 +134,8 @@ func (s *nekoBackendServer) initSeries() error {
 			var sInfo nekolib.NekoSeriesInfo
 
 			if err = json.Unmarshal([]byte(sNode.Value), &sInfo); err == nil {
-				var series *nekorocks.Series
-				dbpath := path.Join(s.cfg.DataPath, sInfo.Id)
-
-				if stat, err := os.Stat(dbpath); os.IsNotExist(err) {
-					// If DBPath not inited, re-initialize series
-					series, err = nekorocks.NewSeries(sInfo.Name, sInfo.Id, sInfo.FragLevel)
-					if err != nil {
-						logger.Error(err.Error())
-						return err
-					}
-				} else if stat.IsDir() {
-					// If DBPath presented, init from series files
-					if sInfo.Id != "" {
-						series, err = nekorocks.GetSeries(sInfo.Id)
-						if err != nil {
-							logger.Error(err.Error())
-							return err
-						}
-						c, _ := series.Count()
-						logger.Debug("element count: %d", c)
-					}
-				} else {
-					return fmt.Errorf("Invalid DB Directory: %s", dbpath)
-				}
-
-				s.m.Lock()
-				s.seriesColl[sInfo.Name] = series
-				s.m.Unlock()
-
+				// series are opened on first access
+				s.seriesColl.register(&sInfo, nil)
 			} else {
 				logger.Error(err.Error())
 				return err
@@ -147,22 +145,156 @@ func (s *nekoBackendServer) initSeries() error {
 	return nil
 }
 
-func (s *nekoBackendServer) NewSeries(name, id string, frag_level int) error {
-	series, err := nekorocks.NewSeries(name, id, frag_level)
+func (s *nekoBackendServer) NewSeries(sInfo *nekolib.NekoSeriesInfo) error {
+	if known, found := s.seriesColl.getInfo(sInfo.Name); found && known.Id == sInfo.Id {
+		// created before, as nekos broadcasts new series
+		s.seriesColl.register(sInfo, nil)
+		return nil
+	}
+	series, err := s.engine.NewSeries(sInfo)
 	if err != nil {
 		logger.Error(err.Error())
 		return err
 	}
+	s.seriesColl.register(sInfo, series)
+	return nil
+}
 
-	s.m.Lock()
-	defer s.m.Unlock()
-	s.seriesColl[name] = series
+// lookupSeries reads info of a series this peer has not heard of
+func (s *nekoBackendServer) lookupSeries(name string) (*nekolib.NekoSeriesInfo, error) {
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_SERIES_DIR, name)
+	r, err := s.ec.Get(key, false, false)
+	if err != nil {
+		return nil, err
+	}
+	sInfo := new(nekolib.NekoSeriesInfo)
+	if err := json.Unmarshal([]byte(r.Node.Value), sInfo); err != nil {
+		return nil, err
+	}
+	return sInfo, nil
+}
+
+// GetSeries opens a series on demand, callers ReleaseSeries it when done
+func (s *nekoBackendServer) GetSeries(name string) (SeriesStore, error) {
+	return s.seriesColl.get(name)
+}
+
+func (s *nekoBackendServer) ReleaseSeries(series SeriesStore) {
+	s.seriesColl.release(series)
+}
+
+// DropSeries closes a series and removes its files, it is a no-op for
+// series already dropped
+func (s *nekoBackendServer) DropSeries(sInfo *nekolib.NekoSeriesInfo) error {
+	series := s.seriesColl.unregister(sInfo)
+	if series != nil {
+		return series.Destroy()
+	}
+	// not opened, remove what may be left on disk
+	return s.engine.DestroySeries(sInfo.Id)
+}
+
+func (s *nekoBackendServer) snapshotDir(tag, name string) (string, error) {
+	for _, p := range []string{tag, name} {
+		if p == "" || p == "." || p == ".." || path.Base(p) != p {
+			return "", fmt.Errorf("Invalid Snapshot Path: %s/%s", tag, name)
+		}
+	}
+	return path.Join(s.cfg.SnapshotPath, tag, name), nil
+}
+
+// SnapshotSeries writes the local part of a series together with its info
+// into the snapshot named by tag
+func (s *nekoBackendServer) SnapshotSeries(tag string, sInfo *nekolib.NekoSeriesInfo) error {
+	series, err := s.GetSeries(sInfo.Name)
+	if err != nil {
+		return err
+	}
+	defer s.ReleaseSeries(series)
+	dir, err := s.snapshotDir(tag, sInfo.Name)
+	if err != nil {
+		return err
+	}
+	if err := series.Snapshot(dir); err != nil {
+		return err
+	}
+	sjson, _ := json.Marshal(sInfo)
+	return ioutil.WriteFile(path.Join(dir, "series.json"), sjson, 0600)
+}
+
+// RestoreSeries brings a series back from the snapshot named by tag and
+// opens it, the series must not exist on this peer
+func (s *nekoBackendServer) RestoreSeries(tag, name string) (*nekolib.NekoSeriesInfo, error) {
+	dir, err := s.snapshotDir(tag, name)
+	if err != nil {
+		return nil, err
+	}
+	sjson, err := ioutil.ReadFile(path.Join(dir, "series.json"))
+	if err != nil {
+		return nil, err
+	}
+	sInfo := new(nekolib.NekoSeriesInfo)
+	if err := json.Unmarshal(sjson, sInfo); err != nil {
+		return nil, err
+	}
+
+	if _, found := s.seriesColl.getInfo(sInfo.Name); found {
+		return nil, fmt.Errorf("Series %s exists", sInfo.Name)
+	}
+	series, err := s.engine.RestoreSeries(dir, sInfo)
+	if err != nil {
+		return nil, err
+	}
+	s.seriesColl.register(sInfo, series)
+	return sInfo, nil
+}
+
+// watchDropped drops series of tombstones, those written while this peer
+// was down first, then new ones as they come. nekos removes a tombstone
+// only after every peer on the ring and every departed one acked the
+// drop, and never reuses its id before, so local data under a tombstoned
+// id is always stale.
+func (s *nekoBackendServer) watchDropped() error {
+	r, err := s.ec.Get(nekolib.ETCD_DROPPED_DIR, false, true)
+	if err != nil {
+		e, ok := err.(*etcd.EtcdError)
+		if !ok || e.ErrorCode != nekolib.ETCD_KEY_NOT_FOUND {
+			logger.Error(err.Error())
+			return err
+		}
+	}
+	var waitIndex uint64
+	if r != nil {
+		for _, node := range r.Node.Nodes {
+			s.dropTombstoned(node)
+		}
+		waitIndex = r.EtcdIndex + 1
+	}
+
+	updates := make(chan *etcd.Response)
+	go s.ec.Watch(nekolib.ETCD_DROPPED_DIR, waitIndex, true, updates, nil)
+	go func() {
+		for update := range updates {
+			switch update.Action {
+			case "set", "create", "update":
+				s.dropTombstoned(update.Node)
+			}
+		}
+	}()
 	return nil
 }
 
-func (s *nekoBackendServer) GetSeries(name string) (*nekorocks.Series, bool) {
-	s.m.RLock()
-	defer s.m.RUnlock()
-	series, found := s.seriesColl[name]
-	return series, found
+func (s *nekoBackendServer) dropTombstoned(node *etcd.Node) {
+	var sInfo nekolib.NekoSeriesInfo
+	if err := json.Unmarshal([]byte(node.Value), &sInfo); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if !s.engine.HasSeries(sInfo.Id) {
+		return
+	}
+	logger.Info("Dropping series %s (%s)", sInfo.Name, sInfo.Id)
+	if err := s.DropSeries(&sInfo); err != nil {
+		logger.Error(err.Error())
+	}
 }
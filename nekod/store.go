@@ -0,0 +1,106 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+// Storage engines selectable by Config.Engine, rocksdb is left out of
+// builds tagged norocksdb, which need neither cgo for it nor RocksDB
+const (
+	ENGINE_ROCKSDB = "rocksdb"
+	ENGINE_MEMORY  = "memory"
+)
+
+// SeriesStore keeps the part of a series owned by this peer
+type SeriesStore interface {
+	Info() *nekolib.NekoSeriesInfo
+	Insert(key, value []byte, priority uint8) error
+	// durability is one of nekolib.DURABILITY_*, returns the number of
+	// points hitting a timestamp already stored
+	InsertBatch(records []*nekolib.NekodRecord, priority uint8, durability uint8) (int, error)
+	// PutRollups stores partial rollup values handed over with their frag
+	// block as they are
+	PutRollups(records []*nekolib.NekodRecord, priority uint8, durability uint8) error
+	RangeOp(start, end []byte, priority uint8, op func(key, value []byte))
+	// Last returns up to n raw points not after before, newest first
+	Last(before []byte, n int) ([]*nekolib.NekodRecord, error)
+	Count() (int, error)
+	Recount() (int, error)
+	ReverseHash(h uint32, ts_start, ts_end []byte) error
+	// Blocks lists frag blocks recorded by ReverseHash
+	Blocks() ([]nekolib.FragBlock, error)
+	// DropBlock removes raw points of a frag block and its reverse hash
+	// entry, once handed to its new owner
+	DropBlock(h uint32) (int, error)
+	DeleteRange(start, end []byte, priority uint8) (int, error)
+	Expire(before time.Time) (int, error)
+	Bounds() (first, last time.Time, ok bool)
+	Snapshot(dir string) error
+	// Close releases the series and keeps its data
+	Close() error
+	Destroy() error
+}
+
+type storageEngine interface {
+	// OpenSeries opens the store of a known series, creating it if this
+	// peer has none yet
+	OpenSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error)
+	NewSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error)
+	// HasSeries tells whether this peer keeps data of series id
+	HasSeries(id string) bool
+	// DestroySeries removes what is left of a series not opened
+	DestroySeries(id string) error
+	RestoreSeries(dir string, sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error)
+	// series of engines without persistence are never closed
+	Persistent() bool
+}
+
+// engine compiled into nekod
+type engineFactory struct {
+	// defaults fills engine specific defaults of cfg, may be nil
+	defaults func(cfg *Config)
+	open     func(cfg *Config) (storageEngine, error)
+}
+
+var storageEngines = make(map[string]engineFactory)
+
+// registerEngine is called by init of the file implementing an engine
+func registerEngine(name string, f engineFactory) {
+	storageEngines[name] = f
+}
+
+func engineDefaults(cfg *Config) {
+	for _, f := range storageEngines {
+		if f.defaults != nil {
+			f.defaults(cfg)
+		}
+	}
+}
+
+func newStorageEngine(cfg *Config) (storageEngine, error) {
+	f, found := storageEngines[cfg.Engine]
+	if !found {
+		return nil, fmt.Errorf("Unknown Storage Engine: %s", cfg.Engine)
+	}
+	return f.open(cfg)
+}
@@ -0,0 +1,66 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"github.com/bigeagle/nekodb/nekod/nekomem"
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+func init() {
+	registerEngine(ENGINE_MEMORY, engineFactory{
+		open: func(cfg *Config) (storageEngine, error) {
+			return new(memEngine), nil
+		},
+	})
+}
+
+// memEngine keeps series as long as the process runs, they are recreated
+// empty after a restart
+type memEngine struct{}
+
+func (e *memEngine) OpenSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	if nekomem.HasSeries(sInfo.Id) {
+		return nekomem.GetSeries(sInfo.Id)
+	}
+	return e.NewSeries(sInfo)
+}
+
+func (e *memEngine) NewSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	return nekomem.NewSeries(sInfo), nil
+}
+
+func (e *memEngine) Persistent() bool {
+	return false
+}
+
+func (e *memEngine) HasSeries(id string) bool {
+	return nekomem.HasSeries(id)
+}
+
+func (e *memEngine) DestroySeries(id string) error {
+	return nekomem.DestroySeries(id)
+}
+
+func (e *memEngine) RestoreSeries(dir string, sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	series, err := nekomem.RestoreSeries(dir, sInfo)
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
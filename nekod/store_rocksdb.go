@@ -0,0 +1,113 @@
+//go:build !norocksdb
+// +build !norocksdb
+
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/bigeagle/nekodb/nekod/nekorocks"
+	"github.com/bigeagle/nekodb/nekolib"
+)
+
+func init() {
+	registerEngine(ENGINE_ROCKSDB, engineFactory{
+		defaults: func(cfg *Config) {
+			tuning := nekorocks.DefaultTuning()
+			cfg.BlockCacheSize = tuning.BlockCacheSize
+			cfg.WriteBufferSize = tuning.WriteBufferSize
+			cfg.DbWriteBufferSize = tuning.DbWriteBufferSize
+			cfg.Compression = tuning.Compression
+			cfg.BloomBits = tuning.BloomBits
+			cfg.MaxOpenFiles = tuning.MaxOpenFiles
+		},
+		open: newRocksEngine,
+	})
+}
+
+func newRocksEngine(cfg *Config) (storageEngine, error) {
+	nekorocks.InitNekoRocks(cfg.DataPath, logger)
+	err := nekorocks.SetTuning(nekorocks.Tuning{
+		BlockCacheSize:    cfg.BlockCacheSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		DbWriteBufferSize: cfg.DbWriteBufferSize,
+		Compression:       cfg.Compression,
+		BloomBits:         cfg.BloomBits,
+		MaxOpenFiles:      cfg.MaxOpenFiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return new(rocksEngine), nil
+}
+
+type rocksEngine struct{}
+
+func (e *rocksEngine) OpenSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	if sInfo.Id == "" {
+		return nil, fmt.Errorf("Invalid Series Id of %s", sInfo.Name)
+	}
+	if !nekorocks.HasSeries(sInfo.Id) {
+		// If series not inited, re-initialize series
+		return e.NewSeries(sInfo)
+	}
+	// If series presented, init from stored data
+	if err := nekorocks.TuneSeries(sInfo.Id, sInfo.Tuning); err != nil {
+		return nil, err
+	}
+	series, err := nekorocks.GetSeries(sInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+	c, _ := series.Count()
+	logger.Debug("element count: %d", c)
+	return series, nil
+}
+
+func (e *rocksEngine) NewSeries(sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	series, err := nekorocks.NewSeries(sInfo)
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
+
+func (e *rocksEngine) Persistent() bool {
+	return true
+}
+
+func (e *rocksEngine) HasSeries(id string) bool {
+	return nekorocks.HasSeries(id)
+}
+
+func (e *rocksEngine) DestroySeries(id string) error {
+	return nekorocks.DestroySeries(id)
+}
+
+func (e *rocksEngine) RestoreSeries(dir string, sInfo *nekolib.NekoSeriesInfo) (SeriesStore, error) {
+	if err := nekorocks.TuneSeries(sInfo.Id, sInfo.Tuning); err != nil {
+		return nil, err
+	}
+	series, err := nekorocks.RestoreSeries(dir, sInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+	return series, nil
+}
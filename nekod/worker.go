@@ -20,7 +20,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
-	"fmt"
+	"strings"
 	"time"
 
 	"github.com/bigeagle/nekodb/nekolib"
@@ -36,11 +36,20 @@ type nekodWorker struct {
 }
 
 var ReqHandlerMap = map[uint8](func(*nekodWorker, []byte) error){
-	nekolib.OP_NEW_SERIES:   ReqNewSeries,
-	nekolib.OP_PING:         ReqPing,
-	nekolib.OP_INSERT_BATCH: ReqInsertBatch,
-	nekolib.OP_FIND_RANGE:   ReqGetRange,
-	nekolib.OP_SERIES_INFO:  ReqSeriesMeta,
+	nekolib.OP_NEW_SERIES:    ReqNewSeries,
+	nekolib.OP_PING:          ReqPing,
+	nekolib.OP_INSERT_BATCH:  ReqInsertBatch,
+	nekolib.OP_FIND_RANGE:    ReqGetRange,
+	nekolib.OP_DELETE:        ReqDeleteRange,
+	nekolib.OP_DELETE_SERIES: ReqDropSeries,
+	nekolib.OP_SERIES_INFO:   ReqSeriesMeta,
+	nekolib.OP_RECOUNT:       ReqRecount,
+	nekolib.OP_SNAPSHOT:      ReqSnapshot,
+	nekolib.OP_RESTORE:       ReqRestore,
+	nekolib.OP_FIND_LAST:     ReqFindLast,
+	nekolib.OP_FETCH_HINTS:   ReqFetchHints,
+	nekolib.OP_DROP_HINTS:    ReqDropHints,
+	nekolib.OP_SYNC:          ReqSync,
 }
 
 func (w *nekodWorker) serveForever() {
@@ -74,7 +83,7 @@ func ReqNewSeries(w *nekodWorker, packBytes []byte) error {
 	// logger.Debug("%v", packBytes[1:])
 	logger.Debug("worker %d: %v", w.id, sInfo)
 
-	err := w.srv.NewSeries(sInfo.Name, sInfo.Id, sInfo.FragLevel)
+	err := w.srv.NewSeries(sInfo)
 	if err != nil {
 		w.sock.Send("ERROR", 0)
 		return err
@@ -87,18 +96,23 @@ func ReqSeriesMeta(w *nekodWorker, packBytes []byte) error {
 	reqHdr := new(nekolib.ReqSeriesMetaHdr)
 	reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:]))
 
-	series, found := w.srv.GetSeries(reqHdr.SeriesName)
-	if !found {
-		err := fmt.Errorf("No Series %s", reqHdr.SeriesName)
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
 		w.sock.SendBytes(
 			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
 		return err
 	}
+	defer w.srv.ReleaseSeries(series)
 
 	count, _ := series.Count()
 	sm := nekolib.NekodSeriesInfo{
-		Name:  w.srv.cfg.Name,
-		Count: count,
+		Name:   w.srv.cfg.Name,
+		Count:  count,
+		Blocks: blockCounts(series),
+	}
+	if first, last, ok := series.Bounds(); ok {
+		sm.First = first.Format(nekolib.ISO8601)
+		sm.Last = last.Format(nekolib.ISO8601)
 	}
 	j, _ := json.Marshal(sm)
 	buf := bytes.NewBuffer(make([]byte, 0, 16))
@@ -109,6 +123,52 @@ func ReqSeriesMeta(w *nekodWorker, packBytes []byte) error {
 	return nil
 }
 
+func ReqRecount(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqSeriesMetaHdr)
+	reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:]))
+
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		return err
+	}
+	defer w.srv.ReleaseSeries(series)
+
+	count, err := series.Recount()
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Info("series %s recounted: %d", reqHdr.SeriesName, count)
+
+	sm := nekolib.NekodSeriesInfo{
+		Name:   w.srv.cfg.Name,
+		Count:  count,
+		Blocks: blockCounts(series),
+	}
+	j, _ := json.Marshal(sm)
+	w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_OK, j), 0)
+	return nil
+}
+
+// blockCounts maps frag blocks of a series to their raw points, so that
+// nekos counts each block once whatever the number of its replicas
+func blockCounts(series SeriesStore) map[uint32]int64 {
+	counts := make(map[uint32]int64)
+	blocks, err := series.Blocks()
+	if err != nil {
+		logger.Error(err.Error())
+		return counts
+	}
+	for _, b := range blocks {
+		counts[b.Hash] = b.Count
+	}
+	return counts
+}
+
 func ReqInsertBatch(w *nekodWorker, packBytes []byte) error {
 	var reqHdr nekolib.ReqInsertBlockHdr
 
@@ -121,9 +181,35 @@ func ReqInsertBatch(w *nekodWorker, packBytes []byte) error {
 		return err
 	}
 
-	series, _ := w.srv.GetSeries(reqHdr.SeriesName)
-	series.ReverseHash(reqHdr.HashValue, reqHdr.StartTs, reqHdr.EndTs)
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		return err
+	}
+	defer w.srv.ReleaseSeries(series)
+	// the block goes to its new owner, which takes the write
+	if w.srv.moving.has(series.Info().Id, reqHdr.HashValue) {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, BlockMoving.Error()), 0)
+		return BlockMoving
+	}
+	if err := series.ReverseHash(reqHdr.HashValue, reqHdr.StartTs, reqHdr.EndTs); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
 
+	// hints are handed to their owner as written to this peer
+	var hintHdr []byte
+	if reqHdr.HintFor != "" {
+		h := reqHdr
+		h.HintFor = ""
+		hintHdr = h.ToBytes()
+	}
+
+	ii := nekolib.NekodInsertInfo{Name: w.srv.cfg.Name}
 	for more, _ := w.sock.GetRcvmore(); more; more, _ = w.sock.GetRcvmore() {
 		msg, err := w.sock.RecvBytes(0)
 		if err != nil {
@@ -141,16 +227,34 @@ func ReqInsertBatch(w *nekodWorker, packBytes []byte) error {
 			records = append(records, r)
 		}
 
-		err = series.InsertBatch(records, reqHdr.Priority)
+		dups, err := series.InsertBatch(records, reqHdr.Priority, reqHdr.Durability)
 		if err != nil {
 			w.sock.SendBytes(
 				nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
 			logger.Error(err.Error())
 			return err
 		}
+		if hintHdr != nil {
+			for _, owner := range strings.Split(reqHdr.HintFor, ",") {
+				err := w.srv.hints.Add(owner, hintHdr, msg)
+				if err == HintsFull {
+					// the owner gets the block back by rebalancing
+					logger.Error("hints for %s: %s", owner, err.Error())
+					continue
+				}
+				if err != nil {
+					w.sock.SendBytes(
+						nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+					logger.Error(err.Error())
+					return err
+				}
+			}
+		}
+		ii.Count += len(records)
+		ii.Duplicates += dups
 	}
-	w.sock.SendBytes(
-		nekolib.MakeResponse(nekolib.REP_OK, "Success"), 0)
+	j, _ := json.Marshal(ii)
+	w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_OK, j), 0)
 	return nil
 }
 
@@ -166,10 +270,27 @@ func ReqGetRange(w *nekodWorker, packBytes []byte) error {
 		return err
 	}
 
-	series, _ := w.srv.GetSeries(reqHdr.SeriesName)
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		return err
+	}
+	defer w.srv.ReleaseSeries(series)
+
+	// values of multi-field series keep the asked fields only
+	var fields []string
+	sInfo, found := w.srv.seriesColl.getInfo(reqHdr.SeriesName)
+	if found {
+		if fields, err = sInfo.ParseFieldNames(reqHdr.Fields); err != nil {
+			w.sock.SendBytes(
+				nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+			return err
+		}
+	}
 	start, _ := nekolib.Bytes2Time(reqHdr.StartTs)
 	end, _ := nekolib.Bytes2Time(reqHdr.EndTs)
-	logger.Debug("Start Querying Series: %s from %v to %v", series.Name, start, end)
+	logger.Debug("Start Querying Series: %s from %v to %v", reqHdr.SeriesName, start, end)
 
 	bench_start := time.Now()
 	w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_ACK, "starting"), zmq.SNDMORE)
@@ -177,6 +298,11 @@ func ReqGetRange(w *nekodWorker, packBytes []byte) error {
 	buf = bytes.NewBuffer(make([]byte, 0, 256))
 	count := 0
 	series.RangeOp(reqHdr.StartTs, reqHdr.EndTs, reqHdr.Priority, func(key, value []byte) {
+		if len(fields) > 0 {
+			if v, err := sInfo.ProjectFields(value, fields); err == nil {
+				value = v
+			}
+		}
 		r := &nekolib.NekodRecord{key, value}
 		buf.Write(r.ToBytes())
 		if buf.Len() > 1024 {
@@ -205,8 +331,263 @@ func ReqGetRange(w *nekodWorker, packBytes []byte) error {
 	return nil
 }
 
+func ReqDeleteRange(w *nekodWorker, packBytes []byte) error {
+	var reqHdr nekolib.ReqDeleteRangeHdr
+
+	buf := bytes.NewBuffer(packBytes[1:])
+	err := (&reqHdr).FromBytes(buf)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		return err
+	}
+	defer w.srv.ReleaseSeries(series)
+
+	before := blockCounts(series)
+	count, err := series.DeleteRange(reqHdr.StartTs, reqHdr.EndTs, reqHdr.Priority)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	// points deleted of each frag block, replicas deleted copies too
+	after := blockCounts(series)
+	deleted := make(map[uint32]int64)
+	for h, c := range before {
+		if c > after[h] {
+			deleted[h] = c - after[h]
+		}
+	}
+
+	response := map[string]interface{}{
+		"peer":   w.srv.cfg.Name,
+		"count":  count,
+		"blocks": deleted,
+	}
+	rtext, _ := json.Marshal(response)
+	w.sock.SendBytes(
+		nekolib.MakeResponse(nekolib.REP_OK, rtext), 0)
+	return nil
+}
+
+func ReqDropSeries(w *nekodWorker, packBytes []byte) error {
+	sInfo := new(nekolib.NekoSeriesInfo)
+	if err := sInfo.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Info("worker %d: dropping series %s (%s)", w.id, sInfo.Name, sInfo.Id)
+
+	if err := w.srv.DropSeries(sInfo); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	w.sock.SendBytes(
+		nekolib.MakeResponse(nekolib.REP_OK, "Success"), 0)
+	return nil
+}
+
+func ReqSnapshot(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqSnapshotHdr)
+	sInfo := new(nekolib.NekoSeriesInfo)
+	buf := bytes.NewBuffer(packBytes[1:])
+	err := reqHdr.FromBytes(buf)
+	if err == nil {
+		err = sInfo.FromBytes(buf)
+	}
+	if err == nil {
+		logger.Info("worker %d: snapshot %s of series %s", w.id, reqHdr.Tag, sInfo.Name)
+		err = w.srv.SnapshotSeries(reqHdr.Tag, sInfo)
+	}
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	w.sock.SendBytes(
+		nekolib.MakeResponse(nekolib.REP_OK, "Success"), 0)
+	return nil
+}
+
+func ReqRestore(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqSnapshotHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	logger.Info("worker %d: restoring series %s from %s", w.id, reqHdr.SeriesName, reqHdr.Tag)
+
+	sInfo, err := w.srv.RestoreSeries(reqHdr.Tag, reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	sjson, _ := json.Marshal(sInfo)
+	w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_OK, sjson), 0)
+	return nil
+}
+
 func ReqPing(w *nekodWorker, packBytes []byte) error {
 	buf := []byte{byte(nekolib.OP_PONG)}
 	w.sock.SendBytes(buf, 0)
 	return nil
 }
+
+// ReqFindLast replies with the newest points of this peer not after the
+// given time, newest first
+func ReqFindLast(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqFindLastHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+
+	series, err := w.srv.GetSeries(reqHdr.SeriesName)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		return err
+	}
+	defer w.srv.ReleaseSeries(series)
+
+	records, err := series.Last(reqHdr.BeforeTs, int(reqHdr.Count))
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 1024))
+	buf.WriteByte(byte(nekolib.REP_OK))
+	for _, r := range records {
+		buf.Write(r.ToBytes())
+	}
+	w.sock.SendBytes(buf.Bytes(), 0)
+	return nil
+}
+
+// ReqFetchHints replies REP_OK followed by the header and the records of
+// every write hinted for the owner, in separate frames. They are kept
+// until OP_DROP_HINTS.
+func ReqFetchHints(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqHintsHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+
+	hints, err := w.srv.hints.Take(reqHdr.Owner)
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	if len(hints) == 0 {
+		w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_OK, ""), 0)
+		return nil
+	}
+	logger.Info("handing %d hinted writes to %s", len(hints), reqHdr.Owner)
+
+	w.sock.SendBytes(nekolib.MakeResponse(nekolib.REP_OK, ""), zmq.SNDMORE)
+	for i, h := range hints {
+		w.sock.SendBytes(h.hdr, zmq.SNDMORE)
+		if i == len(hints)-1 {
+			w.sock.SendBytes(h.records, 0)
+		} else {
+			w.sock.SendBytes(h.records, zmq.SNDMORE)
+		}
+	}
+	return nil
+}
+
+// ReqDropHints removes hints handed to their owner, blocks this peer kept
+// only for that owner are dropped too
+func ReqDropHints(w *nekodWorker, packBytes []byte) error {
+	reqHdr := new(nekolib.ReqHintsHdr)
+	var hints []hint
+	err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:]))
+	if err == nil {
+		hints, err = w.srv.hints.Drop(reqHdr.Owner)
+	}
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	w.sock.SendBytes(
+		nekolib.MakeResponse(nekolib.REP_OK, "Success"), 0)
+	go w.srv.dropHandedOff(hints)
+	return nil
+}
+
+// ReqSync receives blocks handed over by their previous owner, see
+// nekoBackendServer.rebalance
+func ReqSync(w *nekodWorker, packBytes []byte) error {
+	buf := bytes.NewBuffer(packBytes[1:])
+	syncHdr := new(nekolib.ReqSyncHdr)
+	err := syncHdr.FromBytes(buf)
+
+	records := make([]*nekolib.NekodRecord, 0)
+	for more, _ := w.sock.GetRcvmore(); more; more, _ = w.sock.GetRcvmore() {
+		msg, rerr := w.sock.RecvBytes(0)
+		if rerr != nil {
+			err = rerr
+			break
+		}
+		for rbuf := bytes.NewBuffer(msg); rbuf.Len() > 0; {
+			r := new(nekolib.NekodRecord)
+			r.FromBytes(rbuf)
+			records = append(records, r)
+		}
+	}
+
+	if err == nil {
+		switch syncHdr.Phase {
+		case nekolib.SYNC_BEGIN:
+			w.srv.beginSync(syncHdr.Source)
+		case nekolib.SYNC_BLOCK:
+			w.srv.touchSync(syncHdr.Source)
+			var reqHdr nekolib.ReqInsertBlockHdr
+			if err = (&reqHdr).FromBytes(buf); err == nil {
+				_, err = w.srv.syncBlock(&reqHdr, records)
+			}
+		case nekolib.SYNC_END:
+			w.srv.endSync(syncHdr.Source)
+		default:
+			err = UnknownSyncPhase
+		}
+	}
+	if err != nil {
+		w.sock.SendBytes(
+			nekolib.MakeResponse(nekolib.REP_ERR, err.Error()), 0)
+		logger.Error(err.Error())
+		return err
+	}
+	w.sock.SendBytes(
+		nekolib.MakeResponse(nekolib.REP_OK, "Success"), 0)
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import "fmt"
+
+var consistencyNames = map[uint8]string{
+	CONSISTENCY_UNSET:  "",
+	CONSISTENCY_ONE:    "one",
+	CONSISTENCY_QUORUM: "quorum",
+	CONSISTENCY_ALL:    "all",
+}
+
+func ConsistencyName(c uint8) string {
+	if name, ok := consistencyNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", c)
+}
+
+// ParseConsistency accepts one, quorum and all, an empty name leaves the
+// consistency unset
+func ParseConsistency(name string) (uint8, error) {
+	for c, n := range consistencyNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return CONSISTENCY_UNSET, fmt.Errorf("Unknown consistency: %s", name)
+}
+
+// WriteConsistency resolves the consistency of a write from that of the
+// request and the default of the series
+func WriteConsistency(req uint8, sinfo *NekoSeriesInfo) uint8 {
+	if req != CONSISTENCY_UNSET {
+		return req
+	}
+	if sinfo.Consistency != CONSISTENCY_UNSET {
+		return sinfo.Consistency
+	}
+	return CONSISTENCY_ALL
+}
+
+// RequiredAcks is the number of replicas out of n which must acknowledge
+// a write of the given consistency
+func RequiredAcks(consistency uint8, n int) int {
+	switch consistency {
+	case CONSISTENCY_ONE:
+		return 1
+	case CONSISTENCY_QUORUM:
+		return n/2 + 1
+	}
+	return n
+}
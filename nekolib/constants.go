@@ -22,9 +22,16 @@ const (
 	ETCD_PEER_DIR         = ETCD_DIR + "/peers"
 	ETCD_COLLECTION_DIR   = ETCD_DIR + "/collections"
 	ETCD_SERIES_DIR       = ETCD_DIR + "/series"
+	ETCD_DROPPED_DIR      = ETCD_DIR + "/dropped"  // tombstones of dropped series, by id
+	ETCD_DEPARTED_DIR     = ETCD_DIR + "/departed" // virtual nodes away, hinted writes wait for them
 	ETCD_REFRESH_INTERVAL = 64
+	ETCD_KEY_NOT_FOUND    = 100 // etcd error code of missing keys
+	ETCD_TEST_FAILED      = 101 // etcd error code of failed compare and swaps
 
 	SLICE_FRAG_LEVEL_DEFAULT = 14
+	MAX_INSERT_POINTS        = 4096 // points of a single OP_INSERT
+	MAX_LAST_POINTS          = 4096 // points of a single OP_FIND_LAST
+	TS_LEN                   = 15   // bytes of a timestamp on the wire
 	ISO8601                  = "2006-01-02T15:04:05.999Z0700"
 )
 
@@ -46,6 +53,76 @@ const (
 	REP_OK
 	REP_ACK
 	REP_ERR
+
+	// new operations are appended to keep existing opcodes stable
+	OP_RECOUNT
+	OP_SNAPSHOT
+	OP_RESTORE
+	OP_FIND_LAST
+	OP_FETCH_HINTS
+	OP_DROP_HINTS
+	OP_SYNC
+)
+
+// Value types of a series, the zero value keeps values as opaque text
+// which is how series created before typed values behave.
+const (
+	VALUE_STRING uint8 = iota
+	VALUE_FLOAT64
+	VALUE_INT64
+	VALUE_BOOL
+	VALUE_BYTES
+	// several named fields, see SeriesField
+	VALUE_FIELDS
+)
+
+// Storage modes of a series
+const (
+	COMPRESS_NONE uint8 = iota
+	COMPRESS_GORILLA
+)
+
+// Durability of writes. DURABILITY_UNSET in a request falls back to the
+// default of the series, which falls back to DURABILITY_WAL.
+const (
+	DURABILITY_UNSET uint8 = iota
+	// best effort, lost if nekod crashes before a flush
+	DURABILITY_NO_WAL
+	// written to the WAL without fsync, lost if the host crashes
+	DURABILITY_WAL
+	// fsynced before the reply
+	DURABILITY_SYNC
+)
+
+// Policies for points written at a timestamp already stored
+const (
+	DUP_LAST_WINS uint8 = iota
+	DUP_FIRST_WINS
+	// the whole write fails with DuplicateTimestamps
+	DUP_REJECT
+	// every version is kept, later ones under a sequence suffix
+	DUP_KEEP_ALL
+)
+
+// Replicas acknowledging a write before it succeeds. CONSISTENCY_UNSET
+// in a request falls back to the default of the series, which falls back
+// to CONSISTENCY_ALL.
+const (
+	CONSISTENCY_UNSET uint8 = iota
+	CONSISTENCY_ONE
+	// a majority of the replicas
+	CONSISTENCY_QUORUM
+	CONSISTENCY_ALL
+)
+
+// Priority layers of the storage key, rollup layers keep min/max/sum/count
+// per 1m/1h/1d bucket of the raw layer and are taken from the top of the
+// priority range
+const (
+	PRIORITY_RAW       uint8 = 0
+	PRIORITY_ROLLUP_1M uint8 = 0xF0 + iota
+	PRIORITY_ROLLUP_1H
+	PRIORITY_ROLLUP_1D
 )
 
 const (
@@ -55,6 +132,14 @@ const (
 	STATE_SYNCING
 )
 
+// Phases of OP_SYNC, a peer handing blocks it no longer owns to their
+// new owner brackets them with SYNC_BEGIN and SYNC_END
+const (
+	SYNC_BEGIN uint8 = iota
+	SYNC_BLOCK
+	SYNC_END
+)
+
 const (
 	PEER_FLG_KEEP int = iota
 	PEER_FLG_UPDATE
@@ -0,0 +1,53 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import (
+	"errors"
+	"fmt"
+)
+
+var DuplicateTimestamps = errors.New("Duplicate Timestamps Rejected")
+
+var duplicatePolicyNames = map[uint8]string{
+	DUP_LAST_WINS:  "last",
+	DUP_FIRST_WINS: "first",
+	DUP_REJECT:     "reject",
+	DUP_KEEP_ALL:   "keep",
+}
+
+func DuplicatePolicyName(p uint8) string {
+	if name, ok := duplicatePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", p)
+}
+
+// ParseDuplicatePolicy accepts last, first, reject and keep, empty means
+// last
+func ParseDuplicatePolicy(name string) (uint8, error) {
+	if name == "" {
+		return DUP_LAST_WINS, nil
+	}
+	for p, n := range duplicatePolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return DUP_LAST_WINS, fmt.Errorf("Unknown duplicate policy: %s", name)
+}
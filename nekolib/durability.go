@@ -0,0 +1,57 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import "fmt"
+
+var durabilityNames = map[uint8]string{
+	DURABILITY_UNSET:  "",
+	DURABILITY_NO_WAL: "nowal",
+	DURABILITY_WAL:    "wal",
+	DURABILITY_SYNC:   "sync",
+}
+
+func DurabilityName(d uint8) string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", d)
+}
+
+// ParseDurability accepts nowal, wal and sync, an empty name leaves the
+// durability unset
+func ParseDurability(name string) (uint8, error) {
+	for d, n := range durabilityNames {
+		if n == name {
+			return d, nil
+		}
+	}
+	return DURABILITY_UNSET, fmt.Errorf("Unknown durability: %s", name)
+}
+
+// WriteDurability resolves the durability of a write from that of the
+// request and the default of the series
+func WriteDurability(req uint8, sinfo *NekoSeriesInfo) uint8 {
+	if req != DURABILITY_UNSET {
+		return req
+	}
+	if sinfo.Durability != DURABILITY_UNSET {
+		return sinfo.Durability
+	}
+	return DURABILITY_WAL
+}
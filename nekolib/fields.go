@@ -0,0 +1,247 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Field of a multi-field series, values of all fields of a point are
+// stored together in one VALUE_FIELDS value
+type SeriesField struct {
+	Name      string `json:"name"`
+	ValueType uint8  `json:"value_type"`
+}
+
+var fieldNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-]*$`)
+
+// ParseFields parses a schema like "temperature:float64,humidity:float64",
+// the type defaults to float64
+func ParseFields(text string) ([]SeriesField, error) {
+	fields := []SeriesField{}
+	if strings.TrimSpace(text) == "" {
+		return fields, nil
+	}
+	for _, f := range strings.Split(text, ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), ":", 2)
+		field := SeriesField{Name: kv[0], ValueType: VALUE_FLOAT64}
+		if len(kv) == 2 {
+			vtype, err := ParseValueType(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			field.ValueType = vtype
+		}
+		fields = append(fields, field)
+	}
+	return fields, ValidateFields(fields)
+}
+
+func FormatFields(fields []SeriesField) string {
+	fs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fs = append(fs, fmt.Sprintf("%s:%s", f.Name, ValueTypeName(f.ValueType)))
+	}
+	return strings.Join(fs, ",")
+}
+
+// ValidateFields checks names are valid and unique, and fields are not
+// nested
+func ValidateFields(fields []SeriesField) error {
+	seen := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		if !fieldNameRegexp.MatchString(f.Name) {
+			return fmt.Errorf("Invalid field name: %q", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("Duplicate field: %s", f.Name)
+		}
+		seen[f.Name] = true
+		if f.ValueType == VALUE_FIELDS {
+			return fmt.Errorf("Field %s: fields can not be nested", f.Name)
+		}
+		if _, ok := valueTypeNames[f.ValueType]; !ok {
+			return fmt.Errorf("Field %s: unknown value type %d", f.Name, f.ValueType)
+		}
+	}
+	return nil
+}
+
+// EncodeFields packs values of fields in schema order, each as an uvarint
+// of its length plus one followed by the value. Missing values are nil
+// and stored as a single zero.
+func EncodeFields(values [][]byte) []byte {
+	size := 0
+	for _, v := range values {
+		size += len(v) + binary.MaxVarintLen32
+	}
+	b := make([]byte, 0, size)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, v := range values {
+		if v == nil {
+			b = append(b, 0)
+			continue
+		}
+		n := binary.PutUvarint(tmp, uint64(len(v))+1)
+		b = append(b, tmp[:n]...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+// DecodeFields is the inverse of EncodeFields
+func DecodeFields(b []byte) ([][]byte, error) {
+	values := [][]byte{}
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n)+1 {
+			return nil, InvalidValue
+		}
+		b = b[n:]
+		if l == 0 {
+			values = append(values, nil)
+			continue
+		}
+		values = append(values, b[:l-1])
+		b = b[l-1:]
+	}
+	return values, nil
+}
+
+// FieldIndex returns the position of a field in the schema, -1 if absent
+func (ns *NekoSeriesInfo) FieldIndex(name string) int {
+	for i, f := range ns.Fields {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseValue converts the textual form of a value of the series, for
+// multi-field series that is a query string like
+// "temperature=21.5&humidity=60", fields left out are missing
+func (ns *NekoSeriesInfo) ParseValue(text string) ([]byte, error) {
+	if ns.ValueType != VALUE_FIELDS {
+		return ParseValue(ns.ValueType, text)
+	}
+	q, err := url.ParseQuery(text)
+	if err != nil || len(q) == 0 {
+		return nil, InvalidValue
+	}
+	values := make([][]byte, len(ns.Fields))
+	for name, vs := range q {
+		i := ns.FieldIndex(name)
+		if i < 0 {
+			return nil, fmt.Errorf("Unknown field: %s", name)
+		}
+		if values[i], err = ParseValue(ns.Fields[i].ValueType, vs[len(vs)-1]); err != nil {
+			return nil, err
+		}
+	}
+	b := EncodeFields(values)
+	if len(b) > MAX_VALUE_LEN {
+		return nil, ValueTooLong
+	}
+	return b, nil
+}
+
+// DecodeValue decodes a value of the series, multi-field values become a
+// map of the fields present
+func (ns *NekoSeriesInfo) DecodeValue(b []byte) (interface{}, error) {
+	if ns.ValueType != VALUE_FIELDS {
+		return DecodeValue(ns.ValueType, b)
+	}
+	values, err := DecodeFields(b)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		if v == nil || i >= len(ns.Fields) {
+			continue
+		}
+		if m[ns.Fields[i].Name], err = DecodeValue(ns.Fields[i].ValueType, v); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// FormatValue is the inverse of ParseValue
+func (ns *NekoSeriesInfo) FormatValue(b []byte) string {
+	if ns.ValueType != VALUE_FIELDS {
+		return FormatValue(ns.ValueType, b)
+	}
+	values, err := DecodeFields(b)
+	if err != nil {
+		return fmt.Sprintf("<%s>", err.Error())
+	}
+	q := url.Values{}
+	for i, v := range values {
+		if v != nil && i < len(ns.Fields) {
+			q.Set(ns.Fields[i].Name, FormatValue(ns.Fields[i].ValueType, v))
+		}
+	}
+	return q.Encode()
+}
+
+// ParseFieldNames parses a comma separated list of fields of the series
+func (ns *NekoSeriesInfo) ParseFieldNames(text string) ([]string, error) {
+	names := []string{}
+	if strings.TrimSpace(text) == "" {
+		return names, nil
+	}
+	if ns.ValueType != VALUE_FIELDS {
+		return nil, fmt.Errorf("series %s has no fields", ns.Name)
+	}
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		if ns.FieldIndex(name) < 0 {
+			return nil, fmt.Errorf("Unknown field: %s", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ProjectFields keeps values of the named fields, others become missing.
+// Values of other series and empty projections are returned as is.
+func (ns *NekoSeriesInfo) ProjectFields(b []byte, names []string) ([]byte, error) {
+	if ns.ValueType != VALUE_FIELDS || len(names) == 0 {
+		return b, nil
+	}
+	values, err := DecodeFields(b)
+	if err != nil {
+		return nil, err
+	}
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	for i := range values {
+		if i >= len(ns.Fields) || !keep[ns.Fields[i].Name] {
+			values[i] = nil
+		}
+	}
+	return EncodeFields(values), nil
+}
@@ -0,0 +1,57 @@
+package nekolib
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFields(t *testing.T) {
+	Convey("Subject: Multi-field series", t, func() {
+		fields, err := ParseFields("temperature,humidity:int64,station:string")
+		So(err, ShouldBeNil)
+		sinfo := &NekoSeriesInfo{Name: "weather", ValueType: VALUE_FIELDS, Fields: fields}
+
+		Convey("Schema should round trip", func() {
+			So(fields[0], ShouldResemble, SeriesField{"temperature", VALUE_FLOAT64})
+			So(FormatFields(fields), ShouldEqual, "temperature:float64,humidity:int64,station:string")
+
+			decoded := new(NekoSeriesInfo)
+			So(decoded.FromBytes(bytes.NewBuffer(sinfo.ToBytes())), ShouldBeNil)
+			So(decoded.Fields, ShouldResemble, fields)
+
+			_, err = ParseFields("a,a")
+			So(err, ShouldNotBeNil)
+			_, err = ParseFields("a:fields")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Values should round trip with missing fields", func() {
+			b, err := sinfo.ParseValue("temperature=21.5&station=a%26b")
+			So(err, ShouldBeNil)
+			So(ValidateValue(VALUE_FIELDS, b), ShouldBeNil)
+			So(sinfo.FormatValue(b), ShouldEqual, "station=a%26b&temperature=21.5")
+
+			v, err := sinfo.DecodeValue(b)
+			So(err, ShouldBeNil)
+			So(v, ShouldResemble, map[string]interface{}{"temperature": 21.5, "station": "a&b"})
+
+			_, err = sinfo.ParseValue("wind=3")
+			So(err, ShouldNotBeNil)
+			So(ValidateValue(VALUE_FIELDS, []byte{5, 1}), ShouldNotBeNil)
+		})
+
+		Convey("Projection should drop other fields", func() {
+			b, _ := sinfo.ParseValue("temperature=21.5&humidity=60")
+			names, err := sinfo.ParseFieldNames("humidity")
+			So(err, ShouldBeNil)
+			p, err := sinfo.ProjectFields(b, names)
+			So(err, ShouldBeNil)
+			So(sinfo.FormatValue(p), ShouldEqual, "humidity=60")
+
+			_, err = sinfo.ParseFieldNames("wind")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -24,12 +24,18 @@ import (
 
 type ReqImportSeriesHdr struct {
 	SeriesName string
+	// DURABILITY_UNSET keeps the default of the series
+	Durability uint8
+	// CONSISTENCY_UNSET keeps the default of the series
+	Consistency uint8
 }
 
 func (r *ReqImportSeriesHdr) ToBytes() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0, 16))
 	sn := NekoString(r.SeriesName)
 	buf.Write(sn.ToBytes())
+	binary.Write(buf, binary.BigEndian, r.Durability)
+	binary.Write(buf, binary.BigEndian, r.Consistency)
 	return buf.Bytes()
 }
 
@@ -40,7 +46,46 @@ func (r *ReqImportSeriesHdr) FromBytes(buf *bytes.Buffer) error {
 	} else {
 		return err
 	}
-	return nil
+	if err := binary.Read(buf, binary.BigEndian, &r.Durability); err != nil {
+		return err
+	}
+	return binary.Read(buf, binary.BigEndian, &r.Consistency)
+}
+
+// Header of OP_INSERT, records follow in the same message
+type ReqInsertHdr struct {
+	SeriesName string
+	Count      uint16
+	// DURABILITY_UNSET keeps the default of the series
+	Durability uint8
+	// CONSISTENCY_UNSET keeps the default of the series
+	Consistency uint8
+}
+
+func (r *ReqInsertHdr) ToBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	sn := NekoString(r.SeriesName)
+	buf.Write(sn.ToBytes())
+	binary.Write(buf, binary.BigEndian, r.Count)
+	binary.Write(buf, binary.BigEndian, r.Durability)
+	binary.Write(buf, binary.BigEndian, r.Consistency)
+	return buf.Bytes()
+}
+
+func (r *ReqInsertHdr) FromBytes(buf *bytes.Buffer) error {
+	sn := new(NekoStrPack)
+	if err := sn.FromBytes(buf); err == nil {
+		r.SeriesName = sn.String()
+	} else {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &r.Count); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &r.Durability); err != nil {
+		return err
+	}
+	return binary.Read(buf, binary.BigEndian, &r.Consistency)
 }
 
 type ReqInsertBlockHdr struct {
@@ -50,6 +95,11 @@ type ReqInsertBlockHdr struct {
 	EndTs      []byte
 	Priority   uint8
 	Count      uint16
+	// resolved by nekos, one of DURABILITY_NO_WAL, _WAL and _SYNC
+	Durability uint8
+	// real names of peers owning the block while they are away, comma
+	// separated, the write is kept as a hint for each of them too
+	HintFor string
 }
 
 func (r *ReqInsertBlockHdr) ToBytes() []byte {
@@ -67,6 +117,8 @@ func (r *ReqInsertBlockHdr) ToBytes() []byte {
 	buf.Write(r.EndTs)
 	binary.Write(buf, binary.BigEndian, r.Priority)
 	binary.Write(buf, binary.BigEndian, r.Count)
+	binary.Write(buf, binary.BigEndian, r.Durability)
+	buf.Write(NekoString(r.HintFor).ToBytes())
 	return buf.Bytes()
 }
 
@@ -80,7 +132,7 @@ func (r *ReqInsertBlockHdr) FromBytes(buf *bytes.Buffer) error {
 
 	binary.Read(buf, binary.BigEndian, &r.HashValue)
 
-	r.StartTs = make([]byte, 15)
+	r.StartTs = make([]byte, TS_LEN)
 	l, err := buf.Read(r.StartTs)
 	if l != 15 {
 		return InvalidPacket
@@ -89,7 +141,7 @@ func (r *ReqInsertBlockHdr) FromBytes(buf *bytes.Buffer) error {
 		return err
 	}
 
-	r.EndTs = make([]byte, 15)
+	r.EndTs = make([]byte, TS_LEN)
 	l, err = buf.Read(r.EndTs)
 	if l != 15 {
 		return InvalidPacket
@@ -100,7 +152,12 @@ func (r *ReqInsertBlockHdr) FromBytes(buf *bytes.Buffer) error {
 
 	binary.Read(buf, binary.BigEndian, &r.Priority)
 	binary.Read(buf, binary.BigEndian, &r.Count)
+	binary.Read(buf, binary.BigEndian, &r.Durability)
 
+	hintFor := new(NekoStrPack)
+	if err := hintFor.FromBytes(buf); err == nil {
+		r.HintFor = hintFor.String()
+	}
 	return nil
 }
 
@@ -109,6 +166,11 @@ type ReqFindByRangeHdr struct {
 	StartTs    []byte
 	EndTs      []byte
 	Priority   uint8
+	// wanted resolution in seconds, nekos picks the rollup layer from it
+	Resolution uint32
+	// fields kept of multi-field series, comma separated, empty for all.
+	// nekod projects values before sending them.
+	Fields string
 }
 
 func (r *ReqFindByRangeHdr) ToBytes() []byte {
@@ -118,6 +180,8 @@ func (r *ReqFindByRangeHdr) ToBytes() []byte {
 	buf.Write(r.StartTs)
 	buf.Write(r.EndTs)
 	binary.Write(buf, binary.BigEndian, r.Priority)
+	binary.Write(buf, binary.BigEndian, r.Resolution)
+	buf.Write(NekoString(r.Fields).ToBytes())
 	return buf.Bytes()
 }
 
@@ -129,7 +193,7 @@ func (r *ReqFindByRangeHdr) FromBytes(buf *bytes.Buffer) error {
 		return err
 	}
 
-	r.StartTs = make([]byte, 15)
+	r.StartTs = make([]byte, TS_LEN)
 	l, err := buf.Read(r.StartTs)
 	if l != 15 {
 		return InvalidPacket
@@ -138,7 +202,7 @@ func (r *ReqFindByRangeHdr) FromBytes(buf *bytes.Buffer) error {
 		return err
 	}
 
-	r.EndTs = make([]byte, 15)
+	r.EndTs = make([]byte, TS_LEN)
 	l, err = buf.Read(r.EndTs)
 	if l != 15 {
 		return InvalidPacket
@@ -148,9 +212,61 @@ func (r *ReqFindByRangeHdr) FromBytes(buf *bytes.Buffer) error {
 	}
 
 	binary.Read(buf, binary.BigEndian, &r.Priority)
+	binary.Read(buf, binary.BigEndian, &r.Resolution)
+	// older clients send no fields
+	fields := new(NekoStrPack)
+	if err := fields.FromBytes(buf); err == nil {
+		r.Fields = fields.String()
+	}
 	return nil
 }
 
+type ReqDeleteRangeHdr struct {
+	SeriesName string
+	StartTs    []byte
+	EndTs      []byte
+	Priority   uint8
+}
+
+func (r *ReqDeleteRangeHdr) ToBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	sn := NekoString(r.SeriesName)
+	buf.Write(sn.ToBytes())
+	buf.Write(r.StartTs)
+	buf.Write(r.EndTs)
+	binary.Write(buf, binary.BigEndian, r.Priority)
+	return buf.Bytes()
+}
+
+func (r *ReqDeleteRangeHdr) FromBytes(buf *bytes.Buffer) error {
+	sn := new(NekoStrPack)
+	if err := sn.FromBytes(buf); err == nil {
+		r.SeriesName = sn.String()
+	} else {
+		return err
+	}
+
+	r.StartTs = make([]byte, TS_LEN)
+	l, err := buf.Read(r.StartTs)
+	if l != 15 {
+		return InvalidPacket
+	}
+	if err != nil {
+		return err
+	}
+
+	r.EndTs = make([]byte, TS_LEN)
+	l, err = buf.Read(r.EndTs)
+	if l != 15 {
+		return InvalidPacket
+	}
+	if err != nil {
+		return err
+	}
+
+	return binary.Read(buf, binary.BigEndian, &r.Priority)
+}
+
 type ReqSeriesMetaHdr struct {
 	SeriesName string
 }
@@ -171,3 +287,127 @@ func (r *ReqSeriesMetaHdr) FromBytes(buf *bytes.Buffer) error {
 	}
 	return nil
 }
+
+// Snapshots are named by a tag, every peer keeps its part of a series
+// under the same tag
+type ReqSnapshotHdr struct {
+	SeriesName string
+	Tag        string
+}
+
+func (r *ReqSnapshotHdr) ToBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	sn := NekoString(r.SeriesName)
+	buf.Write(sn.ToBytes())
+	tag := NekoString(r.Tag)
+	buf.Write(tag.ToBytes())
+	return buf.Bytes()
+}
+
+func (r *ReqSnapshotHdr) FromBytes(buf *bytes.Buffer) error {
+	sn := new(NekoStrPack)
+	if err := sn.FromBytes(buf); err != nil {
+		return err
+	}
+	r.SeriesName = sn.String()
+
+	tag := new(NekoStrPack)
+	if err := tag.FromBytes(buf); err != nil {
+		return err
+	}
+	r.Tag = tag.String()
+	return nil
+}
+
+// Header of OP_FIND_LAST, asking for the newest Count points not after
+// BeforeTs
+type ReqFindLastHdr struct {
+	SeriesName string
+	BeforeTs   []byte
+	Count      uint16
+}
+
+func (r *ReqFindLastHdr) ToBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.Write(NekoString(r.SeriesName).ToBytes())
+	buf.Write(r.BeforeTs)
+	binary.Write(buf, binary.BigEndian, r.Count)
+	return buf.Bytes()
+}
+
+func (r *ReqFindLastHdr) FromBytes(buf *bytes.Buffer) error {
+	sn := new(NekoStrPack)
+	if err := sn.FromBytes(buf); err != nil {
+		return err
+	}
+	r.SeriesName = sn.String()
+
+	r.BeforeTs = make([]byte, TS_LEN)
+	if l, _ := buf.Read(r.BeforeTs); l != 15 {
+		return InvalidPacket
+	}
+	return binary.Read(buf, binary.BigEndian, &r.Count)
+}
+
+// Header of OP_LIST_SERIES, tag matchers in the form of ParseTagMatchers,
+// empty to list every series
+type ReqListSeriesHdr struct {
+	Match string
+}
+
+func (r *ReqListSeriesHdr) ToBytes() []byte {
+	return NekoString(r.Match).ToBytes()
+}
+
+func (r *ReqListSeriesHdr) FromBytes(buf *bytes.Buffer) error {
+	match := new(NekoStrPack)
+	if err := match.FromBytes(buf); err != nil {
+		return err
+	}
+	r.Match = match.String()
+	return nil
+}
+
+// Header of OP_FETCH_HINTS and OP_DROP_HINTS, hints are kept by the real
+// name of the peer they are meant for
+type ReqHintsHdr struct {
+	Owner string
+}
+
+func (r *ReqHintsHdr) ToBytes() []byte {
+	return NekoString(r.Owner).ToBytes()
+}
+
+func (r *ReqHintsHdr) FromBytes(buf *bytes.Buffer) error {
+	owner := new(NekoStrPack)
+	if err := owner.FromBytes(buf); err != nil {
+		return err
+	}
+	r.Owner = owner.String()
+	return nil
+}
+
+// Header of OP_SYNC, SYNC_BLOCK is followed by a ReqInsertBlockHdr and
+// frames of records like OP_INSERT_BATCH
+type ReqSyncHdr struct {
+	// real name of the sending peer
+	Source string
+	// one of SYNC_*
+	Phase uint8
+}
+
+func (r *ReqSyncHdr) ToBytes() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	buf.Write(NekoString(r.Source).ToBytes())
+	binary.Write(buf, binary.BigEndian, r.Phase)
+	return buf.Bytes()
+}
+
+func (r *ReqSyncHdr) FromBytes(buf *bytes.Buffer) error {
+	source := new(NekoStrPack)
+	if err := source.FromBytes(buf); err != nil {
+		return err
+	}
+	r.Source = source.String()
+	return binary.Read(buf, binary.BigEndian, &r.Phase)
+}
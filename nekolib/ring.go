@@ -0,0 +1,85 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import "sort"
+
+// PeerRing places virtual nodes of peers on the hash ring the same way
+// nekos does, so that peers can tell which frag blocks they own
+type PeerRing struct {
+	ringNodes
+}
+
+// virtual nodes sorted by their keys on the ring
+type ringNodes struct {
+	nodes []NekodPeerInfo
+	keys  []uint32
+}
+
+func (r ringNodes) Len() int { return len(r.nodes) }
+func (r ringNodes) Swap(i, j int) {
+	r.nodes[i], r.nodes[j] = r.nodes[j], r.nodes[i]
+	r.keys[i], r.keys[j] = r.keys[j], r.keys[i]
+}
+func (r ringNodes) Less(i, j int) bool {
+	if r.keys[i] == r.keys[j] {
+		return r.nodes[i].Name < r.nodes[j].Name
+	}
+	return r.keys[i] < r.keys[j]
+}
+
+func NewPeerRing(peers []NekodPeerInfo) *PeerRing {
+	r := &PeerRing{ringNodes{
+		nodes: append([]NekodPeerInfo{}, peers...),
+		keys:  make([]uint32, len(peers)),
+	}}
+	for i, p := range r.nodes {
+		r.keys[i] = Hash32([]byte(p.Name))
+	}
+	sort.Sort(r.ringNodes)
+	return r
+}
+
+// Owners returns the virtual node owning key followed by the next ones
+// clockwise, n of them at most, each of a different real peer
+func (r *PeerRing) Owners(key uint32, n int) []NekodPeerInfo {
+	owners := []NekodPeerInfo{}
+	if len(r.nodes) == 0 {
+		return owners
+	}
+	start := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= key })
+	seen := make(map[string]bool)
+	for i := 0; i < len(r.nodes) && len(owners) < n; i++ {
+		p := r.nodes[(start+i)%len(r.nodes)]
+		if !seen[p.RealName] {
+			seen[p.RealName] = true
+			owners = append(owners, p)
+		}
+	}
+	return owners
+}
+
+// Owns tells whether the real peer is one of the n owners of key
+func (r *PeerRing) Owns(realName string, key uint32, n int) bool {
+	for _, p := range r.Owners(key, n) {
+		if p.RealName == realName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package nekolib
+
+import (
+	"fmt"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPeerRing(t *testing.T) {
+	peers := []NekodPeerInfo{}
+	for _, name := range []string{"a", "b", "c"} {
+		for i := 0; i < 4; i++ {
+			peers = append(peers, NekodPeerInfo{Name: fmt.Sprintf("%s-%d", name, i), RealName: name})
+		}
+	}
+
+	Convey("Subject: Peer ring", t, func() {
+		ring := NewPeerRing(peers)
+		So(ring.Len(), ShouldEqual, len(peers))
+
+		Convey("Owners should be distinct real peers", func() {
+			for _, key := range []uint32{0, 1 << 20, 1 << 31, ^uint32(0)} {
+				owners := ring.Owners(key, 5)
+				So(len(owners), ShouldEqual, 3)
+				seen := map[string]bool{}
+				for _, o := range owners {
+					So(seen[o.RealName], ShouldBeFalse)
+					seen[o.RealName] = true
+				}
+				So(ring.Owns(owners[0].RealName, key, 1), ShouldBeTrue)
+			}
+		})
+
+		Convey("The first owner should follow the key clockwise", func() {
+			key := Hash32([]byte("b-2"))
+			So(ring.Owners(key, 1)[0].Name, ShouldEqual, "b-2")
+			So(ring.Owners(key+1, 1)[0].Name, ShouldNotEqual, "b-2")
+		})
+
+		Convey("Empty rings should own nothing", func() {
+			So(len(NewPeerRing(nil).Owners(0, 1)), ShouldEqual, 0)
+		})
+	})
+}
@@ -0,0 +1,165 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+var rollupSteps = map[uint8]int64{
+	PRIORITY_ROLLUP_1M: 60,
+	PRIORITY_ROLLUP_1H: 3600,
+	PRIORITY_ROLLUP_1D: 86400,
+}
+
+// Rollup layers from finest to coarsest
+var RollupLayers = []uint8{
+	PRIORITY_ROLLUP_1M,
+	PRIORITY_ROLLUP_1H,
+	PRIORITY_ROLLUP_1D,
+}
+
+func IsRollupLayer(priority uint8) bool {
+	_, found := rollupSteps[priority]
+	return found
+}
+
+// Bucket width of a rollup layer in seconds
+func RollupStep(priority uint8) int64 {
+	return rollupSteps[priority]
+}
+
+// RollupLayer picks the coarsest layer whose buckets are not wider than
+// resolution, PRIORITY_RAW if none of them is.
+func RollupLayer(resolution time.Duration) uint8 {
+	layer := PRIORITY_RAW
+	for _, p := range RollupLayers {
+		if time.Duration(rollupSteps[p])*time.Second <= resolution {
+			layer = p
+		}
+	}
+	return layer
+}
+
+// Unix aligned bucket of a time in a rollup layer
+func RollupBucket(t time.Time, priority uint8) (lower, upper time.Time) {
+	step := rollupSteps[priority]
+	ts := t.Unix()
+	l := ts - ts%step
+	if ts < 0 && ts%step != 0 {
+		l -= step
+	}
+	return time.Unix(l, 0).UTC(), time.Unix(l+step, 0).UTC()
+}
+
+func IsNumericValue(vtype uint8) bool {
+	return vtype == VALUE_FLOAT64 || vtype == VALUE_INT64
+}
+
+func NumericValue(vtype uint8, b []byte) (float64, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	switch vtype {
+	case VALUE_FLOAT64:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), true
+	case VALUE_INT64:
+		return float64(int64(binary.BigEndian.Uint64(b))), true
+	}
+	return 0, false
+}
+
+// Aggregates of a rollup bucket, partial aggregates of the same bucket
+// are merged with Merge
+type RollupValue struct {
+	Count int64
+	Min   float64
+	Max   float64
+	Sum   float64
+}
+
+const ROLLUP_VALUE_LEN = 32
+
+func (r *RollupValue) Add(v float64) {
+	if r.Count == 0 || v < r.Min {
+		r.Min = v
+	}
+	if r.Count == 0 || v > r.Max {
+		r.Max = v
+	}
+	r.Sum += v
+	r.Count++
+}
+
+func (r *RollupValue) Merge(o *RollupValue) {
+	if o.Count == 0 {
+		return
+	}
+	if r.Count == 0 || o.Min < r.Min {
+		r.Min = o.Min
+	}
+	if r.Count == 0 || o.Max > r.Max {
+		r.Max = o.Max
+	}
+	r.Sum += o.Sum
+	r.Count += o.Count
+}
+
+// Subtract takes the values aggregated in o out of r, it returns false if
+// Min or Max may have been one of them and need to be recomputed
+func (r *RollupValue) Subtract(o *RollupValue) bool {
+	if o.Count == 0 {
+		return true
+	}
+	r.Count -= o.Count
+	r.Sum -= o.Sum
+	if r.Count <= 0 {
+		r.Count, r.Min, r.Max, r.Sum = 0, 0, 0, 0
+		return true
+	}
+	return o.Min > r.Min && o.Max < r.Max
+}
+
+func (r *RollupValue) Mean() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Sum / float64(r.Count)
+}
+
+func (r *RollupValue) ToBytes() []byte {
+	b := make([]byte, ROLLUP_VALUE_LEN)
+	binary.BigEndian.PutUint64(b[0:8], uint64(r.Count))
+	binary.BigEndian.PutUint64(b[8:16], math.Float64bits(r.Min))
+	binary.BigEndian.PutUint64(b[16:24], math.Float64bits(r.Max))
+	binary.BigEndian.PutUint64(b[24:32], math.Float64bits(r.Sum))
+	return b
+}
+
+func (r *RollupValue) FromBytes(b []byte) error {
+	if len(b) != ROLLUP_VALUE_LEN {
+		return InvalidValue
+	}
+	r.Count = int64(binary.BigEndian.Uint64(b[0:8]))
+	r.Min = math.Float64frombits(binary.BigEndian.Uint64(b[8:16]))
+	r.Max = math.Float64frombits(binary.BigEndian.Uint64(b[16:24]))
+	r.Sum = math.Float64frombits(binary.BigEndian.Uint64(b[24:32]))
+	return nil
+}
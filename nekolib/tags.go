@@ -0,0 +1,130 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Operators of tag matchers
+const (
+	MATCH_EQUAL     = "="
+	MATCH_NOT_EQUAL = "!="
+	MATCH_REGEXP    = "=~"
+)
+
+const tagSpecials = ",=!~"
+
+// ParseTags reads tags in the form of "site=beijing,sensor=temp"
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	if s == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid tag: %s", pair)
+		}
+		if err := validateTag(kv[0], kv[1]); err != nil {
+			return nil, err
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
+// FormatTags is the inverse of ParseTags, keys are sorted
+func FormatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func validateTag(k, v string) error {
+	if k == "" || strings.ContainsAny(k, tagSpecials) || strings.ContainsAny(v, tagSpecials) {
+		return fmt.Errorf("Invalid tag: %s=%s", k, v)
+	}
+	return nil
+}
+
+// TagMatcher selects series by the value of one tag. A missing tag
+// counts as the empty value.
+type TagMatcher struct {
+	Key   string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+func (m *TagMatcher) Match(tags map[string]string) bool {
+	v := tags[m.Key]
+	switch m.Op {
+	case MATCH_EQUAL:
+		return v == m.Value
+	case MATCH_NOT_EQUAL:
+		return v != m.Value
+	case MATCH_REGEXP:
+		return m.re.MatchString(v)
+	}
+	return false
+}
+
+func (m *TagMatcher) String() string {
+	return m.Key + m.Op + m.Value
+}
+
+// ParseTagMatchers reads matchers in the form of
+// "site=beijing,sensor!=temp,rack=~a.*", regexps are anchored
+func ParseTagMatchers(s string) ([]*TagMatcher, error) {
+	matchers := []*TagMatcher{}
+	if s == "" {
+		return matchers, nil
+	}
+	for _, expr := range strings.Split(s, ",") {
+		i := strings.IndexAny(expr, "=!")
+		if i < 1 {
+			return nil, fmt.Errorf("Invalid tag matcher: %s", expr)
+		}
+		m := &TagMatcher{Key: expr[:i]}
+		for _, op := range []string{MATCH_REGEXP, MATCH_NOT_EQUAL, MATCH_EQUAL} {
+			if strings.HasPrefix(expr[i:], op) {
+				m.Op, m.Value = op, expr[i+len(op):]
+				break
+			}
+		}
+		if m.Op == "" {
+			return nil, fmt.Errorf("Invalid tag matcher: %s", expr)
+		}
+		if m.Op == MATCH_REGEXP {
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, err
+			}
+			m.re = re
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
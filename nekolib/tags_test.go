@@ -0,0 +1,48 @@
+package nekolib
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTags(t *testing.T) {
+	Convey("Subject: Series tags", t, func() {
+		Convey("Tags should round trip", func() {
+			tags, err := ParseTags("sensor=temp,site=beijing")
+			So(err, ShouldBeNil)
+			So(tags, ShouldResemble, map[string]string{"site": "beijing", "sensor": "temp"})
+			So(FormatTags(tags), ShouldEqual, "sensor=temp,site=beijing")
+
+			_, err = ParseTags("site")
+			So(err, ShouldNotBeNil)
+			_, err = ParseTags("=beijing")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Matchers should select by tags", func() {
+			tags := map[string]string{"site": "beijing", "sensor": "temp"}
+			matchers, err := ParseTagMatchers("site=beijing,sensor!=humidity,rack=~|a.*")
+			So(err, ShouldBeNil)
+			So(len(matchers), ShouldEqual, 3)
+			for _, m := range matchers {
+				So(m.Match(tags), ShouldBeTrue)
+			}
+
+			matchers, err = ParseTagMatchers("site=~bei")
+			So(err, ShouldBeNil)
+			So(matchers[0].Match(tags), ShouldBeFalse)
+
+			_, err = ParseTagMatchers("site")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Series info should carry tags", func() {
+			sinfo := &NekoSeriesInfo{Name: "temp", Id: "temp", Tags: map[string]string{"site": "beijing"}}
+			decoded := new(NekoSeriesInfo)
+			So(decoded.FromBytes(bytes.NewBuffer(sinfo.ToBytes())), ShouldBeNil)
+			So(decoded.Tags, ShouldResemble, sinfo.Tags)
+		})
+	})
+}
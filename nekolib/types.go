@@ -22,6 +22,7 @@ import (
 	//  "github.com/bigeagle/nekodb/nekod/backend"
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 )
 
@@ -92,11 +93,11 @@ func (r *NekodRecord) FromBytes(buf *bytes.Buffer) (err error) {
 	if l == 0 {
 		return EndOfStream
 	}
-	if l <= 15 {
+	if l <= TS_LEN {
 		return InvalidPacket
 	}
-	lv := l - 15
-	r.Ts = make([]byte, 15)
+	lv := l - TS_LEN
+	r.Ts = make([]byte, TS_LEN)
 	r.Value = make([]byte, lv)
 	buf.Read(r.Ts)
 	buf.Read(r.Value)
@@ -125,6 +126,44 @@ type NekoSeriesInfo struct {
 	Id string `json:"id"`
 	// fragmentation level
 	FragLevel int `json:"frag_level"`
+	// type of values, one of VALUE_*
+	ValueType uint8 `json:"value_type"`
+	// storage mode, one of COMPRESS_*
+	Compression uint8 `json:"compression"`
+	// retention in seconds, 0 keeps data forever
+	Retention int64 `json:"retention"`
+	// default durability of writes, one of DURABILITY_*
+	Durability uint8 `json:"durability,omitempty"`
+	// handling of points at stored timestamps, one of DUP_*
+	DuplicatePolicy uint8 `json:"duplicate_policy,omitempty"`
+	// key/value tags selecting the series, eg: site=beijing
+	Tags map[string]string `json:"tags,omitempty"`
+	// storage tuning overriding that of nekod, nil keeps the defaults
+	Tuning *SeriesTuning `json:"tuning,omitempty"`
+	// schema of VALUE_FIELDS series
+	Fields []SeriesField `json:"fields,omitempty"`
+	// copies kept of each frag block, 0 means 1
+	Replicas uint8 `json:"replicas,omitempty"`
+	// default consistency of writes, one of CONSISTENCY_*
+	Consistency uint8 `json:"consistency,omitempty"`
+}
+
+// ReplicaCount is the number of distinct peers each frag block is
+// written to
+func (ns *NekoSeriesInfo) ReplicaCount() int {
+	if ns.Replicas < 1 {
+		return 1
+	}
+	return int(ns.Replicas)
+}
+
+// SeriesTuning tunes the storage of a series, zero fields keep the
+// defaults of nekod. Changes to a series already stored by a nekod take
+// effect once that nekod restarts.
+type SeriesTuning struct {
+	WriteBufferSize  int    `json:"write_buffer_size,omitempty"`
+	BlockCompression string `json:"block_compression,omitempty"`
+	BloomBits        int    `json:"bloom_bits,omitempty"`
 }
 
 func (ns *NekoSeriesInfo) ToBytes() []byte {
@@ -133,6 +172,21 @@ func (ns *NekoSeriesInfo) ToBytes() []byte {
 	buf.Write(NekoString(ns.Name).ToBytes())
 	buf.Write(NekoString(ns.Id).ToBytes())
 	binary.Write(buf, binary.BigEndian, uint8(ns.FragLevel))
+	binary.Write(buf, binary.BigEndian, ns.ValueType)
+	binary.Write(buf, binary.BigEndian, ns.Compression)
+	binary.Write(buf, binary.BigEndian, ns.Retention)
+	binary.Write(buf, binary.BigEndian, ns.Durability)
+	binary.Write(buf, binary.BigEndian, ns.DuplicatePolicy)
+	buf.Write(NekoString(FormatTags(ns.Tags)).ToBytes())
+	// tuning travels as JSON, empty when not set
+	tuning := []byte{}
+	if ns.Tuning != nil {
+		tuning, _ = json.Marshal(ns.Tuning)
+	}
+	buf.Write(NekoString(string(tuning)).ToBytes())
+	buf.Write(NekoString(FormatFields(ns.Fields)).ToBytes())
+	binary.Write(buf, binary.BigEndian, ns.Replicas)
+	binary.Write(buf, binary.BigEndian, ns.Consistency)
 	return buf.Bytes()
 }
 
@@ -157,9 +211,79 @@ func (ns *NekoSeriesInfo) FromBytes(buf *bytes.Buffer) error {
 	} else {
 		return err
 	}
+
+	if err := binary.Read(buf, binary.BigEndian, &ns.ValueType); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ns.Compression); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ns.Retention); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ns.Durability); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ns.DuplicatePolicy); err != nil {
+		return err
+	}
+	tags := new(NekoStrPack)
+	if err := tags.FromBytes(buf); err != nil {
+		return err
+	}
+	ns.Tags = nil
+	if tags.Len > 0 {
+		t, err := ParseTags(tags.String())
+		if err != nil {
+			return err
+		}
+		ns.Tags = t
+	}
+
+	tuning := new(NekoStrPack)
+	if err := tuning.FromBytes(buf); err != nil {
+		return err
+	}
+	ns.Tuning = nil
+	if tuning.Len > 0 {
+		ns.Tuning = new(SeriesTuning)
+		if err := json.Unmarshal(tuning.Bytes, ns.Tuning); err != nil {
+			return err
+		}
+	}
+
+	fields := new(NekoStrPack)
+	if err := fields.FromBytes(buf); err != nil {
+		return err
+	}
+	ns.Fields = nil
+	if fields.Len > 0 {
+		f, err := ParseFields(fields.String())
+		if err != nil {
+			return err
+		}
+		ns.Fields = f
+	}
+
+	if err := binary.Read(buf, binary.BigEndian, &ns.Replicas); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.BigEndian, &ns.Consistency); err != nil {
+		return err
+	}
 	return nil
 }
 
+// Frag block a peer keeps points of, as recorded by ReverseHash. Bounds
+// are unix nanoseconds, End is not part of the block. Count is the number
+// of raw points in the block.
+type FragBlock struct {
+	Hash  uint32
+	Start int64
+	End   int64
+	Count int64
+}
+
 type NekoSeriesMeta struct {
 	NekoSeriesInfo
 	// Record Counts
@@ -172,4 +296,20 @@ type NekodSeriesInfo struct {
 	Name string `json:"name"`
 	// Record Count
 	Count int `json:"count"`
+	// Timestamps of the first and the last record, empty if none
+	First string `json:"first,omitempty"`
+	Last  string `json:"last,omitempty"`
+	// Raw points of every frag block kept, by hash
+	Blocks map[uint32]int64 `json:"blocks,omitempty"`
+}
+
+// Reply of a peer to a batch insert
+type NekodInsertInfo struct {
+	// Peer Name
+	Name string `json:"name"`
+	// Records received
+	Count int `json:"count"`
+	// Records at timestamps already stored, handled by the duplicate
+	// policy of the series
+	Duplicates int `json:"duplicates"`
 }
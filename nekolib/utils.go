@@ -33,12 +33,18 @@ func Bytes2Time(b []byte) (time.Time, error) {
 	return *t, err
 }
 
+// Seconds from year 1, the epoch of Bytes2TimeSec, to unix epoch
+const UNIX_TO_INTERNAL int64 = (1969*365 + 1969/4 - 1969/100 + 1969/400) * 86400
+
+// Inverse of Bytes2TimeSec, in UTC
+func TimeSec2Time(ts int64) time.Time {
+	return time.Unix(ts-UNIX_TO_INTERNAL, 0).UTC()
+}
+
+// Seconds since year 1 of a binary timestamp, as used by frag blocks
 func Bytes2TimeSec(b []byte) int64 {
-	tb := b[1:9]
-	ts := int64(tb[7]) | int64(tb[6])<<8 | int64(tb[5])<<16 |
-		int64(tb[4])<<24 | int64(tb[3])<<32 | int64(tb[2])<<40 |
-		int64(tb[1])<<48 | int64(tb[0])<<56
-	return ts
+	t, _ := Bytes2Time(b)
+	return t.Unix() + UNIX_TO_INTERNAL
 }
 
 func TimeSec2Bytes(ts int64) []byte {
@@ -70,23 +76,13 @@ func TsBoundary(ts int64, frag_level int) (lower, upper int64) {
 	return lower, upper
 }
 
+// Boundaries of the frag block of a binary timestamp, in its zone
 func TimeBoundary(tb []byte, frag_level int) (lower, upper []byte) {
-	lower = make([]byte, 15)
-	upper = make([]byte, 15)
-	copy(lower, tb)
-	copy(upper, tb)
-
-	ts := Bytes2TimeSec(tb)
-	l, u := TsBoundary(ts, frag_level)
-
-	lbs := TimeSec2Bytes(l)
-	ubs := TimeSec2Bytes(u)
-
-	copy(lower[1:9], lbs)
-	copy(lower[9:13], []byte{0, 0, 0, 0})
-	copy(upper[1:9], ubs)
-	copy(upper[9:13], []byte{0, 0, 0, 0})
+	t, _ := Bytes2Time(tb)
+	l, u := TsBoundary(t.Unix()+UNIX_TO_INTERNAL, frag_level)
 
+	lower = Time2Bytes(TimeSec2Time(l).In(t.Location()))
+	upper = Time2Bytes(TimeSec2Time(u).In(t.Location()))
 	return lower, upper
 }
 
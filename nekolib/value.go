@@ -0,0 +1,166 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package nekolib
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+var InvalidValue = errors.New("Invalid Value")
+var ValueTooLong = errors.New("Value Too Long")
+
+// values travel in records whose 16bit length covers the 15 byte
+// timestamp too, compressed blocks keep the same limit
+const MAX_VALUE_LEN = 0xFFFF - TS_LEN
+
+var valueTypeNames = map[uint8]string{
+	VALUE_STRING:  "string",
+	VALUE_FLOAT64: "float64",
+	VALUE_INT64:   "int64",
+	VALUE_BOOL:    "bool",
+	VALUE_BYTES:   "bytes",
+	VALUE_FIELDS:  "fields",
+}
+
+func ValueTypeName(vtype uint8) string {
+	if name, ok := valueTypeNames[vtype]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", vtype)
+}
+
+func ParseValueType(name string) (uint8, error) {
+	for vtype, n := range valueTypeNames {
+		if n == name {
+			return vtype, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown value type: %s", name)
+}
+
+// ParseValue converts the textual form of a value (as found in csv files)
+// to its binary encoding: 8 bytes big endian for numbers, 1 byte for bools,
+// raw bytes for strings, and base64 text for bytes.
+func ParseValue(vtype uint8, text string) ([]byte, error) {
+	switch vtype {
+	case VALUE_FLOAT64:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, InvalidValue
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(f))
+		return b, nil
+	case VALUE_INT64:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, InvalidValue
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(i))
+		return b, nil
+	case VALUE_BOOL:
+		v, err := strconv.ParseBool(text)
+		if err != nil {
+			return nil, InvalidValue
+		}
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case VALUE_STRING:
+		if len(text) > MAX_VALUE_LEN {
+			return nil, ValueTooLong
+		}
+		return []byte(text), nil
+	case VALUE_BYTES:
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, InvalidValue
+		}
+		if len(b) > MAX_VALUE_LEN {
+			return nil, ValueTooLong
+		}
+		return b, nil
+	}
+	return nil, InvalidValue
+}
+
+func ValidateValue(vtype uint8, b []byte) error {
+	if len(b) > MAX_VALUE_LEN {
+		return ValueTooLong
+	}
+	switch vtype {
+	case VALUE_FLOAT64, VALUE_INT64:
+		if len(b) != 8 {
+			return InvalidValue
+		}
+	case VALUE_BOOL:
+		if len(b) != 1 || b[0] > 1 {
+			return InvalidValue
+		}
+	case VALUE_STRING, VALUE_BYTES:
+	case VALUE_FIELDS:
+		// engines know no schema, only the framing is checked
+		if _, err := DecodeFields(b); err != nil {
+			return InvalidValue
+		}
+	default:
+		return InvalidValue
+	}
+	return nil
+}
+
+// DecodeValue returns the go value of an encoded value, the result
+// marshals to a native json type
+func DecodeValue(vtype uint8, b []byte) (interface{}, error) {
+	if err := ValidateValue(vtype, b); err != nil {
+		return nil, err
+	}
+	switch vtype {
+	case VALUE_FLOAT64:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	case VALUE_INT64:
+		return int64(binary.BigEndian.Uint64(b)), nil
+	case VALUE_BOOL:
+		return b[0] == 1, nil
+	case VALUE_STRING:
+		return string(b), nil
+	}
+	return b, nil
+}
+
+// FormatValue is the inverse of ParseValue
+func FormatValue(vtype uint8, b []byte) string {
+	v, err := DecodeValue(vtype, b)
+	if err != nil {
+		return fmt.Sprintf("<%s>", err.Error())
+	}
+	switch x := v.(type) {
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(x)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,64 @@
+package nekolib
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestValueEncoding(t *testing.T) {
+	Convey("Subject: Test Typed Values", t, func() {
+
+		Convey("Numbers should round trip", func() {
+			b, err := ParseValue(VALUE_FLOAT64, "-8.25")
+			So(err, ShouldBeNil)
+			So(len(b), ShouldEqual, 8)
+			v, err := DecodeValue(VALUE_FLOAT64, b)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, -8.25)
+
+			b, err = ParseValue(VALUE_INT64, "-42")
+			So(err, ShouldBeNil)
+			v, err = DecodeValue(VALUE_INT64, b)
+			So(err, ShouldBeNil)
+			So(v, ShouldEqual, int64(-42))
+			So(FormatValue(VALUE_INT64, b), ShouldEqual, "-42")
+		})
+
+		Convey("Bools and bytes should round trip", func() {
+			b, err := ParseValue(VALUE_BOOL, "true")
+			So(err, ShouldBeNil)
+			So(FormatValue(VALUE_BOOL, b), ShouldEqual, "true")
+
+			b, err = ParseValue(VALUE_BYTES, "bmVrbw==")
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "neko")
+			So(FormatValue(VALUE_BYTES, b), ShouldEqual, "bmVrbw==")
+		})
+
+		Convey("Values too long for a record should be rejected", func() {
+			long := make([]byte, MAX_VALUE_LEN+1)
+			_, err := ParseValue(VALUE_STRING, string(long))
+			So(err, ShouldEqual, ValueTooLong)
+			So(ValidateValue(VALUE_BYTES, long), ShouldEqual, ValueTooLong)
+			So(ValidateValue(VALUE_BYTES, long[1:]), ShouldBeNil)
+		})
+
+		Convey("Invalid values should be rejected", func() {
+			_, err := ParseValue(VALUE_FLOAT64, "abc")
+			So(err, ShouldEqual, InvalidValue)
+			_, err = ParseValue(VALUE_FLOAT64, "NaN")
+			So(err, ShouldEqual, InvalidValue)
+			So(ValidateValue(VALUE_INT64, []byte{1, 2}), ShouldEqual, InvalidValue)
+			So(ValidateValue(VALUE_STRING, []byte("anything")), ShouldBeNil)
+		})
+
+		Convey("Type names should be parsed", func() {
+			vtype, err := ParseValueType("int64")
+			So(err, ShouldBeNil)
+			So(vtype, ShouldEqual, VALUE_INT64)
+			_, err = ParseValueType("complex")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -22,10 +22,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/coreos/go-etcd/etcd"
 	zmq "github.com/pebbe/zmq4"
 )
 
@@ -34,7 +38,12 @@ func ensureSeries(sname string) {
 	c := s.collection
 
 	if _, ok := c.getSeries(sname); !ok {
-		newSeries(&nekolib.NekoSeriesInfo{sname, sname, nekolib.SLICE_FRAG_LEVEL_DEFAULT})
+		newSeries(&nekolib.NekoSeriesInfo{
+			Name:      sname,
+			Id:        sname,
+			FragLevel: nekolib.SLICE_FRAG_LEVEL_DEFAULT,
+			ValueType: nekolib.VALUE_FLOAT64,
+		})
 	}
 }
 
@@ -42,6 +51,19 @@ func ensureSeries(sname string) {
 func newSeries(series *nekolib.NekoSeriesInfo) error {
 	s := getServer()
 
+	if len(series.Fields) > 0 {
+		if err := nekolib.ValidateFields(series.Fields); err != nil {
+			return err
+		}
+		series.ValueType = nekolib.VALUE_FIELDS
+	} else if series.ValueType == nekolib.VALUE_FIELDS {
+		return errors.New("Fields Required")
+	}
+
+	if err := clearTombstone(series.Id); err != nil {
+		return err
+	}
+
 	sjson, _ := json.Marshal(series)
 	key := fmt.Sprintf("%s/%s", nekolib.ETCD_SERIES_DIR, series.Name)
 	s.ec.Set(key, string(sjson), 0)
@@ -85,68 +107,507 @@ func newSeries(series *nekolib.NekoSeriesInfo) error {
 	return nil
 }
 
-func importSeries(sname string, sock *zmq.Socket) error {
+// Drop a series on every peer. A tombstone is written first, nekods drop
+// series they see tombstones of, so that peers missing the request now
+// finish the drop when they start again. The tombstone is removed once
+// every known peer acked, departed ones included, until then the id
+// cannot be reused.
+func dropSeries(sname string) error {
+	s := getServer()
+	sinfo, found := s.collection.getSeries(sname)
+	if !found {
+		return fmt.Errorf("series %s not found", sname)
+	}
+
+	sjson, _ := json.Marshal(sinfo)
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_DROPPED_DIR, sinfo.Id)
+	if _, err := s.ec.Set(key, string(sjson), 0); err != nil {
+		return err
+	}
+	key = fmt.Sprintf("%s/%s", nekolib.ETCD_SERIES_DIR, sinfo.Name)
+	if _, err := s.ec.Delete(key, false); err != nil {
+		return err
+	}
+	s.collection.removeSeries(sinfo.Name)
+	away, err := finishDrop(sinfo)
+	if err != nil {
+		return err
+	}
+	if len(away) > 0 {
+		logger.Info("series %s is dropped once %s are back", sname, strings.Join(away, ", "))
+	}
+	return nil
+}
+
+// finishDrop asks every peer to drop a tombstoned series and removes the
+// tombstone once all of them did. Departed peers have not, their real
+// names are returned and the tombstone is kept for finishDrops to remove
+// when they are back.
+func finishDrop(sinfo *nekolib.NekoSeriesInfo) ([]string, error) {
+	s := getServer()
+	var m sync.Mutex
+	acked := make(map[string]bool)
+	msg := append([]byte{byte(nekolib.OP_DELETE_SERIES)}, sinfo.ToBytes()...)
+	err := broadcast(msg, func(n *nekoRingNode, reply []byte) error {
+		m.Lock()
+		defer m.Unlock()
+		acked[n.RealName] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	away := []string{}
+	for _, name := range s.hints.departedPeers() {
+		if !acked[name] {
+			away = append(away, name)
+		}
+	}
+	if len(away) > 0 {
+		return away, nil
+	}
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_DROPPED_DIR, sinfo.Id)
+	_, err = s.ec.Delete(key, false)
+	return nil, err
+}
+
+// finishDrops finishes the drops of every tombstone left, run when a
+// departed peer is back
+func finishDrops() error {
+	s := getServer()
+	r, err := s.ec.Get(nekolib.ETCD_DROPPED_DIR, false, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == nekolib.ETCD_KEY_NOT_FOUND {
+			return nil
+		}
+		return err
+	}
+	for _, node := range r.Node.Nodes {
+		sinfo := new(nekolib.NekoSeriesInfo)
+		if err := json.Unmarshal([]byte(node.Value), sinfo); err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		if _, err := finishDrop(sinfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearTombstone finishes a pending drop of the series id, a new series
+// must not take the id over while peers may still keep its old data
+func clearTombstone(id string) error {
 	s := getServer()
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_DROPPED_DIR, id)
+	r, err := s.ec.Get(key, false, false)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == nekolib.ETCD_KEY_NOT_FOUND {
+			return nil
+		}
+		return err
+	}
+	sinfo := new(nekolib.NekoSeriesInfo)
+	if err := json.Unmarshal([]byte(r.Node.Value), sinfo); err != nil {
+		return err
+	}
+	away, err := finishDrop(sinfo)
+	if err != nil {
+		return fmt.Errorf("series id %s is still being dropped: %s", id, err.Error())
+	}
+	if len(away) > 0 {
+		return fmt.Errorf("series id %s is still being dropped, %s are away", id, strings.Join(away, ", "))
+	}
+	return nil
+}
 
+// snapshotSeries makes every peer snapshot its part of a series under tag
+func snapshotSeries(sname, tag string) error {
+	s := getServer()
 	sinfo, found := s.collection.getSeries(sname)
 	if !found {
-		return errors.New("Series Not Found")
+		return fmt.Errorf("series %s not found", sname)
 	}
 
-	var wg sync.WaitGroup
+	reqHdr := &nekolib.ReqSnapshotHdr{
+		SeriesName: sname,
+		Tag:        tag,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.WriteByte(byte(nekolib.OP_SNAPSHOT))
+	buf.Write(reqHdr.ToBytes())
+	buf.Write(sinfo.ToBytes())
+	return broadcast(buf.Bytes(), nil)
+}
 
-	// flush block to coresponding peer
-	flushBlock := func(block []*nekolib.NekodRecord, lower, upper int64) {
-		defer wg.Done()
-		if len(block) < 1 {
-			return
+// restoreSeries brings a series back from snapshot tag on every peer, it
+// is registered only after all peers restored their parts. Snapshots are
+// restored by the peers that took them, so the ring must not change in
+// between.
+func restoreSeries(sname, tag string) (*nekolib.NekoSeriesInfo, error) {
+	s := getServer()
+	if _, found := s.collection.getSeries(sname); found {
+		return nil, fmt.Errorf("series %s exists", sname)
+	}
+
+	reqHdr := &nekolib.ReqSnapshotHdr{
+		SeriesName: sname,
+		Tag:        tag,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 32))
+	buf.WriteByte(byte(nekolib.OP_RESTORE))
+	buf.Write(reqHdr.ToBytes())
+
+	var mutex sync.Mutex
+	var sinfo *nekolib.NekoSeriesInfo
+	err := broadcast(buf.Bytes(), func(n *nekoRingNode, reply []byte) error {
+		psinfo := new(nekolib.NekoSeriesInfo)
+		if err := json.Unmarshal(reply, psinfo); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if sinfo != nil && sinfo.Id != psinfo.Id {
+			return fmt.Errorf("snapshot %s holds series id %s, expected %s", tag, psinfo.Id, sinfo.Id)
+		}
+		sinfo = psinfo
+		return nil
+	})
+	if err != nil {
+		if sinfo != nil {
+			// undo parts restored by other peers
+			msg := append([]byte{byte(nekolib.OP_DELETE_SERIES)}, sinfo.ToBytes()...)
+			broadcast(msg, nil)
 		}
+		return nil, err
+	}
 
-		hkey := nekolib.TimeSec2Bytes(lower)
-		hs := nekolib.Hash32(hkey)
-		peer, _ := s.backends.GetByKey(hs)
-		start_ts, end_ts := nekolib.TimeBoundary(block[0].Ts, sinfo.FragLevel)
+	sjson, _ := json.Marshal(sinfo)
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_SERIES_DIR, sinfo.Name)
+	if _, err := s.ec.Set(key, string(sjson), 0); err != nil {
+		return nil, err
+	}
+	key = fmt.Sprintf("%s/%s", nekolib.ETCD_DROPPED_DIR, sinfo.Id)
+	if _, err := s.ec.Delete(key, false); err != nil {
+		if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != nekolib.ETCD_KEY_NOT_FOUND {
+			return nil, err
+		}
+	}
+	s.collection.insertSeries(sinfo)
+	return sinfo, nil
+}
 
-		reqHdr := &nekolib.ReqInsertBlockHdr{
-			SeriesName: sname,
-			HashValue:  hs,
-			StartTs:    start_ts,
-			EndTs:      end_ts,
-			Priority:   uint8(0),
-			Count:      uint16(len(block)),
+// updateSeries changes a series in etcd by compare and swap, so that
+// concurrent updates of other fields are not lost. It retries as long as
+// the series is changed meanwhile.
+func updateSeries(sname string, update func(series *nekolib.NekoSeriesInfo)) error {
+	s := getServer()
+	if _, found := s.collection.getSeries(sname); !found {
+		return fmt.Errorf("series %s not found", sname)
+	}
+
+	key := fmt.Sprintf("%s/%s", nekolib.ETCD_SERIES_DIR, sname)
+	for {
+		r, err := s.ec.Get(key, false, false)
+		if err != nil {
+			if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == nekolib.ETCD_KEY_NOT_FOUND {
+				return fmt.Errorf("series %s not found", sname)
+			}
+			return err
+		}
+		series := new(nekolib.NekoSeriesInfo)
+		if err := json.Unmarshal([]byte(r.Node.Value), series); err != nil {
+			return err
 		}
+		update(series)
+		sjson, _ := json.Marshal(series)
+		_, err = s.ec.CompareAndSwap(key, string(sjson), 0, "", r.Node.ModifiedIndex)
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == nekolib.ETCD_TEST_FAILED {
+			continue
+		}
+		return err
+	}
+}
+
+// Update retention of a series, nekod reads it from etcd
+func setRetention(sname string, retention int64) error {
+	return updateSeries(sname, func(series *nekolib.NekoSeriesInfo) {
+		series.Retention = retention
+	})
+}
 
-		peer.Request(func(psock *zmq.Socket) error {
-			buf := bytes.NewBuffer(make([]byte, 0))
-			buf.WriteByte(byte(nekolib.OP_INSERT_BATCH))
-			buf.Write(reqHdr.ToBytes())
-			psock.SendBytes(buf.Bytes(), zmq.SNDMORE)
+// Update the default durability of writes to a series
+func setDurability(sname string, durability uint8) error {
+	return updateSeries(sname, func(series *nekolib.NekoSeriesInfo) {
+		series.Durability = durability
+	})
+}
 
-			buf = bytes.NewBuffer(make([]byte, 0, 1024))
-			for _, r := range block {
-				buf.Write(r.ToBytes())
+// Update the default consistency of writes to a series
+func setConsistency(sname string, consistency uint8) error {
+	return updateSeries(sname, func(series *nekolib.NekoSeriesInfo) {
+		series.Consistency = consistency
+	})
+}
+
+// Replace tags of a series, the index follows through the etcd watch
+func setTags(sname string, tags map[string]string) error {
+	return updateSeries(sname, func(series *nekolib.NekoSeriesInfo) {
+		series.Tags = tags
+	})
+}
+
+// insertBlock sends records of the frag block starting at lower to the
+// peers keeping its replicas and waits for as many acknowledgements as
+// the consistency asks for. Returns the number of records at timestamps
+// already stored.
+func insertBlock(sinfo *nekolib.NekoSeriesInfo, block []*nekolib.NekodRecord, lower int64, durability, consistency uint8) (int, error) {
+	// headers count points in 16 bits, larger blocks go in chunks
+	if len(block) > nekolib.MAX_INSERT_POINTS {
+		duplicates := 0
+		for i := 0; i < len(block); i += nekolib.MAX_INSERT_POINTS {
+			j := i + nekolib.MAX_INSERT_POINTS
+			if j > len(block) {
+				j = len(block)
 			}
-			psock.SendBytes(buf.Bytes(), 0)
-			msg, _ := psock.RecvBytes(0)
-			if uint8(msg[0]) != nekolib.REP_OK {
-				logger.Error("peer %s: %s", peer.Name, string(msg[1:]))
+			dups, err := insertBlock(sinfo, block[i:j], lower, durability, consistency)
+			duplicates += dups
+			if err != nil {
+				return duplicates, err
 			}
-			// logger.Debug("peer %s: %s", peer.Name, string(msg[1:]))
-			return nil
-		})
+		}
+		return duplicates, nil
+	}
+	s := getServer()
+
+	hkey := nekolib.TimeSec2Bytes(lower)
+	hs := nekolib.Hash32(hkey)
+	peers, err := s.backends.GetReplicas(hs, sinfo.ReplicaCount())
+	if err != nil {
+		return 0, err
+	}
+	// acks are required of the replicas the series asks for, a ring too
+	// small to keep them does not meet the consistency
+	required := nekolib.RequiredAcks(consistency, sinfo.ReplicaCount())
+	if len(peers) < required {
+		return 0, fmt.Errorf("consistency %s not met, %d replicas required but only %d peers on the ring",
+			nekolib.ConsistencyName(consistency), required, len(peers))
+	}
+	start_ts, end_ts := nekolib.TimeBoundary(block[0].Ts, sinfo.FragLevel)
+
+	reqHdr := &nekolib.ReqInsertBlockHdr{
+		SeriesName: sinfo.Name,
+		HashValue:  hs,
+		StartTs:    start_ts,
+		EndTs:      end_ts,
+		Priority:   uint8(0),
+		Count:      uint16(len(block)),
+		Durability: durability,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	buf.WriteByte(byte(nekolib.OP_INSERT_BATCH))
+	buf.Write(reqHdr.ToBytes())
+	hdrMsg := buf.Bytes()
+
+	// peers standing in for owners which are away keep hints for them
+	hintMsgs := make(map[string][]byte)
+	for standin, owners := range s.hints.substitutes(hs, peers) {
+		h := *reqHdr
+		h.HintFor = strings.Join(owners, ",")
+		hintMsgs[standin] = append([]byte{byte(nekolib.OP_INSERT_BATCH)}, h.ToBytes()...)
+	}
+
+	buf = bytes.NewBuffer(make([]byte, 0, 1024))
+	for _, r := range block {
+		buf.Write(r.ToBytes())
+	}
+	recMsg := buf.Bytes()
+
+	type blockAck struct {
+		ii  nekolib.NekodInsertInfo
+		err error
+	}
+	// replicas left behind once enough acknowledged still get written
+	acks := make(chan blockAck, len(peers))
+	for _, peer := range peers {
+		go func(peer *nekoRingNode) {
+			msg, found := hintMsgs[peer.RealName]
+			if !found {
+				msg = hdrMsg
+			}
+			ii, err := writeBlock(peer, msg, recMsg)
+			if err != nil {
+				logger.Error(err.Error())
+			}
+			acks <- blockAck{ii, err}
+		}(peer)
+	}
+
+	acked, duplicates := 0, 0
+	failures := []string{}
+	for i := 0; i < len(peers) && acked < required; i++ {
+		ack := <-acks
+		if ack.err != nil {
+			failures = append(failures, ack.err.Error())
+			continue
+		}
+		acked++
+		// replicas may have been out of sync, report the most
+		if ack.ii.Duplicates > duplicates {
+			duplicates = ack.ii.Duplicates
+		}
+	}
+
+	if acked < required {
+		return duplicates, fmt.Errorf("consistency %s not met, %d of %d replicas acknowledged: %s",
+			nekolib.ConsistencyName(consistency), acked, required, strings.Join(failures, "; "))
+	}
+	return duplicates, nil
+}
+
+// writeBlock sends an OP_INSERT_BATCH request to a single peer
+func writeBlock(peer *nekoRingNode, hdrMsg, recMsg []byte) (nekolib.NekodInsertInfo, error) {
+	var ii nekolib.NekodInsertInfo
+	err := peer.Request(func(psock *zmq.Socket) error {
+		psock.SendBytes(hdrMsg, zmq.SNDMORE)
+		psock.SendBytes(recMsg, 0)
+		msg, err := psock.RecvBytes(0)
+		if err != nil {
+			return err
+		}
+		if uint8(msg[0]) != nekolib.REP_OK {
+			return fmt.Errorf("peer %s: %s", peer.Name, string(msg[1:]))
+		}
+		return json.Unmarshal(msg[1:], &ii)
+	})
+	return ii, err
+}
+
+// Error of a single point of an insert
+type insertError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// insertPoints writes a small batch of points, records of each frag block
+// go to the block owner. Returns the number of points written, how many
+// of them hit a timestamp already stored and errors of the rejected ones.
+func insertPoints(sname string, records []*nekolib.NekodRecord, durability, consistency uint8) (int, int, []insertError) {
+	s := getServer()
+	errs := []insertError{}
+
+	sinfo, found := s.collection.getSeries(sname)
+	if !found {
+		err := fmt.Sprintf("series %s not found", sname)
+		for i := range records {
+			errs = append(errs, insertError{i, err})
+		}
+		return 0, 0, errs
+	}
+	durability = nekolib.WriteDurability(durability, sinfo)
+	consistency = nekolib.WriteConsistency(consistency, sinfo)
+
+	type block struct {
+		records []*nekolib.NekodRecord
+		indexes []int
+	}
+	blocks := make(map[int64]*block)
+	for i, r := range records {
+		if len(r.Ts) != nekolib.TS_LEN {
+			errs = append(errs, insertError{i, "invalid timestamp"})
+			continue
+		}
+		// values arrive as text, store them in binary form
+		v, err := sinfo.ParseValue(string(r.Value))
+		if err != nil {
+			errs = append(errs, insertError{i, fmt.Sprintf("invalid %s value %q",
+				nekolib.ValueTypeName(sinfo.ValueType), string(r.Value))})
+			continue
+		}
+		lower, _ := nekolib.TsBoundary(nekolib.Bytes2TimeSec(r.Ts), sinfo.FragLevel)
+		b, found := blocks[lower]
+		if !found {
+			b = new(block)
+			blocks[lower] = b
+		}
+		b.records = append(b.records, &nekolib.NekodRecord{r.Ts, v})
+		b.indexes = append(b.indexes, i)
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	count, duplicates := 0, 0
+	for lower, b := range blocks {
+		wg.Add(1)
+		go func(lower int64, b *block) {
+			defer wg.Done()
+			dups, err := insertBlock(sinfo, b.records, lower, durability, consistency)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				logger.Error(err.Error())
+				for _, i := range b.indexes {
+					errs = append(errs, insertError{i, err.Error()})
+				}
+				return
+			}
+			count += len(b.records)
+			duplicates += dups
+		}(lower, b)
+	}
+	wg.Wait()
+
+	return count, duplicates, errs
+}
+
+// importSeries writes records streamed on sock, returns the number of
+// records written and how many of them hit a timestamp already stored.
+// Blocks not acknowledged by enough replicas make it fail.
+func importSeries(sname string, durability, consistency uint8, sock *zmq.Socket) (int, int, error) {
+	s := getServer()
+
+	sinfo, found := s.collection.getSeries(sname)
+	if !found {
+		return 0, 0, errors.New("Series Not Found")
+	}
+	durability = nekolib.WriteDurability(durability, sinfo)
+	consistency = nekolib.WriteConsistency(consistency, sinfo)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	count, duplicates, failed := 0, 0, 0
+	var lastErr error
 
+	// flush block to coresponding peer
+	flushBlock := func(block []*nekolib.NekodRecord, lower int64) {
+		defer wg.Done()
+		if len(block) < 1 {
+			return
+		}
+		dups, err := insertBlock(sinfo, block, lower, durability, consistency)
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			logger.Error(err.Error())
+			failed += len(block)
+			lastErr = err
+			return
+		}
+		count += len(block)
+		duplicates += dups
 	}
 
 	blk_lower := int64(1<<63 - 1)
 	blk_upper := int64(-1 << 63)
 	var record_blk []*nekolib.NekodRecord
+	invalid := 0
 	// count := 0
 	// count2 := 0
 	for more, _ := sock.GetRcvmore(); more; more, _ = sock.GetRcvmore() {
 		msg, err := sock.RecvBytes(0)
 		if err != nil {
 			logger.Error(err.Error())
-			return err
+			return 0, 0, err
 		}
 
 		for buf := bytes.NewBuffer(msg); buf.Len() > 0; {
@@ -156,7 +617,15 @@ func importSeries(sname string, sock *zmq.Socket) error {
 					break
 				}
 				logger.Error(err.Error())
-				return err
+				return 0, 0, err
+			}
+
+			// values arrive as text, store them in binary form
+			if v, err := sinfo.ParseValue(string(r.Value)); err == nil {
+				r.Value = v
+			} else {
+				invalid++
+				continue
 			}
 
 			ts := nekolib.Bytes2TimeSec(r.Ts)
@@ -164,7 +633,7 @@ func importSeries(sname string, sock *zmq.Socket) error {
 				// count2 += len(record_blk)
 				// logger.Debug("%d, %d", count, count2)
 				wg.Add(1)
-				go flushBlock(record_blk, blk_lower, blk_upper)
+				go flushBlock(record_blk, blk_lower)
 				// Reset Block Cache and Time Range
 				record_blk = make([]*nekolib.NekodRecord, 0, 32)
 				blk_lower, blk_upper = nekolib.TsBoundary(ts, sinfo.FragLevel)
@@ -175,92 +644,232 @@ func importSeries(sname string, sock *zmq.Socket) error {
 	}
 
 	wg.Add(1)
-	flushBlock(record_blk, blk_lower, blk_upper)
+	flushBlock(record_blk, blk_lower)
 	wg.Wait()
 
-	return nil
+	if failed > 0 {
+		return count, duplicates, fmt.Errorf("%d records not written: %s",
+			failed, lastErr.Error())
+	}
+	if invalid > 0 {
+		return count, duplicates, fmt.Errorf("%d records with invalid %s values skipped",
+			invalid, nekolib.ValueTypeName(sinfo.ValueType))
+	}
+	return count, duplicates, nil
+}
+
+// unreadBlocks counts frag blocks of a range which neither their owner nor
+// any replica of them could be read from, final once records are drained
+type unreadBlocks struct {
+	n int32
 }
 
-func getRangeToChan(reqHdr *nekolib.ReqFindByRangeHdr, recordChan chan nekolib.SCNode, msgChan chan map[string]interface{}) error {
+func (u *unreadBlocks) add()       { atomic.AddInt32(&u.n, 1) }
+func (u *unreadBlocks) count() int { return int(atomic.LoadInt32(&u.n)) }
+
+// getRangeToChan reads a range from the peers into recordChan, which is
+// closed once every peer is done. Blocks missing from the records are
+// counted by the returned unreadBlocks.
+func getRangeToChan(reqHdr *nekolib.ReqFindByRangeHdr, recordChan chan nekolib.SCNode, msgChan chan map[string]interface{}) *unreadBlocks {
 	s := getServer()
-	sortedChannel := nekolib.NewSortedChannel(128, recordChan)
+	unread := new(unreadBlocks)
+	if nekolib.IsRollupLayer(reqHdr.Priority) {
+		sorted := make(chan nekolib.SCNode, 1024)
+		go mergeRollups(sorted, recordChan, reqHdr.Priority)
+		recordChan = sorted
+	}
+	// copies read again from replicas after a peer failed, and those of
+	// ranges asked of every peer, are dropped once sorted
+	replicas := make(chan nekolib.SCNode, 1024)
+	go dedupeReplicas(replicas, recordChan)
+	sortedChannel := nekolib.NewSortedChannel(128, replicas)
 
-	visited := make(map[string]bool)
-	s.backends.ForEachSafe(func(n *nekoRingNode) {
-		sortedChannel.AddPublisher(n.RealName)
-	})
+	// unknown series are asked of every peer, which report the error
+	sinfo, found := s.collection.getSeries(reqHdr.SeriesName)
+	if !found {
+		sinfo = nil
+	}
+	owners := ownersOfRange(sinfo, reqHdr.StartTs, reqHdr.EndTs)
+	for name := range owners {
+		sortedChannel.AddPublisher(name)
+	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, 16))
-	buf.WriteByte(byte(nekolib.OP_FIND_RANGE))
-	buf.Write(reqHdr.ToBytes())
-	reqMsg := buf.Bytes()
+	for name, o := range owners {
+		go func(name string, o *rangeOwner) {
+			defer sortedChannel.RemovePublisher(name)
+			bench_start := time.Now()
 
-	s.backends.ForEachSafe(func(n *nekoRingNode) {
-		if _, found := visited[n.RealName]; !found {
-			visited[n.RealName] = true
-			go func() {
-				// logger.Debug(n.RealName)
-				n.Request(func(psock *zmq.Socket) error {
-					bench_start := time.Now()
-					if _, err := psock.SendBytes(reqMsg, 0); err != nil {
-						logger.Error(err.Error())
-						return err
-					}
-					ack, _ := psock.RecvBytes(0)
-					if uint8(ack[0]) != nekolib.REP_ACK {
-						logger.Error("peer %s: %s", n.Name, string(ack[1:]))
-						return errors.New(string(ack[1:]))
-					}
+			var stats map[string]interface{}
+			// records before the last one published were read already
+			// when a span is read again from replicas
+			published, last := false, int64(0)
+			read := func(peer *nekoRingNode, start, end []byte) error {
+				spanHdr := *reqHdr
+				spanHdr.StartTs, spanHdr.EndTs = start, end
+				buf := bytes.NewBuffer(make([]byte, 0, 16))
+				buf.WriteByte(byte(nekolib.OP_FIND_RANGE))
+				buf.Write(spanHdr.ToBytes())
 
-				READ_STREAM:
-					for more, _ := psock.GetRcvmore(); more; more, _ = psock.GetRcvmore() {
-						msg, err := psock.RecvBytes(0)
-						// logger.Debug("yes")
-						if err != nil {
-							logger.Error(err.Error())
-							return err
-						}
+				r, err := readRange(peer, buf.Bytes(), func(rec *nekolib.NekodRecord) {
+					if published && rec.Key() < last {
+						return
+					}
+					published, last = true, rec.Key()
+					sortedChannel.Pub(name, &replicaRecord{rec, peer.RealName})
+				})
+				if err != nil {
+					return err
+				}
+				if stats == nil {
+					stats = r
+				} else if r != nil {
+					stats["count"] = stats["count"].(float64) + r["count"].(float64)
+					stats["duration"] = stats["duration"].(float64) + r["duration"].(float64)
+				}
+				return nil
+			}
 
-						for buf := bytes.NewBuffer(msg); buf.Len() > 0; {
-							r := new(nekolib.NekodRecord)
-							if err := r.FromBytes(buf); err != nil {
-								if err == nekolib.EndOfStream {
-									break READ_STREAM
-								}
-								logger.Error(err.Error())
-								return err
-							}
-							// logger.Debug("%#v", r)
-							sortedChannel.Pub(n.RealName, r)
+			for _, span := range o.spans {
+				if read(o.peer, span.start, span.end) == nil {
+					continue
+				}
+				// blocks of a failed span are read from their other
+				// replicas, one after another. Ranges asked of every peer
+				// have no blocks listed, replicas were asked anyway.
+				for _, b := range span.blocks {
+					done := false
+					for _, peer := range b.replicas {
+						if done = read(peer, b.start, b.end) == nil; done {
+							break
 						}
 					}
-					msg, _ := psock.RecvBytes(0)
-					sortedChannel.RemovePublisher(n.RealName)
-					if uint8(msg[0]) != nekolib.REP_OK {
-						logger.Error("peer %s", n.Name)
-						return errors.New(string(msg[1:]))
+					if !done {
+						unread.add()
 					}
-					if msgChan != nil {
-						var r map[string]interface{}
-						if err := json.Unmarshal(msg[1:], &r); err == nil {
-							r["full_duration"] = time.Since(bench_start).Nanoseconds()
-							msgChan <- r
-						} else {
-							logger.Error(err.Error())
-						}
+				}
+			}
+			if msgChan != nil && stats != nil {
+				stats["full_duration"] = time.Since(bench_start).Nanoseconds()
+				msgChan <- stats
+			}
+		}(name, o)
+	}
+
+	return unread
+}
+
+// readRange sends an OP_FIND_RANGE request to a peer and passes the
+// records read to pub, in time order. Returns the stats of the peer.
+func readRange(n *nekoRingNode, reqMsg []byte, pub func(r *nekolib.NekodRecord)) (map[string]interface{}, error) {
+	var stats map[string]interface{}
+	err := n.Request(func(psock *zmq.Socket) error {
+		if _, err := psock.SendBytes(reqMsg, 0); err != nil {
+			logger.Error(err.Error())
+			return err
+		}
+		ack, _ := psock.RecvBytes(0)
+		if uint8(ack[0]) != nekolib.REP_ACK {
+			logger.Error("peer %s: %s", n.Name, string(ack[1:]))
+			return errors.New(string(ack[1:]))
+		}
+
+	READ_STREAM:
+		for more, _ := psock.GetRcvmore(); more; more, _ = psock.GetRcvmore() {
+			msg, err := psock.RecvBytes(0)
+			if err != nil {
+				logger.Error(err.Error())
+				return err
+			}
+
+			for buf := bytes.NewBuffer(msg); buf.Len() > 0; {
+				r := new(nekolib.NekodRecord)
+				if err := r.FromBytes(buf); err != nil {
+					if err == nekolib.EndOfStream {
+						break READ_STREAM
 					}
-					// logger.Debug("peer %s: %s", n.Name, string(msg[1:]))
-					return nil
-				})
-			}()
+					logger.Error(err.Error())
+					return err
+				}
+				pub(r)
+			}
+		}
+		msg, _ := psock.RecvBytes(0)
+		if uint8(msg[0]) != nekolib.REP_OK {
+			logger.Error("peer %s", n.Name)
+			return errors.New(string(msg[1:]))
 		}
+		if err := json.Unmarshal(msg[1:], &stats); err != nil {
+			logger.Error(err.Error())
+			stats = nil
+		}
+		return nil
 	})
+	return stats, err
+}
 
-	return nil
+// Delete points of a series in [start, end] on every peer, hinted and
+// moving copies included, returns the number of deleted points with
+// copies of replicas counted once
+func deleteRange(sname string, start, end []byte) (int, error) {
+	s := getServer()
+	sinfo, found := s.collection.getSeries(sname)
+	if !found {
+		return 0, fmt.Errorf("series %s not found", sname)
+	}
+
+	reqHdr := &nekolib.ReqDeleteRangeHdr{
+		SeriesName: sname,
+		StartTs:    start,
+		EndTs:      end,
+		Priority:   nekolib.PRIORITY_RAW,
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 16))
+	buf.WriteByte(byte(nekolib.OP_DELETE))
+	buf.Write(reqHdr.ToBytes())
+
+	var mutex sync.Mutex
+	byPeer := make(map[string]map[uint32]int64)
+	err := broadcast(buf.Bytes(), func(n *nekoRingNode, reply []byte) error {
+		var r map[string]interface{}
+		if err := json.Unmarshal(reply, &r); err != nil {
+			return err
+		}
+		if _, ok := r["count"].(float64); !ok {
+			return fmt.Errorf("peer %s: no count of deleted points", n.RealName)
+		}
+		counts, ok := r["blocks"].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("peer %s: no counts of deleted blocks", n.RealName)
+		}
+		blocks := make(map[uint32]int64, len(counts))
+		for k, v := range counts {
+			h, err := strconv.ParseUint(k, 10, 32)
+			c, ok := v.(float64)
+			if err != nil || !ok {
+				return fmt.Errorf("peer %s: bad count of deleted block %s", n.RealName, k)
+			}
+			blocks[uint32(h)] = int64(c)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		byPeer[n.RealName] = blocks
+		return nil
+	})
+	return countBlocks(sinfo, byPeer), err
 }
 
 func getSeriesMeta(sname string) (*nekolib.NekoSeriesMeta, error) {
+	return collectSeriesMeta(sname, nekolib.OP_SERIES_INFO)
+}
 
+// Rebuild element counters of a series on every peer from their data
+func recountSeries(sname string) (*nekolib.NekoSeriesMeta, error) {
+	return collectSeriesMeta(sname, nekolib.OP_RECOUNT)
+}
+
+// collectSeriesMeta sends a per-series request to every peer and sums up
+// the counts they reply with
+func collectSeriesMeta(sname string, opcode uint8) (*nekolib.NekoSeriesMeta, error) {
 	s := getServer()
 	sinfo, found := s.collection.getSeries(sname)
 	if !found {
@@ -268,7 +877,7 @@ func getSeriesMeta(sname string) (*nekolib.NekoSeriesMeta, error) {
 	}
 
 	buf := bytes.NewBuffer(make([]byte, 0, 8))
-	buf.WriteByte(byte(nekolib.OP_SERIES_INFO))
+	buf.WriteByte(byte(opcode))
 	reqHdr := &nekolib.ReqSeriesMetaHdr{
 		SeriesName: sname,
 	}
@@ -317,10 +926,198 @@ func getSeriesMeta(sname string) (*nekolib.NekoSeriesMeta, error) {
 
 	wg.Wait()
 
-	total_count := 0
-	for _, pi := range psinfo {
-		total_count += pi.Count
+	byPeer := make(map[string]map[uint32]int64)
+	for i := range psinfo {
+		byPeer[psinfo[i].Name] = psinfo[i].Blocks
+		psinfo[i].Blocks = nil
 	}
+	total_count := countBlocks(sinfo, byPeer)
 
 	return &nekolib.NekoSeriesMeta{*sinfo, total_count, psinfo}, nil
 }
+
+// countBlocks sums up counts of frag blocks replied by peers, keyed by
+// real name. Replicas keep copies of a block, each one is counted from its
+// first owner on the ring that replied, or else from any peer.
+func countBlocks(sinfo *nekolib.NekoSeriesInfo, byPeer map[string]map[uint32]int64) int {
+	s := getServer()
+	blocks := make(map[uint32]int64)
+	for _, counts := range byPeer {
+		for h, count := range counts {
+			blocks[h] = count
+		}
+	}
+	total_count := 0
+	for h, count := range blocks {
+		if owners, err := s.backends.GetReplicas(h, sinfo.ReplicaCount()); err == nil {
+			for _, owner := range owners {
+				if c, found := byPeer[owner.RealName][h]; found {
+					count = c
+					break
+				}
+			}
+		}
+		total_count += int(count)
+	}
+	return total_count
+}
+
+// frag blocks probed back from the query time before the newest block is
+// looked up on every peer
+const MAX_LAST_PROBES = 8
+
+// lastPoints finds the newest n points of a series not after before, a
+// zero before means now. Frag blocks are probed back from before on their
+// owners, the newest one holding points is looked up on every peer only
+// if none of the last MAX_LAST_PROBES does. Earlier blocks may lie on any
+// peer, so when that block holds fewer than n points the rest are
+// gathered from every peer.
+func lastPoints(sname string, before time.Time, n int) ([]*nekolib.NekodRecord, error) {
+	s := getServer()
+	sinfo, found := s.collection.getSeries(sname)
+	if !found {
+		return nil, fmt.Errorf("series %s not found", sname)
+	}
+	if n < 1 || n > nekolib.MAX_LAST_POINTS {
+		return nil, fmt.Errorf("between 1 and %d points can be asked for", nekolib.MAX_LAST_POINTS)
+	}
+	if before.IsZero() {
+		before = time.Now().UTC()
+	}
+
+	lower, _ := nekolib.TsBoundary(before.Unix()+nekolib.UNIX_TO_INTERNAL, sinfo.FragLevel)
+	step := int64(1) << uint8(sinfo.FragLevel)
+	var records []*nekolib.NekodRecord
+	var err error
+	for i := 0; i < MAX_LAST_PROBES && len(records) == 0; i++ {
+		if i > 0 {
+			lower -= step
+		}
+		if records, err = lastInBlock(sinfo, lower, before, n); err != nil {
+			return nil, err
+		}
+	}
+	if len(records) == 0 {
+		sm, err := getSeriesMeta(sname)
+		if err != nil {
+			return nil, err
+		}
+		var newest time.Time
+		for _, b := range sm.Backends {
+			if t, err := time.Parse(nekolib.ISO8601, b.Last); err == nil && t.After(newest) {
+				newest = t
+			}
+		}
+		if newest.IsZero() {
+			return []*nekolib.NekodRecord{}, nil
+		}
+		if before.Before(newest) {
+			newest = before
+		}
+		lower, _ = nekolib.TsBoundary(newest.Unix()+nekolib.UNIX_TO_INTERNAL, sinfo.FragLevel)
+		if records, err = lastInBlock(sinfo, lower, before, n); err != nil {
+			return nil, err
+		}
+	}
+	if len(records) == n {
+		return records, nil
+	}
+
+	blockStart := nekolib.TimeSec2Time(lower)
+	reqHdr := &nekolib.ReqFindLastHdr{
+		SeriesName: sname,
+		BeforeTs:   nekolib.Time2Bytes(blockStart.Add(-time.Nanosecond)),
+		Count:      uint16(n - len(records)),
+	}
+	msg := append([]byte{byte(nekolib.OP_FIND_LAST)}, reqHdr.ToBytes()...)
+	var mutex sync.Mutex
+	replicas := []*replicaRecord{}
+	err = broadcast(msg, func(node *nekoRingNode, reply []byte) error {
+		precords, err := decodeRecords(reply)
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, r := range precords {
+			replicas = append(replicas, &replicaRecord{r, node.RealName})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// drop copies of replicas, run by run of the same timestamp
+	sortReplicasNewestFirst(replicas)
+	earlier := []*nekolib.NekodRecord{}
+	for i := 0; i < len(replicas); {
+		j := i + 1
+		for j < len(replicas) && replicas[j].Key() == replicas[i].Key() {
+			j++
+		}
+		earlier = append(earlier, pickReplica(replicas[i:j])...)
+		i = j
+	}
+	if len(earlier) > int(reqHdr.Count) {
+		earlier = earlier[:reqHdr.Count]
+	}
+	return append(records, earlier...), nil
+}
+
+// lastInBlock asks an owner of the frag block starting at lower for its
+// newest n points not after before, any replica of the block will do
+func lastInBlock(sinfo *nekolib.NekoSeriesInfo, lower int64, before time.Time, n int) ([]*nekolib.NekodRecord, error) {
+	_, upper := nekolib.TsBoundary(lower, sinfo.FragLevel)
+	blockStart := nekolib.TimeSec2Time(lower)
+	limit := nekolib.TimeSec2Time(upper).Add(-time.Nanosecond)
+	if before.Before(limit) {
+		limit = before
+	}
+	peers, err := getServer().backends.GetReplicas(
+		nekolib.Hash32(nekolib.TimeSec2Bytes(lower)), sinfo.ReplicaCount())
+	if err != nil {
+		return nil, err
+	}
+	reqHdr := &nekolib.ReqFindLastHdr{
+		SeriesName: sinfo.Name,
+		BeforeTs:   nekolib.Time2Bytes(limit),
+		Count:      uint16(n),
+	}
+	msg := append([]byte{byte(nekolib.OP_FIND_LAST)}, reqHdr.ToBytes()...)
+
+	var records []*nekolib.NekodRecord
+	for _, peer := range peers {
+		err = peer.Request(func(psock *zmq.Socket) error {
+			if _, err := psock.SendBytes(msg, 0); err != nil {
+				return err
+			}
+			reply, err := psock.RecvBytes(0)
+			if err != nil {
+				return err
+			}
+			if uint8(reply[0]) != nekolib.REP_OK {
+				return fmt.Errorf("peer %s: %s", peer.Name, string(reply[1:]))
+			}
+			records, err = decodeRecords(reply[1:])
+			return err
+		})
+		if err == nil {
+			break
+		}
+		logger.Error(err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the owner may have filled up with its own earlier blocks
+	found_n := 0
+	for _, r := range records {
+		if t, _ := nekolib.Bytes2Time(r.Ts); t.Before(blockStart) {
+			break
+		}
+		found_n++
+	}
+	return records[:found_n], nil
+}
@@ -19,6 +19,7 @@ package main
 
 import (
 	//    "fmt"
+	"sort"
 	"strings"
 	"sync"
 	// zmq "github.com/pebbe/zmq4"
@@ -29,16 +30,48 @@ import (
 type nekoCollection struct {
 	m    sync.RWMutex
 	coll map[string]*nekolib.NekoSeriesInfo
+	// inverted index of tags, key -> value -> series names
+	index map[string]map[string]map[string]bool
 }
 
 func newNekoCollection() *nekoCollection {
 	c := new(nekoCollection)
 	c.coll = make(map[string]*nekolib.NekoSeriesInfo)
+	c.index = make(map[string]map[string]map[string]bool)
 	return c
 }
 
 func (c *nekoCollection) insertSeries_unsafe(series *nekolib.NekoSeriesInfo) {
+	c.removeSeries_unsafe(series.Name)
 	c.coll[series.Name] = series
+	for k, v := range series.Tags {
+		values, found := c.index[k]
+		if !found {
+			values = make(map[string]map[string]bool)
+			c.index[k] = values
+		}
+		if values[v] == nil {
+			values[v] = make(map[string]bool)
+		}
+		values[v][series.Name] = true
+	}
+}
+
+func (c *nekoCollection) removeSeries_unsafe(sname string) {
+	series, found := c.coll[sname]
+	if !found {
+		return
+	}
+	for k, v := range series.Tags {
+		delete(c.index[k][v], sname)
+		if len(c.index[k][v]) == 0 {
+			delete(c.index[k], v)
+		}
+		if len(c.index[k]) == 0 {
+			delete(c.index, k)
+		}
+	}
+	delete(c.coll, sname)
 }
 
 func (c *nekoCollection) insertSeries(series *nekolib.NekoSeriesInfo) {
@@ -50,7 +83,7 @@ func (c *nekoCollection) insertSeries(series *nekolib.NekoSeriesInfo) {
 func (c *nekoCollection) removeSeries(sname string) {
 	c.m.Lock()
 	defer c.m.Unlock()
-	delete(c.coll, sname)
+	c.removeSeries_unsafe(sname)
 }
 
 func (c *nekoCollection) getSeries(sname string) (*nekolib.NekoSeriesInfo, bool) {
@@ -60,6 +93,63 @@ func (c *nekoCollection) getSeries(sname string) (*nekolib.NekoSeriesInfo, bool)
 	return s, ok
 }
 
+// selectSeries returns series matching all matchers, sorted by name. Equal
+// matchers are looked up in the index, the others filter what is left.
+func (c *nekoCollection) selectSeries(matchers []*nekolib.TagMatcher) []*nekolib.NekoSeriesInfo {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	var names map[string]bool
+	for _, m := range matchers {
+		if m.Op != nekolib.MATCH_EQUAL || m.Value == "" {
+			continue
+		}
+		postings := c.index[m.Key][m.Value]
+		if names == nil {
+			names = make(map[string]bool, len(postings))
+			for name := range postings {
+				names[name] = true
+			}
+			continue
+		}
+		for name := range names {
+			if !postings[name] {
+				delete(names, name)
+			}
+		}
+	}
+
+	candidates := c.coll
+	if names != nil {
+		candidates = make(map[string]*nekolib.NekoSeriesInfo, len(names))
+		for name := range names {
+			candidates[name] = c.coll[name]
+		}
+	}
+
+	list := []*nekolib.NekoSeriesInfo{}
+	for _, series := range candidates {
+		matched := true
+		for _, m := range matchers {
+			if !m.Match(series.Tags) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			list = append(list, series)
+		}
+	}
+	sort.Sort(seriesByName(list))
+	return list
+}
+
+type seriesByName []*nekolib.NekoSeriesInfo
+
+func (l seriesByName) Len() int           { return len(l) }
+func (l seriesByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l seriesByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
 func (c *nekoCollection) String() string {
 	c.m.RLock()
 	defer c.m.RUnlock()
@@ -44,13 +44,19 @@ func initEtcd() error {
 		logger.Error(err.Error())
 		return err
 	}
+	if err = initDeparted(); err != nil {
+		logger.Error(err.Error())
+		return err
+	}
 
 	logger.Info("Watching for peer udpates")
 	go s.ec.Watch(nekolib.ETCD_PEER_DIR, 0, true, s.peerChan, nil)
 	logger.Info("Watching for collection and series udpates")
 	go s.ec.Watch(nekolib.ETCD_SERIES_DIR, 0, true, s.seriesChan, nil)
+	go s.ec.Watch(nekolib.ETCD_DEPARTED_DIR, 0, true, s.departedChan, nil)
 	go handlePeerUpdate()
 	go handleCollectionUpdate()
+	go handleDepartedUpdate()
 	logger.Debug("%v", s.collection)
 
 	return nil
@@ -101,6 +107,9 @@ func handlePeerUpdate() {
 
 		switch update.Action {
 		case "expire", "delete":
+			if n, found := s.backends.Get(vname); found {
+				s.hints.depart(n)
+			}
 			s.backends.Remove(vname)
 		default:
 			var vnode nekolib.NekodPeerInfo
@@ -109,11 +118,13 @@ func handlePeerUpdate() {
 				case nekolib.PEER_FLG_NEW:
 					// logger.Debug("insert")
 					s.backends.Insert(&vnode)
+					s.hints.rejoin(vname, vnode.RealName)
 				case nekolib.PEER_FLG_UPDATE:
 					s.backends.UpdateInfo(vname, &vnode)
 				case nekolib.PEER_FLG_RESET:
 					// logger.Debug("reset")
 					s.backends.ResetPeer(vname, &vnode)
+					s.hints.rejoin(vname, vnode.RealName)
 				default:
 					continue
 				}
@@ -145,3 +156,27 @@ func handleCollectionUpdate() {
 
 	}
 }
+
+// initDeparted reads virtual nodes which left the ring while writes for
+// them were hinted
+func initDeparted() error {
+	s := getServer()
+	r, err := s.ec.Get(nekolib.ETCD_DEPARTED_DIR, true, true)
+	if err != nil {
+		if e, ok := err.(*etcd.EtcdError); ok && e.ErrorCode == nekolib.ETCD_KEY_NOT_FOUND {
+			return nil
+		}
+		return err
+	}
+	for _, vn := range r.Node.Nodes {
+		s.hints.apply("get", vn)
+	}
+	return nil
+}
+
+func handleDepartedUpdate() {
+	s := getServer()
+	for update := range s.departedChan {
+		s.hints.apply(update.Action, update.Node)
+	}
+}
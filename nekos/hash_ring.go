@@ -187,6 +187,9 @@ func (r *nekoBackendRing) Get(name string) (*nekoRingNode, bool) {
 }
 
 func (r *nekoBackendRing) GetByKey(key uint32) (*nekoRingNode, error) {
+	if r.Head == nil {
+		return nil, errors.New("No Peers")
+	}
 	if (key < r.Head.Key) || (key > r.Head.Prev.Key) {
 		return r.Head, nil
 	} else {
@@ -202,6 +205,42 @@ func (r *nekoBackendRing) GetByKey(key uint32) (*nekoRingNode, error) {
 	return nil, errors.New("Not Found")
 }
 
+// GetReplicas returns the owner of key followed by the next nodes
+// clockwise, n of them at most, each of a different real peer
+func (r *nekoBackendRing) GetReplicas(key uint32, n int) ([]*nekoRingNode, error) {
+	r.m.RLock()
+	defer r.m.RUnlock()
+
+	first, err := r.GetByKey(key)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*nekoRingNode{first}
+	seen := map[string]bool{first.RealName: true}
+	for cur := first.Next; cur != first && len(nodes) < n; cur = cur.Next {
+		if !seen[cur.RealName] {
+			seen[cur.RealName] = true
+			nodes = append(nodes, cur)
+		}
+	}
+	return nodes, nil
+}
+
+// PeerRing returns the ring shared with nekod, with the extra nodes on it
+// too
+func (r *nekoBackendRing) PeerRing(extra []nekolib.NekodPeerInfo) *nekolib.PeerRing {
+	peers := append([]nekolib.NekodPeerInfo{}, extra...)
+	r.ForEachSafe(func(node *nekoRingNode) {
+		peers = append(peers, nekolib.NekodPeerInfo{
+			Name:     node.Name,
+			RealName: node.RealName,
+			Hostname: node.Hostname,
+			Port:     node.Port,
+		})
+	})
+	return nekolib.NewPeerRing(peers)
+}
+
 func (r *nekoBackendRing) String() string {
 	nodes := make([]string, 0)
 	for cur := r.Head; cur != nil; {
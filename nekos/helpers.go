@@ -15,3 +15,293 @@
  * Copyright (C) Justin Wong, 2014
  */
 package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Storage layer to read for a query resolution, only numeric series have
+// rollup layers
+func rangePriority(sinfo *nekolib.NekoSeriesInfo, resolution uint32) uint8 {
+	if resolution == 0 || !nekolib.IsNumericValue(sinfo.ValueType) {
+		return nekolib.PRIORITY_RAW
+	}
+	return nekolib.RollupLayer(time.Duration(resolution) * time.Second)
+}
+
+// mergeRollups merges sorted partial aggregates of the same bucket, which
+// come from different frag blocks, into one record at bucket start
+func mergeRollups(in, out chan nekolib.SCNode, priority uint8) {
+	var cur *nekolib.RollupValue
+	var curBucket time.Time
+	flush := func() {
+		if cur != nil {
+			out <- &nekolib.NekodRecord{nekolib.Time2Bytes(curBucket), cur.ToBytes()}
+		}
+	}
+	for n := range in {
+		r := n.(*nekolib.NekodRecord)
+		t, err := nekolib.Bytes2Time(r.Ts)
+		if err != nil {
+			continue
+		}
+		rv := new(nekolib.RollupValue)
+		if err := rv.FromBytes(r.Value); err != nil {
+			logger.Error(err.Error())
+			continue
+		}
+		bucket, _ := nekolib.RollupBucket(t, priority)
+		if cur != nil && bucket.Equal(curBucket) {
+			cur.Merge(rv)
+			continue
+		}
+		flush()
+		cur, curBucket = rv, bucket
+	}
+	flush()
+	close(out)
+}
+
+// beyond this many frag blocks a range goes to every peer
+const MAX_ROUTED_BLOCKS = 256
+
+// Part of a range kept by a peer, bounds are inclusive. Blocks of the span
+// list the other replicas to read them from should the peer fail.
+type rangeSpan struct {
+	start, end []byte
+	blocks     []rangeBlock
+}
+
+// A frag block of a span with its replicas but the first owner
+type rangeBlock struct {
+	start, end []byte
+	replicas   []*nekoRingNode
+}
+
+// rangeOwner is the first owner of frag blocks of a range, with the spans
+// of consecutive blocks it owns in time order
+type rangeOwner struct {
+	peer  *nekoRingNode
+	spans []rangeSpan
+}
+
+// blocksMoving tells whether some peer is taking over blocks from their
+// previous owner, which is the only one to have them until it is done
+func blocksMoving() bool {
+	moving := false
+	getServer().backends.ForEachSafe(func(n *nekoRingNode) {
+		moving = moving || n.State == nekolib.STATE_SYNCING
+	})
+	return moving
+}
+
+// ownersOfRange groups frag blocks of [start, end] by their first owner,
+// keyed by real name. Wide ranges, ranges of unknown series and ranges
+// read while blocks move go to every peer as a whole.
+func ownersOfRange(sinfo *nekolib.NekoSeriesInfo, start, end []byte) map[string]*rangeOwner {
+	s := getServer()
+	owners := make(map[string]*rangeOwner)
+	whole := func() map[string]*rangeOwner {
+		s.backends.ForEachSafe(func(n *nekoRingNode) {
+			if _, found := owners[n.RealName]; !found {
+				owners[n.RealName] = &rangeOwner{n, []rangeSpan{{start, end, nil}}}
+			}
+		})
+		return owners
+	}
+	if sinfo == nil {
+		return whole()
+	}
+
+	lower, _ := nekolib.TsBoundary(nekolib.Bytes2TimeSec(start), sinfo.FragLevel)
+	endSec := nekolib.Bytes2TimeSec(end)
+	step := int64(1) << uint8(sinfo.FragLevel)
+
+	if (endSec-lower)/step > MAX_ROUTED_BLOCKS || blocksMoving() {
+		return whole()
+	}
+
+	// clip bounds in seconds, upper excluded, to the range
+	startT, _ := nekolib.Bytes2Time(start)
+	endT, _ := nekolib.Bytes2Time(end)
+	clip := func(lower, upper int64) (from, to []byte) {
+		from, to = start, end
+		if t := nekolib.TimeSec2Time(lower); t.After(startT) {
+			from = nekolib.Time2Bytes(t)
+		}
+		if t := nekolib.TimeSec2Time(upper).Add(-time.Nanosecond); t.Before(endT) {
+			to = nekolib.Time2Bytes(t)
+		}
+		return from, to
+	}
+
+	// lower bound of the last span of each owner, its upper bound is that
+	// of the last block
+	spanLower := make(map[string]int64)
+	lastUpper := make(map[string]int64)
+	for ; lower <= endSec; lower += step {
+		hs := nekolib.Hash32(nekolib.TimeSec2Bytes(lower))
+		replicas, err := s.backends.GetReplicas(hs, sinfo.ReplicaCount())
+		if err != nil {
+			continue
+		}
+		first := replicas[0]
+		o, found := owners[first.RealName]
+		if !found {
+			o = &rangeOwner{peer: first}
+			owners[first.RealName] = o
+		}
+		if len(o.spans) == 0 || lastUpper[first.RealName] != lower {
+			o.spans = append(o.spans, rangeSpan{})
+			spanLower[first.RealName] = lower
+		}
+		lastUpper[first.RealName] = lower + step
+
+		span := &o.spans[len(o.spans)-1]
+		b := rangeBlock{replicas: replicas[1:]}
+		b.start, b.end = clip(lower, lower+step)
+		span.blocks = append(span.blocks, b)
+		span.start, span.end = clip(spanLower[first.RealName], lower+step)
+	}
+	return owners
+}
+
+// parseTime accepts ISO8601 timestamps or plain dates
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(nekolib.ISO8601, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// broadcast sends msg to every peer once and passes REP_OK replies to op,
+// which may be nil. Failures of all peers are reported together.
+func broadcast(msg []byte, op func(n *nekoRingNode, reply []byte) error) error {
+	s := getServer()
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failures := []string{}
+	visited := make(map[string]bool)
+
+	s.backends.ForEachSafe(func(n *nekoRingNode) {
+		if _, found := visited[n.RealName]; found {
+			return
+		}
+		visited[n.RealName] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := n.Request(func(psock *zmq.Socket) error {
+				if _, err := psock.SendBytes(msg, 0); err != nil {
+					return err
+				}
+				reply, err := psock.RecvBytes(0)
+				if err != nil {
+					return err
+				}
+				if uint8(reply[0]) != nekolib.REP_OK {
+					return errors.New(string(reply[1:]))
+				}
+				if op != nil {
+					return op(n, reply[1:])
+				}
+				return nil
+			})
+			if err != nil {
+				logger.Error("peer %s: %s", n.RealName, err.Error())
+				mutex.Lock()
+				failures = append(failures, fmt.Sprintf("%s: %s", n.RealName, err.Error()))
+				mutex.Unlock()
+			}
+		}()
+	})
+
+	wg.Wait()
+	if len(visited) == 0 {
+		return errors.New("No Peers")
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// decodeRecords reads records packed back to back
+func decodeRecords(b []byte) ([]*nekolib.NekodRecord, error) {
+	records := []*nekolib.NekodRecord{}
+	for buf := bytes.NewBuffer(b); buf.Len() > 0; {
+		r := new(nekolib.NekodRecord)
+		if err := r.FromBytes(buf); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Record read from a replica, tagged with the real name of its peer
+type replicaRecord struct {
+	*nekolib.NekodRecord
+	peer string
+}
+
+// pickReplica takes a run of records at one timestamp and keeps those
+// read from a single peer, the one having most of them. Copies of other
+// replicas are dropped while versions kept by DUP_KEEP_ALL survive.
+func pickReplica(run []*replicaRecord) []*nekolib.NekodRecord {
+	counts := make(map[string]int)
+	best := ""
+	for _, r := range run {
+		counts[r.peer]++
+		if counts[r.peer] > counts[best] {
+			best = r.peer
+		}
+	}
+	records := make([]*nekolib.NekodRecord, 0, counts[best])
+	for _, r := range run {
+		if r.peer == best {
+			records = append(records, r.NekodRecord)
+		}
+	}
+	return records
+}
+
+// dedupeReplicas passes records of in, sorted by time, to out with
+// copies of replicas dropped
+func dedupeReplicas(in, out chan nekolib.SCNode) {
+	run := []*replicaRecord{}
+	flush := func() {
+		for _, r := range pickReplica(run) {
+			out <- r
+		}
+		run = run[:0]
+	}
+	for n := range in {
+		r := n.(*replicaRecord)
+		if len(run) > 0 && r.Key() != run[0].Key() {
+			flush()
+		}
+		run = append(run, r)
+	}
+	flush()
+	close(out)
+}
+
+type replicasNewestFirst []*replicaRecord
+
+func (r replicasNewestFirst) Len() int           { return len(r) }
+func (r replicasNewestFirst) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r replicasNewestFirst) Less(i, j int) bool { return r[i].Key() > r[j].Key() }
+
+func sortReplicasNewestFirst(records []*replicaRecord) {
+	sort.Sort(replicasNewestFirst(records))
+}
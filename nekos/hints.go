@@ -0,0 +1,314 @@
+/*
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, see <http://www.gnu.org/licenses/>.
+ *
+ * Copyright (C) Justin Wong, 2014
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bigeagle/nekodb/nekolib"
+	"github.com/coreos/go-etcd/etcd"
+	zmq "github.com/pebbe/zmq4"
+)
+
+const (
+	HINT_REPLAY_ATTEMPTS = 5
+	HINT_REPLAY_INTERVAL = 10 * time.Second
+)
+
+// hintedHandoff follows virtual nodes which left the ring. They are
+// recorded in etcd so that every nekos picks the same stand-ins. Writes
+// to blocks they own go to the peers standing in for them, which keep a
+// hint of the write until the owner is back.
+type hintedHandoff struct {
+	m         sync.Mutex
+	departed  map[string]nekolib.NekodPeerInfo
+	replaying map[string]bool
+}
+
+func newHintedHandoff() *hintedHandoff {
+	return &hintedHandoff{
+		departed:  make(map[string]nekolib.NekodPeerInfo),
+		replaying: make(map[string]bool),
+	}
+}
+
+func departedKey(vname string) string {
+	return fmt.Sprintf("%s/%s", nekolib.ETCD_DEPARTED_DIR, vname)
+}
+
+// apply follows a change of the departed nodes recorded in etcd
+func (h *hintedHandoff) apply(action string, node *etcd.Node) {
+	if node.Dir || len(node.Key) <= len(nekolib.ETCD_DEPARTED_DIR)+1 {
+		return
+	}
+	vname := node.Key[len(nekolib.ETCD_DEPARTED_DIR)+1:]
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	switch action {
+	case "expire", "delete", "compareAndDelete":
+		delete(h.departed, vname)
+	default:
+		var vnode nekolib.NekodPeerInfo
+		if err := json.Unmarshal([]byte(node.Value), &vnode); err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		h.departed[vname] = vnode
+	}
+}
+
+// depart records a virtual node leaving the ring
+func (h *hintedHandoff) depart(n *nekoRingNode) {
+	vnode := nekolib.NekodPeerInfo{
+		Name:     n.Name,
+		RealName: n.RealName,
+		Hostname: n.Hostname,
+		Port:     n.Port,
+	}
+	h.m.Lock()
+	h.departed[n.Name] = vnode
+	h.m.Unlock()
+
+	j, _ := json.Marshal(vnode)
+	if _, err := getServer().ec.Set(departedKey(n.Name), string(j), 0); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// rejoin forgets a virtual node coming back, finishes drops it missed and
+// hands the writes hinted for its real peer over to it. Of all nekos, the
+// one removing the record of the node from etcd does.
+func (h *hintedHandoff) rejoin(vname, realName string) {
+	h.m.Lock()
+	delete(h.departed, vname)
+	h.m.Unlock()
+
+	if _, err := getServer().ec.Delete(departedKey(vname), false); err != nil {
+		if e, ok := err.(*etcd.EtcdError); !ok || e.ErrorCode != nekolib.ETCD_KEY_NOT_FOUND {
+			logger.Error(err.Error())
+		}
+		return
+	}
+
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.replaying[realName] {
+		return
+	}
+	h.replaying[realName] = true
+	go func() {
+		defer func() {
+			h.m.Lock()
+			delete(h.replaying, realName)
+			h.m.Unlock()
+		}()
+		// drops of series missed while away are finished first
+		if err := finishDrops(); err != nil {
+			logger.Error("finishing drops for %s: %s", realName, err.Error())
+		}
+		for i := 0; i < HINT_REPLAY_ATTEMPTS; i++ {
+			err := replayHints(realName)
+			if err == nil {
+				return
+			}
+			logger.Error("replaying hints for %s: %s", realName, err.Error())
+			time.Sleep(HINT_REPLAY_INTERVAL)
+		}
+	}()
+}
+
+// departedPeers returns real names of the peers with departed nodes
+func (h *hintedHandoff) departedPeers() []string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, p := range h.departed {
+		if !seen[p.RealName] {
+			seen[p.RealName] = true
+			names = append(names, p.RealName)
+		}
+	}
+	return names
+}
+
+// substitutes maps real names of peers which stand in for departed
+// owners of key to the owners they keep hints for
+func (h *hintedHandoff) substitutes(key uint32, peers []*nekoRingNode) map[string][]string {
+	h.m.Lock()
+	if len(h.departed) == 0 {
+		h.m.Unlock()
+		return nil
+	}
+	departed := make([]nekolib.NekodPeerInfo, 0, len(h.departed))
+	for _, p := range h.departed {
+		departed = append(departed, p)
+	}
+	h.m.Unlock()
+
+	current := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		current[p.RealName] = true
+	}
+	intended := getServer().backends.PeerRing(departed).Owners(key, len(peers))
+	owners := make(map[string]bool, len(intended))
+	missing := []string{}
+	for _, o := range intended {
+		owners[o.RealName] = true
+		if !current[o.RealName] {
+			missing = append(missing, o.RealName)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	standins := []string{}
+	for _, p := range peers {
+		if !owners[p.RealName] {
+			standins = append(standins, p.RealName)
+		}
+	}
+	if len(standins) == 0 {
+		// a ring too small to keep every replica, the owner of the block
+		// keeps the hints
+		standins = append(standins, peers[0].RealName)
+	}
+	subs := make(map[string][]string, len(standins))
+	for i, o := range missing {
+		standin := standins[i%len(standins)]
+		subs[standin] = append(subs[standin], o)
+	}
+	return subs
+}
+
+// replayHints fetches writes hinted for a peer from every other peer,
+// hands them to it the way blocks are synced, so that points it stored
+// since are kept, and drops them once written
+func replayHints(owner string) error {
+	s := getServer()
+	var target *nekoRingNode
+	others := []*nekoRingNode{}
+	visited := make(map[string]bool)
+	s.backends.ForEachSafe(func(n *nekoRingNode) {
+		if n.RealName == owner {
+			target = n
+		} else if !visited[n.RealName] {
+			visited[n.RealName] = true
+			others = append(others, n)
+		}
+	})
+	if target == nil {
+		return fmt.Errorf("peer %s not on the ring", owner)
+	}
+
+	reqHdr := &nekolib.ReqHintsHdr{Owner: owner}
+	fetchMsg := append([]byte{byte(nekolib.OP_FETCH_HINTS)}, reqHdr.ToBytes()...)
+	dropMsg := append([]byte{byte(nekolib.OP_DROP_HINTS)}, reqHdr.ToBytes()...)
+
+	var lastErr error
+	for _, n := range others {
+		hints, err := fetchHints(n, fetchMsg)
+		if err == nil && len(hints) > 0 {
+			syncMsg := func(phase uint8) []byte {
+				hdr := &nekolib.ReqSyncHdr{Source: n.RealName, Phase: phase}
+				return append([]byte{byte(nekolib.OP_SYNC)}, hdr.ToBytes()...)
+			}
+			if err = request(target, syncMsg(nekolib.SYNC_BEGIN)); err == nil {
+				for _, h := range hints {
+					if err = request(target, append(syncMsg(nekolib.SYNC_BLOCK), h[0]...), h[1]); err != nil {
+						break
+					}
+				}
+				if endErr := request(target, syncMsg(nekolib.SYNC_END)); err == nil {
+					err = endErr
+				}
+			}
+			if err == nil {
+				err = request(n, dropMsg)
+			}
+			if err == nil {
+				logger.Info("%d hinted writes handed from %s to %s", len(hints), n.RealName, owner)
+			}
+		}
+		if err != nil {
+			logger.Error("peer %s: %s", n.RealName, err.Error())
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// request sends the frames of a message to a single peer and checks it
+// replies REP_OK
+func request(n *nekoRingNode, frames ...[]byte) error {
+	return n.Request(func(psock *zmq.Socket) error {
+		for i, frame := range frames {
+			flag := zmq.SNDMORE
+			if i == len(frames)-1 {
+				flag = 0
+			}
+			if _, err := psock.SendBytes(frame, flag); err != nil {
+				return err
+			}
+		}
+		reply, err := psock.RecvBytes(0)
+		if err != nil {
+			return err
+		}
+		if uint8(reply[0]) != nekolib.REP_OK {
+			return errors.New(string(reply[1:]))
+		}
+		return nil
+	})
+}
+
+// fetchHints returns pairs of the header and the records of hinted writes
+func fetchHints(n *nekoRingNode, msg []byte) ([][2][]byte, error) {
+	hints := [][2][]byte{}
+	err := n.Request(func(psock *zmq.Socket) error {
+		if _, err := psock.SendBytes(msg, 0); err != nil {
+			return err
+		}
+		reply, err := psock.RecvBytes(0)
+		if err != nil {
+			return err
+		}
+		if uint8(reply[0]) != nekolib.REP_OK {
+			return errors.New(string(reply[1:]))
+		}
+		for more, _ := psock.GetRcvmore(); more; more, _ = psock.GetRcvmore() {
+			hdr, err := psock.RecvBytes(0)
+			if err != nil {
+				return err
+			}
+			records, err := psock.RecvBytes(0)
+			if err != nil {
+				return err
+			}
+			hints = append(hints, [2][]byte{hdr, records})
+		}
+		return nil
+	})
+	return hints, err
+}
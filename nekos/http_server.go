@@ -19,6 +19,8 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bigeagle/nekodb/nekolib"
@@ -33,10 +35,16 @@ func serveHTTP(addr string, port int) {
 		return "Hello World"
 	})
 
-	m.Get("/series/", func(r render.Render) {
+	// series may be selected by tag matchers, eg: ?match=site=beijing
+	m.Get("/series/", func(req *http.Request, r render.Render) {
 		s := getServer()
+		matchers, err := nekolib.ParseTagMatchers(req.FormValue("match"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
 		list := []*nekolib.NekoSeriesMeta{}
-		for _, sinfo := range s.collection.coll {
+		for _, sinfo := range s.collection.selectSeries(matchers) {
 			smeta, _ := getSeriesMeta(sinfo.Name)
 			list = append(list, smeta)
 		}
@@ -80,6 +88,208 @@ func serveHTTP(addr string, port int) {
 		r.JSON(200, *sm)
 	})
 
+	m.Post("/series/:name/recount", func(params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+
+		sm, err := recountSeries(params["name"])
+		if err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, *sm)
+	})
+
+	m.Post("/series/:name/snapshot", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+		tag := req.FormValue("tag")
+		if tag == "" {
+			r.JSON(400, map[string]interface{}{"msg": "Snapshot Tag Required"})
+			return
+		}
+		if err := snapshotSeries(params["name"], tag); err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"msg": "OK", "tag": tag})
+	})
+
+	m.Post("/series/:name/restore", func(req *http.Request, params martini.Params, r render.Render) {
+		tag := req.FormValue("tag")
+		if tag == "" {
+			r.JSON(400, map[string]interface{}{"msg": "Snapshot Tag Required"})
+			return
+		}
+		sinfo, err := restoreSeries(params["name"], tag)
+		if err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, *sinfo)
+	})
+
+	m.Put("/series/:name/retention", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+		retention, err := time.ParseDuration(req.FormValue("duration"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		if err := setRetention(params["name"], int64(retention/time.Second)); err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"msg": "OK"})
+	})
+
+	m.Put("/series/:name/tags", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+		tags, err := nekolib.ParseTags(req.FormValue("tags"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		if err := setTags(params["name"], tags); err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"msg": "OK"})
+	})
+
+	m.Put("/series/:name/durability", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+		durability, err := nekolib.ParseDurability(req.FormValue("level"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		if err := setDurability(params["name"], durability); err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"msg": "OK"})
+	})
+
+	m.Put("/series/:name/consistency", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+		consistency, err := nekolib.ParseConsistency(req.FormValue("level"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		if err := setConsistency(params["name"], consistency); err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"msg": "OK"})
+	})
+
+	m.Delete("/series/:name", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		if _, found := s.collection.getSeries(params["name"]); !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+
+		// the whole series is dropped only when asked for explicitly
+		if req.FormValue("drop") == "true" {
+			if req.FormValue("start") != "" || req.FormValue("end") != "" {
+				r.JSON(400, map[string]interface{}{"msg": "Drop Takes No Range"})
+				return
+			}
+			if err := dropSeries(params["name"]); err != nil {
+				r.JSON(500, map[string]interface{}{"msg": err.Error()})
+				return
+			}
+			r.JSON(200, map[string]interface{}{"msg": "OK"})
+			return
+		}
+
+		if req.FormValue("start") == "" || req.FormValue("end") == "" {
+			r.JSON(400, map[string]interface{}{"msg": "Start And End Required"})
+			return
+		}
+		start, err := parseTime(req.FormValue("start"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		end, err := parseTime(req.FormValue("end"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+
+		count, err := deleteRange(params["name"],
+			nekolib.Time2Bytes(start), nekolib.Time2Bytes(end))
+		if err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error(), "count": count})
+			return
+		}
+		r.JSON(200, map[string]interface{}{"count": count})
+	})
+
+	m.Get("/series/:name/last", func(req *http.Request, params martini.Params, r render.Render) {
+		s := getServer()
+		series, found := s.collection.getSeries(params["name"])
+		if !found {
+			r.JSON(404, map[string]interface{}{"msg": "Series Not Found"})
+			return
+		}
+
+		n := 1
+		if req.FormValue("n") != "" {
+			var err error
+			if n, err = strconv.Atoi(req.FormValue("n")); err != nil {
+				r.JSON(400, map[string]interface{}{"msg": err.Error()})
+				return
+			}
+		}
+
+		records, err := lastPoints(params["name"], time.Time{}, n)
+		if err != nil {
+			r.JSON(500, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		data := make([]interface{}, 0, len(records))
+		for _, rec := range records {
+			t, _ := nekolib.Bytes2Time(rec.Ts)
+			v, err := series.DecodeValue(rec.Value)
+			if err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			data = append(data, []interface{}{t.UnixNano() / 1000000, v})
+		}
+		r.JSON(200, map[string]interface{}{
+			"data":  data,
+			"label": series.Name,
+		})
+	})
+
 	m.Get("/series/:name", func(req *http.Request, params martini.Params, r render.Render) {
 		s := getServer()
 		series, found := s.collection.getSeries(params["name"])
@@ -100,58 +310,22 @@ func serveHTTP(addr string, port int) {
 			return
 		}
 
-		reqHdr := &nekolib.ReqFindByRangeHdr{
-			SeriesName: params["name"],
-			StartTs:    nekolib.Time2Bytes(start),
-			EndTs:      nekolib.Time2Bytes(end),
-			Priority:   0,
+		resolution := time.Duration(0)
+		if req.FormValue("resolution") != "" {
+			resolution, err = time.ParseDuration(req.FormValue("resolution"))
+			if err != nil {
+				r.JSON(400, map[string]interface{}{"msg": err.Error()})
+				return
+			}
 		}
 
-		bench_start := time.Now()
-		bench_peers := map[string](map[string]int){}
-		bench := map[string]interface{}{
-			"total_time":  0,
-			"bench_peers": bench_peers,
+		fields, err := series.ParseFieldNames(req.FormValue("fields"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
 		}
 
-		recordChan := make(chan nekolib.SCNode, 1024)
-		msgChan := make(chan map[string]interface{}, 256)
-		done := make(chan struct{})
-		records := make([]interface{}, 0, 1024)
-		go func() {
-			for record := range recordChan {
-				r := record.(*nekolib.NekodRecord)
-				t, _ := nekolib.Bytes2Time(r.Ts)
-				records = append(records,
-					[]interface{}{
-						t.UnixNano() / 1000000, string(r.Value)})
-			}
-			bench["total_time"] = time.Since(bench_start).Nanoseconds()
-			close(msgChan)
-		}()
-		getRangeToChan(reqHdr, recordChan, msgChan)
-
-		go func() {
-			for r := range msgChan {
-				peer := r["peer"].(string)
-				if _, found := bench_peers[peer]; found {
-					bench_peers[peer]["count"] += int(r["count"].(float64))
-					bench_peers[peer]["duration"] += int(r["duration"].(float64))
-					bench_peers[peer]["full_duration"] += int(r["full_duration"].(float64))
-				} else {
-					bench_peers[peer] = map[string]int{
-						"count":         int(r["count"].(float64)),
-						"duration":      int(r["duration"].(float64)),
-						"full_duration": int(r["full_duration"].(int64)),
-					}
-				}
-			}
-			close(done)
-		}()
-
-		<-done
-		logger.Debug("%v", bench)
-
+		records, bench := rangeData(series, start, end, resolution, fields)
 		r.JSON(200, map[string]interface{}{
 			"data":      records,
 			"label":     series.Name,
@@ -159,6 +333,55 @@ func serveHTTP(addr string, port int) {
 		})
 	})
 
+	// range query of every series selected by tag matchers
+	m.Get("/query", func(req *http.Request, r render.Render) {
+		s := getServer()
+		matchers, err := nekolib.ParseTagMatchers(req.FormValue("match"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		if len(matchers) == 0 {
+			r.JSON(400, map[string]interface{}{"msg": "No Tag Matchers"})
+			return
+		}
+
+		layout := "2006-01-02"
+		start, err := time.Parse(layout, req.FormValue("start"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+		end, err := time.Parse(layout, req.FormValue("end"))
+		if err != nil {
+			r.JSON(400, map[string]interface{}{"msg": err.Error()})
+			return
+		}
+
+		resolution := time.Duration(0)
+		if req.FormValue("resolution") != "" {
+			resolution, err = time.ParseDuration(req.FormValue("resolution"))
+			if err != nil {
+				r.JSON(400, map[string]interface{}{"msg": err.Error()})
+				return
+			}
+		}
+
+		results := []interface{}{}
+		for _, series := range s.collection.selectSeries(matchers) {
+			records, bench := rangeData(series, start, end, resolution, nil)
+			results = append(results, map[string]interface{}{
+				"data":          records,
+				"label":         series.Name,
+				"tags":          series.Tags,
+				"unread_blocks": bench["unread_blocks"],
+			})
+		}
+		r.JSON(200, map[string]interface{}{
+			"series": results,
+		})
+	})
+
 	m.Handlers(
 		render.Renderer(),
 	)
@@ -169,3 +392,81 @@ func serveHTTP(addr string, port int) {
 	logger.Info("Serving REST API at %s:%d", addr, port)
 	http.ListenAndServe(fmt.Sprintf("%s:%d", addr, port), m)
 }
+
+// rangeData reads points of a series for the HTTP API, each point is
+// [time in ms, value], or [time in ms, mean, min, max, count] for rollups.
+// Values of multi-field series keep the given fields, all if empty.
+func rangeData(series *nekolib.NekoSeriesInfo, start, end time.Time, resolution time.Duration, fields []string) ([]interface{}, map[string]interface{}) {
+	reqHdr := &nekolib.ReqFindByRangeHdr{
+		SeriesName: series.Name,
+		StartTs:    nekolib.Time2Bytes(start),
+		EndTs:      nekolib.Time2Bytes(end),
+		Resolution: uint32(resolution / time.Second),
+		Fields:     strings.Join(fields, ","),
+	}
+	reqHdr.Priority = rangePriority(series, reqHdr.Resolution)
+	rollup := nekolib.IsRollupLayer(reqHdr.Priority)
+
+	bench_start := time.Now()
+	bench_peers := map[string](map[string]int){}
+	bench := map[string]interface{}{
+		"total_time":  0,
+		"bench_peers": bench_peers,
+	}
+
+	recordChan := make(chan nekolib.SCNode, 1024)
+	msgChan := make(chan map[string]interface{}, 256)
+	done := make(chan struct{})
+	records := make([]interface{}, 0, 1024)
+	go func() {
+		for record := range recordChan {
+			r := record.(*nekolib.NekodRecord)
+			t, _ := nekolib.Bytes2Time(r.Ts)
+			if rollup {
+				// [t, mean, min, max, count]
+				rv := new(nekolib.RollupValue)
+				if err := rv.FromBytes(r.Value); err != nil {
+					logger.Error(err.Error())
+					continue
+				}
+				records = append(records,
+					[]interface{}{t.UnixNano() / 1000000, rv.Mean(), rv.Min, rv.Max, rv.Count})
+				continue
+			}
+			v, err := series.DecodeValue(r.Value)
+			if err != nil {
+				logger.Error(err.Error())
+				continue
+			}
+			records = append(records,
+				[]interface{}{t.UnixNano() / 1000000, v})
+		}
+		bench["total_time"] = time.Since(bench_start).Nanoseconds()
+		close(msgChan)
+	}()
+	unread := getRangeToChan(reqHdr, recordChan, msgChan)
+
+	go func() {
+		for r := range msgChan {
+			peer := r["peer"].(string)
+			if _, found := bench_peers[peer]; found {
+				bench_peers[peer]["count"] += int(r["count"].(float64))
+				bench_peers[peer]["duration"] += int(r["duration"].(float64))
+				bench_peers[peer]["full_duration"] += int(r["full_duration"].(float64))
+			} else {
+				bench_peers[peer] = map[string]int{
+					"count":         int(r["count"].(float64)),
+					"duration":      int(r["duration"].(float64)),
+					"full_duration": int(r["full_duration"].(int64)),
+				}
+			}
+		}
+		close(done)
+	}()
+
+	<-done
+	// points of these blocks are missing from records
+	bench["unread_blocks"] = unread.count()
+	logger.Debug("%v", bench)
+	return records, bench
+}
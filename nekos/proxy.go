@@ -31,9 +31,11 @@ type nekoServer struct {
 	cfg                  *nekosConfig
 	ec                   *etcd.Client
 	peerChan, seriesChan chan *etcd.Response
+	departedChan         chan *etcd.Response
 	backends             *nekoBackendRing
 	reqPools             map[string]*nekolib.ReqPool
 	collection           *nekoCollection
+	hints                *hintedHandoff
 }
 
 func startNekoServer(cfg *nekosConfig) error {
@@ -41,9 +43,11 @@ func startNekoServer(cfg *nekosConfig) error {
 	srv.cfg = cfg
 	srv.peerChan = make(chan *etcd.Response)
 	srv.seriesChan = make(chan *etcd.Response)
+	srv.departedChan = make(chan *etcd.Response)
 	srv.reqPools = make(map[string]*nekolib.ReqPool)
 	srv.backends = newNekoBackendRing()
 	srv.collection = newNekoCollection()
+	srv.hints = newHintedHandoff()
 	if err := srv.init(); err != nil {
 		return err
 	}
@@ -20,6 +20,7 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"time"
 	// "encoding/binary"
 	"github.com/bigeagle/nekodb/nekolib"
@@ -32,7 +33,14 @@ var ReqHandlerMap = map[uint8](func(*nekoWorker, []byte) ([]byte, error)){
 	nekolib.OP_NEW_SERIES:    ReqNewSeries,
 	nekolib.OP_IMPORT_SERIES: ReqImportSeries,
 	nekolib.OP_FIND_RANGE:    ReqFindByRange,
+	nekolib.OP_INSERT:        ReqInsert,
+	nekolib.OP_DELETE:        ReqDeleteRange,
+	nekolib.OP_DELETE_SERIES: ReqDropSeries,
 	nekolib.OP_LIST_SERIES:   ReqListSeries,
+	nekolib.OP_RECOUNT:       ReqRecount,
+	nekolib.OP_SNAPSHOT:      ReqSnapshot,
+	nekolib.OP_RESTORE:       ReqRestore,
+	nekolib.OP_FIND_LAST:     ReqFindLast,
 }
 
 type nekoWorker struct {
@@ -88,18 +96,62 @@ func ReqImportSeries(w *nekoWorker, packBytes []byte) ([]byte, error) {
 	reqHdr := new(nekolib.ReqImportSeriesHdr)
 	reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:]))
 	logger.Debug("worker %d: %v", w.id, *reqHdr)
-	err := importSeries(reqHdr.SeriesName, w.sock)
+	count, dups, err := importSeries(reqHdr.SeriesName, reqHdr.Durability, reqHdr.Consistency, w.sock)
 	if err != nil {
 		return []byte{}, err
-	} else {
-		return []byte("success"), err
 	}
+	policy := nekolib.DUP_LAST_WINS
+	if sinfo, found := w.srv.collection.getSeries(reqHdr.SeriesName); found {
+		policy = sinfo.DuplicatePolicy
+	}
+	return json.Marshal(map[string]interface{}{
+		"count":            count,
+		"duplicates":       dups,
+		"duplicate_policy": nekolib.DuplicatePolicyName(policy),
+	})
+}
+
+func ReqInsert(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqInsertHdr)
+	buf := bytes.NewBuffer(packBytes[1:])
+	if err := reqHdr.FromBytes(buf); err != nil {
+		return []byte{}, err
+	}
+	if reqHdr.Count > nekolib.MAX_INSERT_POINTS {
+		return []byte{}, fmt.Errorf("at most %d points per insert, use import instead",
+			nekolib.MAX_INSERT_POINTS)
+	}
+
+	records := make([]*nekolib.NekodRecord, 0, reqHdr.Count)
+	for i := 0; i < int(reqHdr.Count); i++ {
+		r := new(nekolib.NekodRecord)
+		if err := r.FromBytes(buf); err != nil {
+			return []byte{}, err
+		}
+		records = append(records, r)
+	}
+
+	count, dups, errs := insertPoints(reqHdr.SeriesName, records, reqHdr.Durability, reqHdr.Consistency)
+	return json.Marshal(map[string]interface{}{
+		"count":      count,
+		"duplicates": dups,
+		"errors":     errs,
+	})
 }
 
 func ReqFindByRange(w *nekoWorker, packBytes []byte) ([]byte, error) {
 	reqHdr := new(nekolib.ReqFindByRangeHdr)
 	reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:]))
 
+	sinfo, found := w.srv.collection.getSeries(reqHdr.SeriesName)
+	if !found {
+		return []byte{}, fmt.Errorf("series %s not found", reqHdr.SeriesName)
+	}
+	reqHdr.Priority = rangePriority(sinfo, reqHdr.Resolution)
+	if _, err := sinfo.ParseFieldNames(reqHdr.Fields); err != nil {
+		return []byte{}, err
+	}
+
 	bench_start := time.Now()
 	bench_peers := map[string](map[string]int){}
 	bench := map[string]interface{}{
@@ -111,13 +163,16 @@ func ReqFindByRange(w *nekoWorker, packBytes []byte) ([]byte, error) {
 	recordChan := make(chan nekolib.SCNode, 1024)
 	done := make(chan struct{})
 	go func() {
+		// ACK carries series info and the layer read so that clients
+		// can decode values
 		w.sock.SendBytes(
-			nekolib.MakeResponse(nekolib.REP_ACK, "Starting Query"),
+			nekolib.MakeResponse(nekolib.REP_ACK,
+				append(sinfo.ToBytes(), reqHdr.Priority)),
 			zmq.SNDMORE,
 		)
 		for record := range recordChan {
-			w.sock.SendBytes(record.(*nekolib.NekodRecord).ToBytes(),
-				zmq.SNDMORE)
+			r := record.(*nekolib.NekodRecord)
+			w.sock.SendBytes(r.ToBytes(), zmq.SNDMORE)
 		}
 		w.sock.SendBytes([]byte{0, 0}, zmq.SNDMORE)
 		bench["total_time"] = time.Since(bench_start).Nanoseconds()
@@ -125,7 +180,7 @@ func ReqFindByRange(w *nekoWorker, packBytes []byte) ([]byte, error) {
 		close(msgChan)
 	}()
 
-	getRangeToChan(reqHdr, recordChan, msgChan)
+	unread := getRangeToChan(reqHdr, recordChan, msgChan)
 
 	go func() {
 		for r := range msgChan {
@@ -146,14 +201,52 @@ func ReqFindByRange(w *nekoWorker, packBytes []byte) ([]byte, error) {
 	}()
 
 	<-done
+	// the stream looked complete, the error tells it was not
+	if n := unread.count(); n > 0 {
+		return []byte{}, fmt.Errorf("%d frag blocks could not be read from any replica", n)
+	}
 	return json.Marshal(bench)
 }
 
+func ReqDeleteRange(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqDeleteRangeHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+
+	count, err := deleteRange(reqHdr.SeriesName, reqHdr.StartTs, reqHdr.EndTs)
+	if err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(map[string]interface{}{"count": count})
+}
+
+func ReqDropSeries(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqSeriesMetaHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+
+	if err := dropSeries(reqHdr.SeriesName); err != nil {
+		return []byte{}, err
+	}
+	return []byte("success"), nil
+}
+
+// ReqListSeries lists series selected by tag matchers, requests without
+// a header list every series
 func ReqListSeries(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqListSeriesHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+	matchers, err := nekolib.ParseTagMatchers(reqHdr.Match)
+	if err != nil {
+		return []byte{}, err
+	}
 
-	s := getServer()
 	list := []*nekolib.NekoSeriesMeta{}
-	for _, sinfo := range s.collection.coll {
+	for _, sinfo := range w.srv.collection.selectSeries(matchers) {
 		smeta, _ := getSeriesMeta(sinfo.Name)
 		list = append(list, smeta)
 	}
@@ -161,3 +254,69 @@ func ReqListSeries(w *nekoWorker, packBytes []byte) ([]byte, error) {
 	j, _ := json.Marshal(list)
 	return j, nil
 }
+
+func ReqRecount(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqSeriesMetaHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+
+	smeta, err := recountSeries(reqHdr.SeriesName)
+	if err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(smeta)
+}
+
+func ReqSnapshot(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqSnapshotHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+
+	if err := snapshotSeries(reqHdr.SeriesName, reqHdr.Tag); err != nil {
+		return []byte{}, err
+	}
+	return []byte("success"), nil
+}
+
+func ReqRestore(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqSnapshotHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+
+	sinfo, err := restoreSeries(reqHdr.SeriesName, reqHdr.Tag)
+	if err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(sinfo)
+}
+
+// ReqFindLast replies with series info followed by the newest points,
+// newest first. A zero BeforeTs sets no limit.
+func ReqFindLast(w *nekoWorker, packBytes []byte) ([]byte, error) {
+	reqHdr := new(nekolib.ReqFindLastHdr)
+	if err := reqHdr.FromBytes(bytes.NewBuffer(packBytes[1:])); err != nil {
+		return []byte{}, err
+	}
+	before, err := nekolib.Bytes2Time(reqHdr.BeforeTs)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	// the series may be dropped meanwhile, its info is kept from here
+	sinfo, found := w.srv.collection.getSeries(reqHdr.SeriesName)
+	if !found {
+		return []byte{}, fmt.Errorf("series %s not found", reqHdr.SeriesName)
+	}
+	records, err := lastPoints(reqHdr.SeriesName, before, int(reqHdr.Count))
+	if err != nil {
+		return []byte{}, err
+	}
+	buf := bytes.NewBuffer(sinfo.ToBytes())
+	for _, r := range records {
+		buf.Write(r.ToBytes())
+	}
+	return buf.Bytes(), nil
+}